@@ -6,7 +6,9 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Sirupsen/logrus"
@@ -17,46 +19,156 @@ type SenderReceiver interface {
 	connect(r *Room) error
 	start(r *Room, inbound chan *PacketEvent, outbound chan *PacketEvent)
 	stop()
+	// reconnect drops the current connection and establishes a new one.
+	reconnect(r *Room) error
+	// close closes the connection for good. It is called after stop.
+	close() error
 }
 
+// DefaultEndpoint is the server WSSenderReceiver connects to unless
+// WithEndpoint is given.
+const DefaultEndpoint = "wss://euphoria.io"
+
 type WSSenderReceiver struct {
 	conn     *websocket.Conn
 	Room     string
 	stopChan chan empty
 	wg       sync.WaitGroup
 	logger   *logrus.Logger
+	// closed is set once close is called, so that the resulting read error
+	// does not trigger a reconnect.
+	closed    int32
+	endpoint  string
+	tlsConfig *tls.Config
+	// optErr records an invalid option, returned when connecting.
+	optErr error
+	// keepalive is how often a websocket ping is sent, if at all, and
+	// pongTimeout how long to wait for a pong before reconnecting.
+	keepalive   time.Duration
+	pongTimeout time.Duration
+}
+
+// WSOption configures a WSSenderReceiver.
+type WSOption func(ws *WSSenderReceiver) error
+
+// WithEndpoint connects to the euphoria-compatible server at endpoint, such
+// as "wss://heim.example.com", instead of DefaultEndpoint. The scheme must be
+// ws or wss.
+func WithEndpoint(endpoint string) WSOption {
+	return func(ws *WSSenderReceiver) error {
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return err
+		}
+		if u.Scheme != "ws" && u.Scheme != "wss" {
+			return fmt.Errorf("Endpoint scheme must be ws or wss, got '%s'.", u.Scheme)
+		}
+		ws.endpoint = strings.TrimSuffix(endpoint, "/")
+		return nil
+	}
+}
+
+// WithTLSConfig uses config for wss connections, for example to trust a
+// private CA.
+func WithTLSConfig(config *tls.Config) WSOption {
+	return func(ws *WSSenderReceiver) error {
+		ws.tlsConfig = config
+		return nil
+	}
+}
+
+// WithKeepalive sends a websocket ping every interval, independent of
+// euphoria's ping-events, so that idle connections are not dropped by proxies.
+// If no pong arrives within timeout the connection is dropped and
+// reestablished. A zero timeout defaults to twice interval. Pongs are not
+// read during the second spent authenticating after connecting, so timeout
+// should be well over a second.
+func WithKeepalive(interval, timeout time.Duration) WSOption {
+	return func(ws *WSSenderReceiver) error {
+		if interval <= 0 {
+			return fmt.Errorf("Keepalive interval must be positive, got %s.", interval)
+		}
+		if timeout <= 0 {
+			timeout = 2 * interval
+		}
+		ws.keepalive = interval
+		ws.pongTimeout = timeout
+		return nil
+	}
 }
 
-func NewWSSenderReceiver(room string, logger *logrus.Logger) *WSSenderReceiver {
-	return &WSSenderReceiver{
+// NewWSSenderReceiver returns a WSSenderReceiver for room. An invalid option
+// is reported when connecting.
+func NewWSSenderReceiver(room string, logger *logrus.Logger, opts ...WSOption) *WSSenderReceiver {
+	ws := &WSSenderReceiver{
 		Room:     room,
 		stopChan: make(chan empty, 2),
 		logger:   logger,
+		endpoint: DefaultEndpoint,
 	}
+	for _, opt := range opts {
+		if err := opt(ws); err != nil && ws.optErr == nil {
+			ws.optErr = err
+		}
+	}
+	return ws
+}
+
+// roomURL returns the websocket URL of the room.
+func (ws *WSSenderReceiver) roomURL() string {
+	return fmt.Sprintf("%s/room/%s/ws", ws.endpoint, ws.Room)
 }
 
 func (ws *WSSenderReceiver) connectOnce(r *Room) error {
 	ws.logger.Debug("Attempting connection...")
-	tlsConn, err := tls.Dial("tcp", "euphoria.io:443", &tls.Config{})
-	if err != nil {
-		ws.logger.Error("Error connecting via tls.")
-		return err
-	}
-	roomURL, err := url.Parse(fmt.Sprintf("wss://euphoria.io/room/%s/ws", ws.Room))
-	if err != nil {
-		return err
+	dialer := &websocket.Dialer{
+		TLSClientConfig: ws.tlsConfig,
+		ReadBufferSize:  4096,
+		WriteBufferSize: 4096,
 	}
-	wsConn, _, err := websocket.NewClient(tlsConn, roomURL, http.Header{}, 4096, 4096)
+	wsConn, _, err := dialer.Dial(ws.roomURL(), http.Header{})
 	if err != nil {
 		ws.logger.Error("Error connecting via websocket.")
 		return err
 	}
 	ws.logger.Debug("Connection success.")
 	ws.conn = wsConn
+	if ws.keepalive > 0 {
+		lastPong := time.Now().UnixNano()
+		wsConn.SetPongHandler(func(string) error {
+			atomic.StoreInt64(&lastPong, time.Now().UnixNano())
+			return nil
+		})
+		go ws.keepAlive(wsConn, &lastPong)
+	}
 	return nil
 }
 
+// keepAlive pings conn every keepalive interval until it is closed, closing
+// it if no pong has been received, as recorded in lastPong, within
+// pongTimeout. The receiver then notices the read error and connects again.
+func (ws *WSSenderReceiver) keepAlive(conn *websocket.Conn, lastPong *int64) {
+	ticker := time.NewTicker(ws.keepalive)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		if atomic.LoadInt32(&ws.closed) == 1 {
+			return
+		}
+		if now.Sub(time.Unix(0, atomic.LoadInt64(lastPong))) > ws.pongTimeout {
+			ws.logger.Warningf("No pong received in %s, reconnecting.", ws.pongTimeout)
+			conn.Close()
+			return
+		}
+		if err := conn.WriteControl(websocket.PingMessage, nil, now.Add(ws.keepalive)); err != nil {
+			return
+		}
+	}
+}
+
 func (ws *WSSenderReceiver) connect(r *Room) error {
+	if ws.optErr != nil {
+		return ws.optErr
+	}
 	if err := ws.connectOnce(r); err != nil {
 		for i := 0; i < 5; i++ {
 			time.Sleep(time.Duration(i+1) * time.Second * 10)
@@ -69,16 +181,28 @@ func (ws *WSSenderReceiver) connect(r *Room) error {
 			return err
 		}
 	}
-	if r.config.Password != "" {
-		r.Logger.Debugln("Sending auth.")
-		r.SendAuth()
-	}
+	// The passcode is only sent when the server asks for it with a
+	// bounce-event, so that it never reaches a room that did not.
 	time.Sleep(time.Second)
 	r.Logger.Debugln("Sending nick.")
-	r.SendNick(r.config.Nick)
+	// The reply arrives once the receive loop is running, so don't wait here.
+	go func() {
+		if _, err := r.SetNick(r.config.Nick); err != nil {
+			r.Logger.Errorf("Could not set nick: %s", err)
+		}
+	}()
 	return nil
 }
 
+// reconnect closes the connection; the receiver notices the read error and
+// connects again.
+func (ws *WSSenderReceiver) reconnect(r *Room) error {
+	if ws.conn == nil {
+		return ws.connect(r)
+	}
+	return ws.conn.Close()
+}
+
 func (ws *WSSenderReceiver) sendJSON(r *Room, msg interface{}) error {
 	if err := ws.conn.WriteJSON(msg); err != nil {
 		if err = ws.connect(r); err != nil {
@@ -109,6 +233,9 @@ func (ws *WSSenderReceiver) sender(r *Room, outbound chan *PacketEvent) {
 func (ws *WSSenderReceiver) receiveMessage(r *Room) (*PacketEvent, error) {
 	_, msg, err := ws.conn.ReadMessage()
 	if err != nil {
+		if atomic.LoadInt32(&ws.closed) == 1 {
+			return &PacketEvent{}, err
+		}
 		if err = ws.connect(r); err != nil {
 			return &PacketEvent{}, err
 		}
@@ -130,6 +257,9 @@ func (ws *WSSenderReceiver) receiveMessage(r *Room) (*PacketEvent, error) {
 func (ws *WSSenderReceiver) receivePacket(r *Room, packetCh chan *PacketEvent) {
 	packet, err := ws.receiveMessage(r)
 	if err != nil {
+		if atomic.LoadInt32(&ws.closed) == 1 {
+			return
+		}
 		panic(err)
 	}
 	packetCh <- packet
@@ -161,6 +291,20 @@ func (ws *WSSenderReceiver) start(r *Room, inbound chan *PacketEvent, outbound c
 	}()
 }
 
+// close sends a close frame and closes the connection.
+func (ws *WSSenderReceiver) close() error {
+	atomic.StoreInt32(&ws.closed, 1)
+	if ws.conn == nil {
+		return nil
+	}
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	err := ws.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	if cerr := ws.conn.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
 func (ws *WSSenderReceiver) stop() {
 	ws.stopChan <- empty{}
 	ws.stopChan <- empty{}
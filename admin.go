@@ -0,0 +1,110 @@
+package maimai
+
+import "strings"
+
+// commandOf returns the first word of content, which for a command message is
+// the command name including its prefix.
+func commandOf(content string) string {
+	fields := strings.Fields(content)
+	if len(fields) == 0 {
+		return ""
+	}
+	return fields[0]
+}
+
+// WithAdminOnly wraps h so that send-events from users whose ID is not in
+// adminIDs never reach it. User IDs are used rather than nicks, which anyone
+// can take. If a filtered message invokes one of commands, the sender is told
+// they are not authorized.
+func WithAdminOnly(h Handler, adminIDs []string, commands ...string) Handler {
+	admins := make(map[string]empty)
+	for _, id := range adminIDs {
+		admins[id] = empty{}
+	}
+	gated := make(map[string]empty)
+	for _, cmd := range commands {
+		gated[cmd] = empty{}
+	}
+	return withSendEventFilter(h, func(room *Room, data *Message) bool {
+		if _, ok := admins[data.Sender.ID]; ok {
+			return true
+		}
+		if _, ok := gated[commandOf(room.commandContent(data.Content))]; ok {
+			room.SendText(room.render("unauthorized", nil), data.ID)
+		}
+		return false
+	})
+}
+
+// WithNonBlankContent wraps h so that send-events whose content is empty or
+// only whitespace never reach it. The built-in command handlers are wrapped
+// with it.
+func WithNonBlankContent(h Handler) Handler {
+	return withSendEventFilter(h, func(room *Room, data *Message) bool {
+		return strings.TrimSpace(data.Content) != ""
+	})
+}
+
+// WithoutEncrypted wraps h so that send-events with encrypted content never
+// reach it. The built-in command handlers are wrapped with it.
+func WithoutEncrypted(h Handler) Handler {
+	return withSendEventFilter(h, func(room *Room, data *Message) bool {
+		if data.IsEncrypted() {
+			room.Logger.Debugf("Skipping encrypted message %s from %s.", data.ID, data.Sender.Name)
+			return false
+		}
+		return true
+	})
+}
+
+// withSendEventFilter wraps h so that only the send-events for which keep
+// returns true reach it. Other packets are passed through.
+func withSendEventFilter(h Handler, keep func(room *Room, data *Message) bool) Handler {
+	return func(room *Room, input chan PacketEvent, cmdChan chan string) {
+		filtered := make(chan PacketEvent, 4)
+		done := make(chan empty)
+		defer close(done)
+		go func() {
+			for {
+				select {
+				case packet := <-input:
+					if packet.Type == SendEventType && !keep(room, GetMessagePayload(&packet)) {
+						continue
+					}
+					select {
+					case filtered <- packet:
+					case <-done:
+						return
+					}
+				case <-done:
+					return
+				}
+			}
+		}()
+		h(room, filtered, cmdChan)
+	}
+}
+
+// ShutdownCommandHandler handles a send-event, checks for a !shutdown command,
+// says goodbye, and shuts the room down. It should be wrapped with
+// WithAdminOnly.
+func ShutdownCommandHandler(room *Room, input chan PacketEvent, cmdChan chan string) {
+	for {
+		select {
+		case packet := <-input:
+			if packet.Type != SendEventType {
+				continue
+			}
+			data := GetMessagePayload(&packet)
+			if room.commandContent(data.Content) == "!shutdown" {
+				room.Logger.Warningf("Shutdown requested by %s (%s)", data.Sender.Name, data.Sender.ID)
+				room.SendText(room.render("shutdown", nil), data.ID)
+				room.Shutdown()
+			}
+		case cmd := <-cmdChan:
+			if cmd == "kill" {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package maimai
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+const aliasUsage = "Usage: !alias add <!trigger> <response>, !alias remove <!trigger>, or !alias list"
+
+// storeAlias records an alias. Aliases are stored in a per-room bucket within
+// the "Aliases" bucket, keyed by their trigger in its DefaultCommandPrefix
+// form.
+func (r *Room) storeAlias(trigger, response string) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket([]byte("Aliases")).CreateBucketIfNotExists([]byte(r.name))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(trigger), []byte(response))
+	})
+}
+
+// deleteAlias deletes the alias for trigger, reporting whether there was one.
+func (r *Room) deleteAlias(trigger string) (bool, error) {
+	found := false
+	err := r.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("Aliases")).Bucket([]byte(r.name))
+		if b == nil || b.Get([]byte(trigger)) == nil {
+			return nil
+		}
+		found = true
+		return b.Delete([]byte(trigger))
+	})
+	return found, err
+}
+
+// retrieveAlias returns the response for trigger, or "" if there is none.
+func (r *Room) retrieveAlias(trigger string) (string, error) {
+	var response string
+	err := r.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("Aliases")).Bucket([]byte(r.name))
+		if b != nil {
+			response = string(b.Get([]byte(trigger)))
+		}
+		return nil
+	})
+	return response, err
+}
+
+// retrieveAliasTriggers returns the triggers of every alias, sorted.
+func (r *Room) retrieveAliasTriggers() ([]string, error) {
+	var triggers []string
+	err := r.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("Aliases")).Bucket([]byte(r.name))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			triggers = append(triggers, string(k))
+			return nil
+		})
+	})
+	sort.Strings(triggers)
+	return triggers, err
+}
+
+func (r *Room) isAdmin(userID string) bool {
+	for _, id := range r.config.Admins {
+		if id == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// AliasHandler handles send-events, replying to alias triggers with their
+// responses, and handles the !alias command with which admins add, remove,
+// and list aliases. Aliases may not shadow built-in commands, and responses
+// may not start with the command prefix, so an alias can never trigger
+// another command.
+func AliasHandler(room *Room, input chan PacketEvent, cmdChan chan string) {
+	for {
+		select {
+		case packet := <-input:
+			if packet.Type != SendEventType {
+				continue
+			}
+			data := GetMessagePayload(&packet)
+			content := room.commandContent(data.Content)
+			cmd := commandOf(content)
+			if cmd == "" {
+				continue
+			}
+			if cmd != "!alias" {
+				response, err := room.retrieveAlias(cmd)
+				if err != nil {
+					room.errChan <- err
+					return
+				}
+				if response != "" {
+					room.SendText(SanitizeContent(response), data.ID)
+				}
+				continue
+			}
+			if err := room.handleAliasCommand(data, ParseArgs(content)); err != nil {
+				room.errChan <- err
+				return
+			}
+		case cmd := <-cmdChan:
+			if cmd == "kill" {
+				return
+			}
+		}
+	}
+}
+
+// handleAliasCommand carries out an !alias command given its arguments.
+func (r *Room) handleAliasCommand(msg *Message, args []string) error {
+	if len(args) == 2 && args[1] == "list" {
+		triggers, err := r.retrieveAliasTriggers()
+		if err != nil {
+			return err
+		}
+		if len(triggers) == 0 {
+			r.SendText("No aliases have been defined.", msg.ID)
+			return nil
+		}
+		r.SendText("Aliases: "+SanitizeContent(strings.Join(triggers, ", ")), msg.ID)
+		return nil
+	}
+	if len(args) < 3 || (args[1] != "add" && args[1] != "remove") || (args[1] == "add" && len(args) < 4) {
+		r.SendText(aliasUsage, msg.ID)
+		return nil
+	}
+	if !r.isAdmin(msg.Sender.ID) {
+		r.SendText(r.render("unauthorized", nil), msg.ID)
+		return nil
+	}
+	trigger := r.commandContent(args[2])
+	if !strings.HasPrefix(trigger, DefaultCommandPrefix) || len(trigger) == len(DefaultCommandPrefix) {
+		r.SendText(aliasUsage, msg.ID)
+		return nil
+	}
+	if args[1] == "remove" {
+		found, err := r.deleteAlias(trigger)
+		if err != nil {
+			return err
+		}
+		if !found {
+			r.SendTextf(msg.ID, "There is no alias %s.", args[2])
+			return nil
+		}
+		r.SendTextf(msg.ID, "Alias %s removed.", args[2])
+		return nil
+	}
+	if isBuiltinCommand(trigger) {
+		r.SendTextf(msg.ID, "%s is a built-in command.", args[2])
+		return nil
+	}
+	response := ValidUTF8(strings.Join(args[3:], " "))
+	if strings.HasPrefix(r.commandContent(response), DefaultCommandPrefix) {
+		r.SendText("An alias may not respond with a command.", msg.ID)
+		return nil
+	}
+	if err := r.storeAlias(trigger, response); err != nil {
+		return err
+	}
+	r.SendTextf(msg.ID, "Alias %s added.", args[2])
+	return nil
+}
@@ -0,0 +1,78 @@
+package maimai
+
+import (
+	"strings"
+	"unicode"
+)
+
+// ParseArgs splits content into arguments shell-style. Arguments are
+// separated by whitespace, which can be included in an argument by quoting it
+// with single or double quotes or escaping it with a backslash. Within double
+// quotes a backslash escapes a double quote or backslash; within single
+// quotes everything is literal. A quote with no closing quote is taken
+// literally, so apostrophes in free text survive.
+func ParseArgs(content string) []string {
+	var args []string
+	var arg []rune
+	inArg := false
+	runes := []rune(content)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			if inArg {
+				args = append(args, string(arg))
+				arg = arg[:0]
+				inArg = false
+			}
+			continue
+		case r == '\\' && i+1 < len(runes):
+			i++
+			arg = append(arg, runes[i])
+		case (r == '"' || r == '\'') && closingQuote(runes, i) > 0:
+			end := closingQuote(runes, i)
+			for j := i + 1; j < end; j++ {
+				if r == '"' && runes[j] == '\\' && (runes[j+1] == '"' || runes[j+1] == '\\') {
+					j++
+				}
+				arg = append(arg, runes[j])
+			}
+			i = end
+		default:
+			arg = append(arg, r)
+		}
+		inArg = true
+	}
+	if inArg {
+		args = append(args, string(arg))
+	}
+	return args
+}
+
+// closingQuote returns the index of the quote closing the one at runes[start],
+// or -1 if there is none.
+func closingQuote(runes []rune, start int) int {
+	quote := runes[start]
+	for j := start + 1; j < len(runes); j++ {
+		if quote == '"' && runes[j] == '\\' {
+			j++
+			continue
+		}
+		if runes[j] == quote {
+			return j
+		}
+	}
+	return -1
+}
+
+// unquote returns text without surrounding quotes if it is a single quoted
+// argument, and unchanged otherwise.
+func unquote(text string) string {
+	if !strings.HasPrefix(text, "\"") && !strings.HasPrefix(text, "'") {
+		return text
+	}
+	if args := ParseArgs(text); len(args) == 1 {
+		return args[0]
+	}
+	return text
+}
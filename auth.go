@@ -0,0 +1,107 @@
+package maimai
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// maxAuthAttempts is the number of times BounceHandler authenticates in
+// response to bounce-events before giving up.
+const maxAuthAttempts = 3
+
+var (
+	// ErrAuthRequired is reported when the room requires a passcode but none
+	// is configured.
+	ErrAuthRequired = errors.New("Room requires authentication but no password is configured.")
+	// ErrAuthFailed is reported when authentication keeps being rejected.
+	ErrAuthFailed = errors.New("Authentication failed repeatedly.")
+)
+
+func hasAuthOption(options []string, option string) bool {
+	for _, o := range options {
+		if o == option {
+			return true
+		}
+	}
+	return false
+}
+
+// BounceHandler handles bounce-events that offer passcode authentication by
+// sending the configured password. If no password is configured it reports
+// ErrAuthRequired, and if authentication keeps failing it backs off and
+// eventually reports ErrAuthFailed.
+func BounceHandler(room *Room, input chan PacketEvent, cmdChan chan string) {
+	attempts := 0
+	for {
+		select {
+		case packet := <-input:
+			payload, err := packet.Payload()
+			if err != nil {
+				continue
+			}
+			switch data := payload.(type) {
+			case *BounceEvent:
+				if !hasAuthOption(data.AuthOptions, "passcode") {
+					continue
+				}
+				passcode, err := room.passcode()
+				if err != nil {
+					room.errChan <- err
+					return
+				}
+				if passcode == "" {
+					room.errChan <- ErrAuthRequired
+					return
+				}
+				if attempts >= maxAuthAttempts {
+					room.errChan <- ErrAuthFailed
+					return
+				}
+				time.Sleep(time.Duration(attempts) * time.Second)
+				attempts++
+				room.SendAuth()
+			case *AuthReply:
+				if data.Success {
+					attempts = 0
+				} else {
+					room.Logger.Errorf("Authentication failed: %s", data.Reason)
+				}
+			}
+		case cmd := <-cmdChan:
+			if cmd == "kill" {
+				return
+			}
+		}
+	}
+}
+
+// Login logs the bot into the account with the given email and password. The
+// server closes the connection after a successful login, so the bot must
+// reconnect to act as the account.
+func (r *Room) Login(email, password string) error {
+	data, err := r.RawSendAndWait(LoginType, LoginCommand{Namespace: "email", ID: email, Password: password})
+	if err != nil {
+		return err
+	}
+	var reply LoginReply
+	if err := json.Unmarshal(data, &reply); err != nil {
+		return err
+	}
+	if !reply.Success {
+		return fmt.Errorf("Login failed: %s", reply.Reason)
+	}
+	r.Logger.Infof("Logged in as account %s", reply.AccountID)
+	return nil
+}
+
+// Logout logs the bot out of its account.
+func (r *Room) Logout() error {
+	data, err := r.RawSendAndWait(LogoutType, LogoutCommand{})
+	if err != nil {
+		return err
+	}
+	var reply LogoutReply
+	return json.Unmarshal(data, &reply)
+}
@@ -0,0 +1,77 @@
+package maimai
+
+import (
+	"strings"
+	"time"
+)
+
+// DefaultAnnounceInterval is the least time between announcements when the
+// RoomConfig does not specify AnnounceInterval.
+const DefaultAnnounceInterval = time.Minute
+
+const announceUsage = "Usage: !announce [@everyone] <text>"
+
+// everyoneMentions returns @-mentions of the users present other than the
+// bot, each nick once.
+func (r *Room) everyoneMentions() string {
+	self := NormalizeNick(r.Nick())
+	seen := make(map[string]empty)
+	var mentions []string
+	for _, user := range r.Users() {
+		nick := NormalizeNick(user.Name)
+		if _, ok := seen[nick]; ok || nick == "" || nick == self {
+			continue
+		}
+		seen[nick] = empty{}
+		mentions = append(mentions, "@"+nick)
+	}
+	return strings.Join(mentions, " ")
+}
+
+// BroadcastCommandHandler handles a send-event, checks for an !announce
+// command, and posts its text as a top-level message. If the text starts with
+// @everyone, that is replaced with @-mentions of everyone present.
+// Announcements are limited to one per AnnounceInterval. It should be wrapped
+// with WithAdminOnly.
+func BroadcastCommandHandler(room *Room, input chan PacketEvent, cmdChan chan string) {
+	interval := room.config.AnnounceInterval
+	if interval <= 0 {
+		interval = DefaultAnnounceInterval
+	}
+	var last time.Time
+	for {
+		select {
+		case packet := <-input:
+			if packet.Type != SendEventType {
+				continue
+			}
+			data := GetMessagePayload(&packet)
+			name, text := data.CommandName(room.config.CommandPrefix)
+			if name != "announce" {
+				continue
+			}
+			if text == "" {
+				room.SendText(announceUsage, data.ID)
+				continue
+			}
+			now := time.Now()
+			if wait := interval - now.Sub(last); wait > 0 {
+				room.SendTextf(data.ID, "Please wait %s before announcing again.", wait.Truncate(time.Second)+time.Second)
+				continue
+			}
+			if fields := strings.Fields(text); fields[0] == "@everyone" {
+				text = strings.TrimSpace(strings.TrimPrefix(text, "@everyone"))
+				if mentions := room.everyoneMentions(); mentions != "" {
+					text = mentions + " " + text
+				}
+			}
+			last = now
+			room.Logger.Infof("Announcement by %s (%s): %s", data.Sender.Name, data.Sender.ID, text)
+			room.SendText(text, "")
+		case cmd := <-cmdChan:
+			if cmd == "kill" {
+				return
+			}
+		}
+	}
+}
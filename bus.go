@@ -0,0 +1,54 @@
+package maimai
+
+import "sync"
+
+// subscriptionSize is the number of events a subscription buffers. Events
+// published while a subscription's buffer is full are dropped for it.
+const subscriptionSize = 16
+
+// bus is an in-process publish/subscribe bus for events between handlers.
+type bus struct {
+	sync.Mutex
+	subs map[string][]chan interface{}
+}
+
+// Publish sends v to the subscribers of topic. It never blocks: subscribers
+// that are not keeping up miss the event.
+func (r *Room) Publish(topic string, v interface{}) {
+	r.bus.Lock()
+	defer r.bus.Unlock()
+	for _, ch := range r.bus.subs[topic] {
+		select {
+		case ch <- v:
+		default:
+			r.Logger.Debugf("Dropped event on topic %s for a slow subscriber", topic)
+		}
+	}
+}
+
+// Subscribe returns a channel receiving the events published to topic from
+// now on. Handlers should Unsubscribe when they exit.
+func (r *Room) Subscribe(topic string) <-chan interface{} {
+	r.bus.Lock()
+	defer r.bus.Unlock()
+	if r.bus.subs == nil {
+		r.bus.subs = make(map[string][]chan interface{})
+	}
+	ch := make(chan interface{}, subscriptionSize)
+	r.bus.subs[topic] = append(r.bus.subs[topic], ch)
+	return ch
+}
+
+// Unsubscribe stops delivery of topic's events to ch, which must have been
+// returned by Subscribe.
+func (r *Room) Unsubscribe(topic string, ch <-chan interface{}) {
+	r.bus.Lock()
+	defer r.bus.Unlock()
+	subs := r.bus.subs[topic]
+	for i, c := range subs {
+		if c == ch {
+			r.bus.subs[topic] = append(subs[:i:i], subs[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package maimai
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxCalcLength is the longest expression !calc evaluates.
+const maxCalcLength = 200
+
+const calcUsage = "Usage: !calc <expression>, e.g. !calc (1 + 2) * 3 ^ 2"
+
+var (
+	errDivisionByZero = errors.New("Division by zero.")
+	errCalcTooLong    = fmt.Errorf("Expression is longer than %d characters.", maxCalcLength)
+)
+
+// calcParser is a recursive descent parser for arithmetic expressions:
+//
+//	expr    = term { ("+" | "-") term }
+//	term    = unary { ("*" | "/") unary }
+//	unary   = "-" unary | power
+//	power   = primary [ "^" unary ]
+//	primary = number | "(" expr ")"
+//
+// Exponentiation is right-associative and binds tighter than unary minus, so
+// -2^2 is -4.
+type calcParser struct {
+	input string
+	pos   int
+}
+
+func (p *calcParser) skipSpace() {
+	for p.pos < len(p.input) && p.input[p.pos] == ' ' {
+		p.pos++
+	}
+}
+
+// accept consumes op if it is the next token.
+func (p *calcParser) accept(op byte) bool {
+	p.skipSpace()
+	if p.pos < len(p.input) && p.input[p.pos] == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *calcParser) expr() (float64, error) {
+	v, err := p.term()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		switch {
+		case p.accept('+'):
+			w, err := p.term()
+			if err != nil {
+				return 0, err
+			}
+			v += w
+		case p.accept('-'):
+			w, err := p.term()
+			if err != nil {
+				return 0, err
+			}
+			v -= w
+		default:
+			return v, nil
+		}
+	}
+}
+
+func (p *calcParser) term() (float64, error) {
+	v, err := p.unary()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		switch {
+		case p.accept('*'):
+			w, err := p.unary()
+			if err != nil {
+				return 0, err
+			}
+			v *= w
+		case p.accept('/'):
+			w, err := p.unary()
+			if err != nil {
+				return 0, err
+			}
+			if w == 0 {
+				return 0, errDivisionByZero
+			}
+			v /= w
+		default:
+			return v, nil
+		}
+	}
+}
+
+func (p *calcParser) unary() (float64, error) {
+	if p.accept('-') {
+		v, err := p.unary()
+		return -v, err
+	}
+	return p.power()
+}
+
+func (p *calcParser) power() (float64, error) {
+	v, err := p.primary()
+	if err != nil {
+		return 0, err
+	}
+	if p.accept('^') {
+		w, err := p.unary()
+		if err != nil {
+			return 0, err
+		}
+		v = math.Pow(v, w)
+	}
+	return v, nil
+}
+
+func (p *calcParser) primary() (float64, error) {
+	if p.accept('(') {
+		v, err := p.expr()
+		if err != nil {
+			return 0, err
+		}
+		if !p.accept(')') {
+			return 0, errors.New("Missing closing parenthesis.")
+		}
+		return v, nil
+	}
+	p.skipSpace()
+	start := p.pos
+	for p.pos < len(p.input) && (p.input[p.pos] == '.' || (p.input[p.pos] >= '0' && p.input[p.pos] <= '9')) {
+		p.pos++
+	}
+	if start == p.pos {
+		if p.pos == len(p.input) {
+			return 0, errors.New("Unexpected end of expression.")
+		}
+		return 0, p.unexpected()
+	}
+	v, err := strconv.ParseFloat(p.input[start:p.pos], 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid number '%s' at position %d.", p.input[start:p.pos], utf8.RuneCountInString(p.input[:start])+1)
+	}
+	return v, nil
+}
+
+// unexpected reports the character at the current position, which may be
+// any rune, as unexpected.
+func (p *calcParser) unexpected() error {
+	r, _ := utf8.DecodeRuneInString(p.input[p.pos:])
+	return fmt.Errorf("Unexpected '%c' at position %d.", r, utf8.RuneCountInString(p.input[:p.pos])+1)
+}
+
+// evalCalc evaluates an arithmetic expression.
+func evalCalc(expression string) (float64, error) {
+	if len(expression) > maxCalcLength {
+		return 0, errCalcTooLong
+	}
+	p := &calcParser{input: strings.Replace(expression, "\t", " ", -1)}
+	v, err := p.expr()
+	if err != nil {
+		return 0, err
+	}
+	p.skipSpace()
+	if p.pos < len(p.input) {
+		return 0, p.unexpected()
+	}
+	if math.IsInf(v, 0) || math.IsNaN(v) {
+		return 0, errors.New("Result is not a finite number.")
+	}
+	return v, nil
+}
+
+// CalcCommandHandler handles a send-event, checks for a !calc command, and
+// replies with the value of the arithmetic expression.
+func CalcCommandHandler(room *Room, input chan PacketEvent, cmdChan chan string) {
+	for {
+		select {
+		case packet := <-input:
+			if packet.Type != SendEventType {
+				continue
+			}
+			data := GetMessagePayload(&packet)
+			content := room.commandContent(data.Content)
+			if commandOf(content) != "!calc" {
+				continue
+			}
+			expression := strings.TrimSpace(strings.TrimPrefix(content, "!calc"))
+			if expression == "" {
+				room.SendText(calcUsage, data.ID)
+				continue
+			}
+			v, err := evalCalc(expression)
+			if err != nil {
+				room.SendText("Could not evaluate: "+err.Error(), data.ID)
+				continue
+			}
+			room.SendText(strconv.FormatFloat(v, 'g', -1, 64), data.ID)
+		case cmd := <-cmdChan:
+			if cmd == "kill" {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package maimai
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Config is the JSON configuration read by LoadConfig.
+type Config struct {
+	Room     string `json:"room"`
+	Nick     string `json:"nick"`
+	Passcode string `json:"passcode"`
+	// Store is the path of the bolt database.
+	Store     string            `json:"store"`
+	Log       string            `json:"log"`
+	Join      bool              `json:"join"`
+	MsgLog    bool              `json:"msglog"`
+	Admins    []string          `json:"admins"`
+	Handlers  []string          `json:"handlers"`
+	Prefix    string            `json:"command_prefix"`
+	Templates map[string]string `json:"templates"`
+	// Endpoint is the server to connect to; see WithEndpoint.
+	Endpoint string `json:"endpoint"`
+}
+
+// RoomConfig returns the RoomConfig described by c.
+func (c *Config) RoomConfig() *RoomConfig {
+	return &RoomConfig{
+		DBPath:        c.Store,
+		ErrorLogPath:  c.Log,
+		Join:          c.Join,
+		MsgLog:        c.MsgLog,
+		Nick:          c.Nick,
+		Password:      c.Passcode,
+		Admins:        c.Admins,
+		Handlers:      c.Handlers,
+		CommandPrefix: c.Prefix,
+		Templates:     c.Templates,
+	}
+}
+
+// ReadConfig reads and validates a JSON Config. Unknown keys are rejected so
+// that typos are not silently ignored.
+func ReadConfig(r io.Reader) (*Config, error) {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	var cfg Config
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, err
+	}
+	if cfg.Room == "" {
+		return nil, errors.New("Config must specify a room.")
+	}
+	if cfg.Store == "" {
+		cfg.Store = "room_" + cfg.Room + ".db"
+	}
+	if cfg.Nick == "" {
+		cfg.Nick = "MaiMai"
+	}
+	return &cfg, nil
+}
+
+// LoadConfig reads a JSON Config and returns a Room ready to Run, connected
+// over a websocket and logging to a new logger.
+func LoadConfig(r io.Reader) (*Room, error) {
+	cfg, err := ReadConfig(r)
+	if err != nil {
+		return nil, err
+	}
+	logger := logrus.New()
+	var opts []WSOption
+	if cfg.Endpoint != "" {
+		opts = append(opts, WithEndpoint(cfg.Endpoint))
+	}
+	return NewRoom(cfg.RoomConfig(), cfg.Room, NewWSSenderReceiver(cfg.Room, logger, opts...), logger)
+}
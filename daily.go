@@ -0,0 +1,48 @@
+package maimai
+
+import (
+	"hash/fnv"
+	"time"
+)
+
+// dailyPick returns the item for the day containing now in loc. The choice is
+// seeded by the command and the date, so it is the same for everyone all day
+// and changes at midnight in loc.
+func dailyPick(command string, items []string, now time.Time, loc *time.Location) string {
+	if len(items) == 0 {
+		return ""
+	}
+	h := fnv.New64a()
+	h.Write([]byte(command + "@" + now.In(loc).Format("2006-01-02")))
+	return items[h.Sum64()%uint64(len(items))]
+}
+
+// NewDailyCommandHandler returns a handler that replies to command, such as
+// "!fortune", with the day's pick from items. Days begin at midnight in loc,
+// or in UTC if loc is nil.
+func NewDailyCommandHandler(command string, items []string, loc *time.Location) Handler {
+	if loc == nil {
+		loc = time.UTC
+	}
+	return func(room *Room, input chan PacketEvent, cmdChan chan string) {
+		for {
+			select {
+			case packet := <-input:
+				if packet.Type != SendEventType {
+					continue
+				}
+				data := GetMessagePayload(&packet)
+				if room.commandContent(data.Content) != command {
+					continue
+				}
+				if item := dailyPick(command, items, time.Now(), loc); item != "" {
+					room.reply(data, item)
+				}
+			case cmd := <-cmdChan:
+				if cmd == "kill" {
+					return
+				}
+			}
+		}
+	}
+}
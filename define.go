@@ -0,0 +1,63 @@
+package maimai
+
+import "strings"
+
+// maxDefinitionLength caps the number of characters of a definition that are
+// posted to the room.
+const maxDefinitionLength = 300
+
+// DictionaryProvider looks up word definitions for DefineCommandHandler.
+type DictionaryProvider interface {
+	// Define returns the definition of word, or an empty string if no
+	// definition was found.
+	Define(word string) (string, error)
+}
+
+func truncate(text string, max int) string {
+	runes := []rune(text)
+	if len(runes) <= max {
+		return text
+	}
+	if max < 3 {
+		return string(runes[:max])
+	}
+	return string(runes[:max-3]) + "..."
+}
+
+// DefineCommandHandler handles a send-event, checks for a !define command, and
+// replies with the definition given by the room's DictionaryProvider.
+func DefineCommandHandler(room *Room, input chan PacketEvent, cmdChan chan string) {
+	for {
+		select {
+		case packet := <-input:
+			if packet.Type != SendEventType {
+				continue
+			}
+			data := GetMessagePayload(&packet)
+			fields := ParseArgs(room.commandContent(data.Content))
+			if len(fields) == 0 || fields[0] != "!define" {
+				continue
+			}
+			if len(fields) == 1 {
+				room.SendText("Usage: !define <word>", data.ID)
+				continue
+			}
+			word := strings.Join(fields[1:], " ")
+			definition, err := room.config.Dictionary.Define(word)
+			if err != nil {
+				room.Logger.Errorf("Error looking up definition of %s: %s", word, err)
+				room.SendText("Sorry, the dictionary is unavailable right now.", data.ID)
+				continue
+			}
+			if definition == "" {
+				room.SendTextf(data.ID, "No definition found for %s.", word)
+				continue
+			}
+			room.SendTextf(data.ID, "%s: %s", word, truncate(definition, maxDefinitionLength))
+		case cmd := <-cmdChan:
+			if cmd == "kill" {
+				return
+			}
+		}
+	}
+}
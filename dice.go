@@ -0,0 +1,165 @@
+package maimai
+
+import (
+	"fmt"
+	"math/rand"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// maxDice and maxSides bound the dice !roll will roll, and maxExplosions the
+// extra rolls an exploding die may make.
+const (
+	maxDice       = 100
+	maxSides      = 1000
+	maxExplosions = 100
+)
+
+const rollUsage = "Usage: !roll <n>d<sides>[!][kh<n>|kl<n>|dh<n>|dl<n>], e.g. !roll 3d6!, " +
+	"!roll 2d20kh1 or !roll 4d6dl1"
+
+var diceNotation = regexp.MustCompile(`^(\d*)d(\d+)(!?)(?:(kh|kl|dh|dl)(\d+))?$`)
+
+// diceRoll is a parsed dice expression. Exploding dice are rolled again,
+// adding to the die's value, whenever they roll their highest face. If n is
+// not zero, the n highest dice, or lowest unless high, are kept if keep is
+// set and dropped otherwise.
+type diceRoll struct {
+	count   int
+	sides   int
+	explode bool
+	keep    bool
+	high    bool
+	n       int
+}
+
+// parseDice parses notation such as 3d6!, 2d20kh1 or 4d6dl1, rejecting
+// anything it does not understand.
+func parseDice(notation string) (*diceRoll, error) {
+	m := diceNotation.FindStringSubmatch(strings.ToLower(notation))
+	if m == nil {
+		return nil, fmt.Errorf("Invalid dice '%s'.", notation)
+	}
+	roll := &diceRoll{count: 1, explode: m[3] == "!"}
+	if m[1] != "" {
+		roll.count, _ = strconv.Atoi(m[1])
+	}
+	roll.sides, _ = strconv.Atoi(m[2])
+	if roll.count < 1 || roll.count > maxDice {
+		return nil, fmt.Errorf("Roll between 1 and %d dice.", maxDice)
+	}
+	if roll.sides < 2 || roll.sides > maxSides {
+		return nil, fmt.Errorf("Dice must have between 2 and %d sides.", maxSides)
+	}
+	if m[4] != "" {
+		roll.keep = m[4][0] == 'k'
+		roll.high = m[4][1] == 'h'
+		roll.n, _ = strconv.Atoi(m[5])
+		if roll.keep && (roll.n < 1 || roll.n > roll.count) {
+			return nil, fmt.Errorf("Keep between 1 and %d dice.", roll.count)
+		}
+		if !roll.keep && roll.n >= roll.count {
+			return nil, fmt.Errorf("Drop fewer than %d dice.", roll.count)
+		}
+	}
+	return roll, nil
+}
+
+// byValue sorts the indices of dice by the dice's values, ascending.
+type byValue struct {
+	indices []int
+	dice    []int
+}
+
+func (v byValue) Len() int           { return len(v.indices) }
+func (v byValue) Swap(i, j int)      { v.indices[i], v.indices[j] = v.indices[j], v.indices[i] }
+func (v byValue) Less(i, j int) bool { return v.dice[v.indices[i]] < v.dice[v.indices[j]] }
+
+// roll rolls the dice with rnd, returning each die's value, whether it was
+// kept, and the total of the kept dice.
+func (d *diceRoll) roll(rnd *rand.Rand) (dice []int, kept []bool, total int) {
+	dice = make([]int, d.count)
+	kept = make([]bool, d.count)
+	for i := range dice {
+		face := rnd.Intn(d.sides) + 1
+		dice[i] = face
+		for j := 0; d.explode && face == d.sides && j < maxExplosions; j++ {
+			face = rnd.Intn(d.sides) + 1
+			dice[i] += face
+		}
+	}
+	order := byValue{indices: make([]int, d.count), dice: dice}
+	for i := range order.indices {
+		order.indices[i] = i
+	}
+	sort.Stable(order)
+	// lo and hi are the range of sorted dice kept.
+	lo, hi := 0, d.count
+	switch {
+	case d.n == 0:
+	case d.keep && d.high:
+		lo = d.count - d.n
+	case d.keep:
+		hi = d.n
+	case d.high:
+		hi = d.count - d.n
+	default:
+		lo = d.n
+	}
+	for _, i := range order.indices[lo:hi] {
+		kept[i] = true
+		total += dice[i]
+	}
+	return dice, kept, total
+}
+
+// formatDice lists dice in the order rolled, with dropped dice in
+// parentheses.
+func formatDice(dice []int, kept []bool) string {
+	parts := make([]string, len(dice))
+	for i, die := range dice {
+		if kept[i] {
+			parts[i] = strconv.Itoa(die)
+		} else {
+			parts[i] = fmt.Sprintf("(%d)", die)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// RollCommandHandler handles a send-event, checks for a !roll command, and
+// replies with the result of rolling the given dice. The total is emitted as
+// a GameResult for the "roll" game.
+func RollCommandHandler(room *Room, input chan PacketEvent, cmdChan chan string) {
+	for {
+		select {
+		case packet := <-input:
+			if packet.Type != SendEventType {
+				continue
+			}
+			data := GetMessagePayload(&packet)
+			fields := strings.Fields(room.commandContent(data.Content))
+			if len(fields) == 0 || fields[0] != "!roll" {
+				continue
+			}
+			if len(fields) != 2 {
+				room.SendText(rollUsage, data.ID)
+				continue
+			}
+			roll, err := parseDice(fields[1])
+			if err != nil {
+				room.SendText(err.Error()+" "+rollUsage, data.ID)
+				continue
+			}
+			dice, kept, total := roll.roll(room.Rand)
+			room.reply(data, fmt.Sprintf("%s: %s = %d", strings.ToLower(fields[1]), formatDice(dice, kept), total))
+			room.EmitGameResult(GameResult{Game: "roll", User: data.Sender, Score: total})
+		case cmd := <-cmdChan:
+			if cmd == "kill" {
+				return
+			}
+		}
+	}
+}
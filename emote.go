@@ -0,0 +1,146 @@
+package maimai
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+// emoteMatcher matches euphoria emote tokens such as ":+1:" and ":heart:".
+var emoteMatcher = regexp.MustCompile(`:[a-z0-9_+\-]+:`)
+
+// maxEmoteStats is the number of emotes !emotestats reports.
+const maxEmoteStats = 5
+
+// extractEmotes returns the emote tokens in content, in order, including
+// repeats. Tokens run together with a letter or digit are not emotes, so that
+// times such as 12:30:45 are not counted.
+func extractEmotes(content string) []string {
+	content = strings.ToLower(content)
+	var emotes []string
+	for _, loc := range emoteMatcher.FindAllStringIndex(content, -1) {
+		if isAlphanumeric(content, loc[0]-1) || isAlphanumeric(content, loc[1]) {
+			continue
+		}
+		emotes = append(emotes, content[loc[0]:loc[1]])
+	}
+	return emotes
+}
+
+// isAlphanumeric reports whether the byte of s at i is an ASCII letter or
+// digit, and false if i is out of range.
+func isAlphanumeric(s string, i int) bool {
+	if i < 0 || i >= len(s) {
+		return false
+	}
+	c := s[i]
+	return c >= 'a' && c <= 'z' || c >= '0' && c <= '9'
+}
+
+// EmoteCount is the number of times an emote has been used.
+type EmoteCount struct {
+	Emote string
+	Count uint64
+}
+
+// byCount sorts EmoteCounts most used first, with ties broken alphabetically.
+type byCount []EmoteCount
+
+func (c byCount) Len() int      { return len(c) }
+func (c byCount) Swap(i, j int) { c[i], c[j] = c[j], c[i] }
+func (c byCount) Less(i, j int) bool {
+	if c[i].Count != c[j].Count {
+		return c[i].Count > c[j].Count
+	}
+	return c[i].Emote < c[j].Emote
+}
+
+// countEmotes adds emotes to the tallies stored in a per-room bucket within
+// the "Emotes" bucket, keyed by emote.
+func (r *Room) countEmotes(emotes []string) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket([]byte("Emotes")).CreateBucketIfNotExists([]byte(r.name))
+		if err != nil {
+			return err
+		}
+		for _, emote := range emotes {
+			var n uint64
+			if v := b.Get([]byte(emote)); v != nil {
+				n, _ = strconv.ParseUint(string(v), 10, 64)
+			}
+			if err := b.Put([]byte(emote), []byte(strconv.FormatUint(n+1, 10))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// topEmotes returns the n most used emotes in byCount order.
+func (r *Room) topEmotes(n int) ([]EmoteCount, error) {
+	var counts []EmoteCount
+	err := r.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("Emotes")).Bucket([]byte(r.name))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			count, err := strconv.ParseUint(string(v), 10, 64)
+			if err != nil {
+				return err
+			}
+			counts = append(counts, EmoteCount{Emote: string(k), Count: count})
+			return nil
+		})
+	})
+	sort.Sort(byCount(counts))
+	if len(counts) > n {
+		counts = counts[:n]
+	}
+	return counts, err
+}
+
+// EmoteStatsHandler handles send-events, tallying the emotes used in them, and
+// handles the !emotestats command, replying with the most used emotes.
+func EmoteStatsHandler(room *Room, input chan PacketEvent, cmdChan chan string) {
+	for {
+		select {
+		case packet := <-input:
+			if packet.Type != SendEventType {
+				continue
+			}
+			data := GetMessagePayload(&packet)
+			if commandOf(room.commandContent(data.Content)) != "!emotestats" {
+				if emotes := extractEmotes(data.Content); len(emotes) > 0 {
+					if err := room.countEmotes(emotes); err != nil {
+						room.errChan <- err
+						return
+					}
+				}
+				continue
+			}
+			counts, err := room.topEmotes(maxEmoteStats)
+			if err != nil {
+				room.errChan <- err
+				return
+			}
+			if len(counts) == 0 {
+				room.reply(data, "No emotes have been used yet.")
+				continue
+			}
+			parts := make([]string, len(counts))
+			for i, c := range counts {
+				parts[i] = fmt.Sprintf("%s %d", c.Emote, c.Count)
+			}
+			room.reply(data, "Top emotes: "+strings.Join(parts, ", "))
+		case cmd := <-cmdChan:
+			if cmd == "kill" {
+				return
+			}
+		}
+	}
+}
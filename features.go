@@ -0,0 +1,97 @@
+package maimai
+
+import (
+	"sort"
+	"strings"
+)
+
+// Names of the features checked by the built-in handlers.
+const (
+	FeatureLinkTitles    = "link-titles"
+	FeatureAnnouncements = "announcements"
+)
+
+// builtinFeatures are the features checked by the built-in handlers.
+var builtinFeatures = []string{FeatureLinkTitles, FeatureAnnouncements}
+
+const featureUsage = "Usage: !feature on <name> or !feature off <name>"
+
+// featureNames returns, sorted, the features that can be turned on or off:
+// the built-in ones and any named in RoomConfig.Features.
+func (r *Room) featureNames() []string {
+	names := append([]string{}, builtinFeatures...)
+	for name := range r.config.Features {
+		known := false
+		for _, n := range names {
+			known = known || n == name
+		}
+		if !known {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (r *Room) isFeature(name string) bool {
+	for _, n := range r.featureNames() {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// IsEnabled reports whether the named feature is enabled. Features are
+// enabled unless turned off in RoomConfig.Features or with SetFeature.
+func (r *Room) IsEnabled(name string) bool {
+	r.data.Lock()
+	defer r.data.Unlock()
+	enabled, ok := r.data.features[name]
+	return !ok || enabled
+}
+
+// SetFeature turns the named feature on or off.
+func (r *Room) SetFeature(name string, enabled bool) {
+	r.data.Lock()
+	r.data.features[name] = enabled
+	r.data.Unlock()
+}
+
+// FeatureCommandHandler handles a send-event, checks for a !feature command,
+// and turns the named feature on or off. Unknown names are refused with the
+// list of features, so that a typo is not mistaken for a change. It should be
+// wrapped with WithAdminOnly.
+func FeatureCommandHandler(room *Room, input chan PacketEvent, cmdChan chan string) {
+	for {
+		select {
+		case packet := <-input:
+			if packet.Type != SendEventType {
+				continue
+			}
+			data := GetMessagePayload(&packet)
+			fields := strings.Fields(room.commandContent(data.Content))
+			if len(fields) == 0 || fields[0] != "!feature" {
+				continue
+			}
+			if len(fields) != 3 || (fields[1] != "on" && fields[1] != "off") {
+				room.SendText(featureUsage, data.ID)
+				continue
+			}
+			name := fields[2]
+			if !room.isFeature(name) {
+				room.SendText(room.render("feature.bad", map[string]interface{}{
+					"Name":  SanitizeContent(name),
+					"Names": strings.Join(room.featureNames(), ", ")}), data.ID)
+				continue
+			}
+			room.SetFeature(name, fields[1] == "on")
+			room.Logger.Infof("Feature %s turned %s by %s (%s)", name, fields[1], data.Sender.Name, data.Sender.ID)
+			room.SendText(room.render("feature."+fields[1], map[string]interface{}{"Name": name}), data.ID)
+		case cmd := <-cmdChan:
+			if cmd == "kill" {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package maimai
+
+import "time"
+
+// DefaultFloodWindow is the window over which FloodGuardHandler counts
+// messages when the RoomConfig does not specify FloodWindow.
+const DefaultFloodWindow = time.Duration(3) * time.Second
+
+// floodTracker counts each user's messages over a sliding window.
+type floodTracker struct {
+	limit  int
+	window time.Duration
+	recent map[string][]time.Time
+	warned map[string]bool
+}
+
+func newFloodTracker(limit int, window time.Duration) *floodTracker {
+	return &floodTracker{
+		limit:  limit,
+		window: window,
+		recent: make(map[string][]time.Time),
+		warned: make(map[string]bool),
+	}
+}
+
+// inWindow returns the times within the window ending at now.
+func (f *floodTracker) inWindow(times []time.Time, now time.Time) []time.Time {
+	cutoff := now.Add(-f.window)
+	i := 0
+	for i < len(times) && !times[i].After(cutoff) {
+		i++
+	}
+	return times[i:]
+}
+
+// record records a message from user at now and reports whether the user
+// has just exceeded the limit. A user is reported once per flood, and again
+// only after their rate has fallen back within the limit.
+func (f *floodTracker) record(user string, now time.Time) bool {
+	times := append(f.inWindow(f.recent[user], now), now)
+	f.recent[user] = times
+	if len(times) <= f.limit {
+		delete(f.warned, user)
+		return false
+	}
+	if f.warned[user] {
+		return false
+	}
+	f.warned[user] = true
+	return true
+}
+
+// expire forgets users who have sent no messages within the window.
+func (f *floodTracker) expire(now time.Time) {
+	for user, times := range f.recent {
+		if len(f.inWindow(times, now)) == 0 {
+			delete(f.recent, user)
+			delete(f.warned, user)
+		}
+	}
+}
+
+// FloodGuardHandler handles send-events and warns users who send more than
+// the RoomConfig's FloodLimit messages within FloodWindow. If OnFlood is set
+// it is called as well, for example to ban the user.
+func FloodGuardHandler(room *Room, input chan PacketEvent, cmdChan chan string) {
+	window := room.config.FloodWindow
+	if window <= 0 {
+		window = DefaultFloodWindow
+	}
+	tracker := newFloodTracker(room.config.FloodLimit, window)
+	ticker := time.NewTicker(window)
+	defer ticker.Stop()
+	for {
+		select {
+		case packet := <-input:
+			if packet.Type != SendEventType {
+				continue
+			}
+			data := GetMessagePayload(&packet)
+			if !tracker.record(data.Sender.ID, time.Now()) {
+				continue
+			}
+			room.Logger.Warningf("Flood detected from %s (%s)", data.Sender.Name, data.Sender.ID)
+			room.SendText(room.render("flood", map[string]interface{}{"User": SanitizeContent(data.Sender.Name)}), data.ID)
+			if room.config.OnFlood != nil {
+				go room.config.OnFlood(room, data.Sender)
+			}
+		case now := <-ticker.C:
+			tracker.expire(now)
+		case cmd := <-cmdChan:
+			if cmd == "kill" {
+				return
+			}
+		}
+	}
+}
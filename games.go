@@ -0,0 +1,174 @@
+package maimai
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+// maxLeaderboardEntries is the number of players !leaderboard reports.
+const maxLeaderboardEntries = 5
+
+const leaderboardUsage = "Usage: !leaderboard <game>, e.g. !leaderboard flip"
+
+// GameResult is emitted by game handlers for each play, so that stats can be
+// kept without the games knowing about them. Score is game-specific; for
+// !flip it is 1 for heads and 0 for tails.
+type GameResult struct {
+	Game  string
+	User  User
+	Score int
+}
+
+// GameStats are a player's accumulated results in one game.
+type GameStats struct {
+	Name  string `json:"name"`
+	Plays int    `json:"plays"`
+	Best  int    `json:"best"`
+	Total int    `json:"total"`
+}
+
+func (s *GameStats) add(result GameResult) {
+	if s.Plays == 0 || result.Score > s.Best {
+		s.Best = result.Score
+	}
+	s.Plays++
+	s.Total += result.Score
+	s.Name = result.User.Name
+}
+
+// GameResultTopic is the topic GameResults are published to.
+const GameResultTopic = "game-result"
+
+// EmitGameResult publishes result to GameResultTopic, where GameStatsHandler
+// receives it.
+func (r *Room) EmitGameResult(result GameResult) {
+	r.Publish(GameResultTopic, result)
+}
+
+// recordGameResult adds result to the stats stored in a per-game bucket
+// within a per-room bucket of the "GameStats" bucket, keyed by userKey.
+func (r *Room) recordGameResult(result GameResult) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		room, err := tx.Bucket([]byte("GameStats")).CreateBucketIfNotExists([]byte(r.name))
+		if err != nil {
+			return err
+		}
+		b, err := room.CreateBucketIfNotExists([]byte(result.Game))
+		if err != nil {
+			return err
+		}
+		key := []byte(userKey(&result.User))
+		var stats GameStats
+		if data := b.Get(key); data != nil {
+			if err := json.Unmarshal(data, &stats); err != nil {
+				return err
+			}
+		}
+		stats.add(result)
+		data, err := json.Marshal(&stats)
+		if err != nil {
+			return err
+		}
+		return b.Put(key, data)
+	})
+}
+
+// byBest sorts GameStats by best score, then total, then plays, descending.
+type byBest []GameStats
+
+func (s byBest) Len() int      { return len(s) }
+func (s byBest) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byBest) Less(i, j int) bool {
+	switch {
+	case s[i].Best != s[j].Best:
+		return s[i].Best > s[j].Best
+	case s[i].Total != s[j].Total:
+		return s[i].Total > s[j].Total
+	}
+	return s[i].Plays > s[j].Plays
+}
+
+// leaderboard returns the top n players of game in byBest order.
+func (r *Room) leaderboard(game string, n int) ([]GameStats, error) {
+	var all []GameStats
+	err := r.db.View(func(tx *bolt.Tx) error {
+		room := tx.Bucket([]byte("GameStats")).Bucket([]byte(r.name))
+		if room == nil {
+			return nil
+		}
+		b := room.Bucket([]byte(game))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var stats GameStats
+			if err := json.Unmarshal(v, &stats); err != nil {
+				return err
+			}
+			all = append(all, stats)
+			return nil
+		})
+	})
+	sort.Stable(byBest(all))
+	if len(all) > n {
+		all = all[:n]
+	}
+	return all, err
+}
+
+// GameStatsHandler records the results emitted by game handlers and handles
+// the !leaderboard command.
+func GameStatsHandler(room *Room, input chan PacketEvent, cmdChan chan string) {
+	results := room.Subscribe(GameResultTopic)
+	defer room.Unsubscribe(GameResultTopic, results)
+	for {
+		select {
+		case event := <-results:
+			result, ok := event.(GameResult)
+			if !ok {
+				continue
+			}
+			if err := room.recordGameResult(result); err != nil {
+				room.errChan <- err
+				return
+			}
+		case packet := <-input:
+			if packet.Type != SendEventType {
+				continue
+			}
+			data := GetMessagePayload(&packet)
+			fields := strings.Fields(room.commandContent(data.Content))
+			if len(fields) == 0 || fields[0] != "!leaderboard" {
+				continue
+			}
+			if len(fields) != 2 {
+				room.reply(data, leaderboardUsage)
+				continue
+			}
+			game := strings.TrimPrefix(fields[1], DefaultCommandPrefix)
+			board, err := room.leaderboard(game, maxLeaderboardEntries)
+			if err != nil {
+				room.errChan <- err
+				return
+			}
+			if len(board) == 0 {
+				room.reply(data, fmt.Sprintf("No one has played %s yet.", SanitizeContent(game)))
+				continue
+			}
+			lines := []string{"Leaderboard for " + game + ":"}
+			for i, stats := range board {
+				lines = append(lines, fmt.Sprintf("%d. %s: best %d, total %d in %d plays",
+					i+1, SanitizeContent(stats.Name), stats.Best, stats.Total, stats.Plays))
+			}
+			room.reply(data, strings.Join(lines, "\n"))
+		case cmd := <-cmdChan:
+			if cmd == "kill" {
+				return
+			}
+		}
+	}
+}
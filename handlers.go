@@ -1,15 +1,23 @@
 package maimai
 
 import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"net/url"
 	"regexp"
-	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/net/html"
+	"golang.org/x/net/html/charset"
 )
 
 type MsgLogEvent struct {
@@ -18,20 +26,75 @@ type MsgLogEvent struct {
 	UserName string `json:"userName"`
 	Time     int64  `json:"time"`
 	Content  string `json:"content"`
+	Edited   int64  `json:"edited,omitempty"`
+	Deleted  int64  `json:"deleted,omitempty"`
+	// Truncated is set if Content was cut to the RoomConfig's
+	// MaxLogContentLength; the full message can be fetched with GetMessage.
+	Truncated bool `json:"truncated,omitempty"`
+	// EncryptionKeyID is the key Content is encrypted with, if any.
+	EncryptionKeyID string `json:"encryptionKeyID,omitempty"`
+}
+
+// Timestamp returns the time the logged message was sent.
+func (m *MsgLogEvent) Timestamp() time.Time {
+	return time.Unix(m.Time, 0)
 }
 
 func prepareMsgLogEvent(msg *Message) (string, *MsgLogEvent) {
 	msgLogEvent := &MsgLogEvent{
-		Parent:   msg.Parent,
-		UserID:   msg.Sender.ID,
-		UserName: msg.Sender.Name,
-		Time:     msg.Time,
-		Content:  msg.Content}
+		Parent:          msg.Parent,
+		UserID:          msg.Sender.ID,
+		UserName:        ValidUTF8(msg.Sender.Name),
+		Time:            msg.Time,
+		Content:         ValidUTF8(msg.Content),
+		Edited:          int64(msg.Edited),
+		Deleted:         int64(msg.Deleted),
+		EncryptionKeyID: msg.EncryptionKeyID}
 	return msg.ID, msgLogEvent
 }
 
+// reconcileMsgLogEvent applies an edit-message-event to the logged copy of the
+// edited message, logging it afresh if it was not already logged.
+func (r *Room) reconcileMsgLogEvent(edit *EditMessageEvent) {
+	msgID, updated := prepareMsgLogEvent(&edit.Message)
+	if updated.Edited == 0 {
+		updated.Edited = time.Now().Unix()
+	}
+	existing, err := r.retrieveMsgLogEvent(msgID)
+	if err != nil {
+		r.Logger.Errorf("Error retrieving logged message %s: %s", msgID, err)
+	}
+	if existing != nil {
+		existing.Content = updated.Content
+		existing.Parent = updated.Parent
+		existing.Edited = updated.Edited
+		existing.Deleted = updated.Deleted
+		updated = existing
+	}
+	r.storeMsgLogEvent(msgID, updated)
+}
+
 var linkMatcher = regexp.MustCompile("(https?://)?[\\S]+\\.[\\S][\\S]+[\\S^\\.]")
 
+// DefaultCommandPrefix starts commands when the RoomConfig does not specify
+// CommandPrefix.
+const DefaultCommandPrefix = "!"
+
+// commandContent returns content with the configured command prefix replaced
+// by DefaultCommandPrefix, which the built-in handlers match on. Content that
+// does not start with the configured prefix is not a command, so it is
+// returned as "".
+func (r *Room) commandContent(content string) string {
+	prefix := r.config.CommandPrefix
+	if prefix == "" || prefix == DefaultCommandPrefix {
+		return content
+	}
+	if !strings.HasPrefix(content, prefix) {
+		return ""
+	}
+	return DefaultCommandPrefix + content[len(prefix):]
+}
+
 // Handler describes functions that process packets.
 type Handler func(room *Room, input chan PacketEvent, cmdChan chan string)
 
@@ -53,6 +116,7 @@ func PingEventHandler(room *Room, input chan PacketEvent, cmdChan chan string) {
 				room.errChan <- errors.New("Could not assert payload as *PingEvent.")
 				return
 			}
+			room.recordPingEvent(data, time.Now())
 			room.sendPing(data.Time)
 		case cmd := <-cmdChan:
 			if cmd == "kill" {
@@ -62,11 +126,56 @@ func PingEventHandler(room *Room, input chan PacketEvent, cmdChan chan string) {
 	}
 }
 
-func isValidPingCommand(payload *Message) bool {
-	if len(payload.Content) >= 5 && payload.Content[0:5] == "!ping" {
-		return true
+// DefaultPingGraceMultiplier is used when the RoomConfig does not specify
+// PingGraceMultiplier.
+const DefaultPingGraceMultiplier = 1.0
+
+// pingDeadline returns how long to wait for the ping after data before the
+// connection is considered dead: until the announced next ping, plus a grace
+// period proportional to the ping interval.
+func (r *Room) pingDeadline(data *PingEvent) time.Duration {
+	multiplier := r.config.PingGraceMultiplier
+	if multiplier <= 0 {
+		multiplier = DefaultPingGraceMultiplier
+	}
+	interval := time.Duration(data.Next-data.Time) * time.Second
+	grace := time.Duration(float64(interval) * multiplier)
+	return time.Unix(data.Next, 0).Sub(time.Now()) + grace
+}
+
+// PingWatchdogHandler reconnects if a ping-event does not arrive within the
+// grace period after the time announced by the previous one. This catches
+// half-open connections that never report an error.
+func PingWatchdogHandler(room *Room, input chan PacketEvent, cmdChan chan string) {
+	var timeout <-chan time.Time
+	for {
+		select {
+		case packet := <-input:
+			if packet.Type != PingEventType {
+				continue
+			}
+			payload, err := packet.Payload()
+			if err != nil {
+				continue
+			}
+			data, ok := payload.(*PingEvent)
+			if !ok {
+				continue
+			}
+			timeout = time.After(room.pingDeadline(data))
+		case <-timeout:
+			timeout = nil
+			room.Logger.Warnln("Missed ping, reconnecting.")
+			if err := room.sr.reconnect(room); err != nil {
+				room.errChan <- err
+				return
+			}
+		case cmd := <-cmdChan:
+			if cmd == "kill" {
+				return
+			}
+		}
 	}
-	return false
 }
 
 // PingCommandHandler handles a send-event, checks for a !ping, and replies.
@@ -78,8 +187,8 @@ func PingCommandHandler(room *Room, input chan PacketEvent, cmdChan chan string)
 				continue
 			}
 			data := GetMessagePayload(&packet)
-			if isValidPingCommand(data) {
-				room.SendText("pong!", data.ID)
+			if name, _ := data.CommandName(room.config.CommandPrefix); name == "ping" {
+				room.reply(data, "pong!")
 			}
 		case cmd := <-cmdChan:
 			if cmd == "kill" {
@@ -89,41 +198,120 @@ func PingCommandHandler(room *Room, input chan PacketEvent, cmdChan chan string)
 	}
 }
 
-// SeenRecordHandler handles a send-event and records that the sender was seen.
+// SeenRecordHandler handles a send-event and records that the sender was seen
+// at the time the message was sent.
+// On a snapshot-event it backfills the seen records from the recent messages
+// in the snapshot, so that !seen works for users not seen since a restart.
+// Failed writes are retried a few times before the handler gives up.
 func SeenRecordHandler(room *Room, input chan PacketEvent, cmdChan chan string) {
+	// flush stays nil, and never fires, unless writes are batched.
+	var flush <-chan time.Time
+	if interval := room.config.SeenFlushInterval; interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		flush = ticker.C
+	}
 	for {
 		select {
+		case <-flush:
+			if err := room.flushSeen(); err != nil {
+				room.Logger.Errorf("Could not flush seen records, will retry: %s", err)
+			}
 		case packet := <-input:
+			if packet.Type == SnapshotEventType {
+				msgs := GetSnapshotEventPayload(&packet).Log
+				if err := room.retryStore("seen records", func() error { return room.backfillSeen(msgs) }); err != nil {
+					room.errChan <- err
+					return
+				}
+				continue
+			}
 			if packet.Type != SendEventType {
 				continue
 			}
 			data := GetMessagePayload(&packet)
 			user := strings.Replace(data.Sender.Name, " ", "", -1)
-			t := time.Now().Unix()
-			err := room.storeSeen(user, t)
+			// Prefer the server's timestamp, which is right even for
+			// messages processed late, such as after a reconnect.
+			t := data.Time
+			if t <= 0 {
+				t = time.Now().Unix()
+			}
+			err := room.retryStore("seen record", func() error { return room.storeSeen(user, t) })
 			if err != nil {
 				room.errChan <- err
 				return
 			}
 		case cmd := <-cmdChan:
 			if cmd == "kill" {
+				if err := room.flushSeen(); err != nil {
+					room.Logger.Errorf("Could not flush seen records: %s", err)
+				}
 				return
 			}
 		}
 	}
 }
 
-func isValidSeenCommand(payload *Message) bool {
-	if len(payload.Content) >= 5 &&
-		payload.Content[0:5] == "!seen" &&
-		string(payload.Content[6]) == "@" &&
-		len(strings.Split(payload.Content, " ")) == 2 {
+func isValidSeenCommand(content string) bool {
+	if len(content) >= 7 &&
+		content[0:5] == "!seen" &&
+		content[6] == '@' &&
+		len(strings.Split(content, " ")) == 2 {
 		return true
 	}
 	return false
 }
 
+// replySeen replies to msg with when nick was last seen, or that they are here
+// now if they are present. A nick without a seen record is resolved with
+// ResolveNick; if that is ambiguous the sender is asked which nick they meant.
+func (r *Room) replySeen(msg *Message, nick string) error {
+	if user, ok := r.presentUser(nick); ok {
+		r.reply(msg, r.render("seen.here", map[string]interface{}{
+			"User": SanitizeContent(user.Name)}))
+		return nil
+	}
+	lastSeen, err := r.LastSeen(nick)
+	if err != nil {
+		return err
+	}
+	if !lastSeen.IsZero() {
+		r.reply(msg, r.render("seen", map[string]interface{}{
+			"Hours": int(time.Since(lastSeen).Hours())}))
+		return nil
+	}
+	matches, err := r.ResolveNick(nick)
+	if err != nil {
+		return err
+	}
+	switch len(matches) {
+	case 0:
+	case 1:
+		if lastSeen, err = r.LastSeen(matches[0]); err != nil {
+			return err
+		}
+		if !lastSeen.IsZero() {
+			r.reply(msg, r.render("seen.fuzzy", map[string]interface{}{
+				"Nick":  SanitizeContent(matches[0]),
+				"Hours": int(time.Since(lastSeen).Hours())}))
+			return nil
+		}
+	default:
+		nicks := make([]string, len(matches))
+		for i, match := range matches {
+			nicks[i] = "@" + SanitizeContent(match)
+		}
+		r.reply(msg, r.render("seen.which", map[string]interface{}{
+			"Nicks": strings.Join(nicks, " or ")}))
+		return nil
+	}
+	r.reply(msg, r.render("seen.never", nil))
+	return nil
+}
+
 // SeenCommandHandler handles a send-event, checks if !seen command was given, and responds.
+// If the store cannot be read it says so rather than giving up.
 // TODO : make seen record a time when a user joins a room or changes their nick
 func SeenCommandHandler(room *Room, input chan PacketEvent, cmdChan chan string) {
 	for {
@@ -133,23 +321,14 @@ func SeenCommandHandler(room *Room, input chan PacketEvent, cmdChan chan string)
 				continue
 			}
 			data := GetMessagePayload(&packet)
-			if isValidSeenCommand(data) {
-				trimmed := strings.TrimSpace(data.Content)
+			content := room.commandContent(data.Content)
+			if isValidSeenCommand(content) {
+				trimmed := strings.TrimSpace(content)
 				splits := strings.Split(trimmed, " ")
-				lastSeen, err := room.retrieveSeen(splits[1][1:])
-				if err != nil {
-					room.errChan <- err
-					return
-				}
-				if lastSeen == nil {
-					room.SendText("User has not been seen yet.", data.ID)
-					continue
+				if err := room.replySeen(data, splits[1][1:]); err != nil {
+					room.Logger.Errorf("Error looking up seen record: %s", err)
+					room.reply(data, room.render("unavailable", nil))
 				}
-				lastSeenInt, _ := strconv.Atoi(string(lastSeen))
-				lastSeenTime := time.Unix(int64(lastSeenInt), 0)
-				since := time.Since(lastSeenTime)
-				room.SendText(fmt.Sprintf("Seen %v hours ago.",
-					int(since.Hours())), data.ID)
 			}
 		case cmd := <-cmdChan:
 			if cmd == "kill" {
@@ -168,11 +347,7 @@ func extractTitleFromTree(z *html.Tokenizer) string {
 			return ""
 		case html.TextToken:
 			if depth > 0 {
-				title := strings.TrimSpace(string(z.Text()))
-				if title == "Imgur" {
-					return ""
-				}
-				return title
+				return strings.TrimSpace(string(z.Text()))
 			}
 		case html.StartTagToken:
 			tn, _ := z.TagName()
@@ -183,8 +358,65 @@ func extractTitleFromTree(z *html.Tokenizer) string {
 	}
 }
 
-func getLinkTitle(url string) (string, error) {
-	resp, err := http.Get(url)
+// DefaultIgnoredTitles lists the boilerplate link titles suppressed when a
+// RoomConfig does not specify its own IgnoredTitles.
+var DefaultIgnoredTitles = []string{"Imgur"}
+
+func (r *Room) isIgnoredTitle(title string) bool {
+	ignored := r.config.IgnoredTitles
+	if ignored == nil {
+		ignored = DefaultIgnoredTitles
+	}
+	for _, t := range ignored {
+		if strings.EqualFold(t, title) {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultUserAgent is the User-Agent sent when fetching link titles if the
+// RoomConfig does not specify one.
+const DefaultUserAgent = "maimai-bot/1.0"
+
+// DefaultMaxConcurrentFetches is the most link titles fetched at once when the
+// RoomConfig does not specify MaxConcurrentFetches.
+const DefaultMaxConcurrentFetches = 4
+
+// DefaultLinkTitleTimeout bounds how long fetching a link title may take when
+// the RoomConfig does not specify LinkTitleTimeout.
+const DefaultLinkTitleTimeout = time.Duration(10) * time.Second
+
+// getLinkTitle fetches the title of the page at url, waiting first if
+// MaxConcurrentFetches fetches are already in progress. The whole fetch,
+// including the wait, is abandoned after the RoomConfig's LinkTitleTimeout or
+// once ctx is done.
+func (r *Room) getLinkTitle(ctx context.Context, url string) (string, error) {
+	timeout := r.config.LinkTitleTimeout
+	if timeout <= 0 {
+		timeout = DefaultLinkTitleTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	select {
+	case r.fetchSem <- empty{}:
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+	defer func() { <-r.fetchSem }()
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return "", err
+	}
+	req = req.WithContext(ctx)
+	userAgent := r.config.UserAgent
+	if userAgent == "" {
+		userAgent = DefaultUserAgent
+	}
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("Accept", "text/html")
+	req.Header.Set("Accept-Encoding", "gzip, deflate")
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return "", err
 	}
@@ -192,30 +424,158 @@ func getLinkTitle(url string) (string, error) {
 	if resp.StatusCode != 200 {
 		return "", fmt.Errorf("Bad response code: %v", resp.StatusCode)
 	}
-	z := html.NewTokenizer(resp.Body)
-	return extractTitleFromTree(z), nil
+	body, err := decodeBody(resp)
+	if err != nil {
+		return "", err
+	}
+	// Convert to UTF-8 using the Content-Type header or a <meta> charset.
+	utf8Body, err := charset.NewReader(body, resp.Header.Get("Content-Type"))
+	if err != nil {
+		return "", err
+	}
+	z := html.NewTokenizer(utf8Body)
+	title := extractTitleFromTree(z)
+	// A read cut short by the deadline looks like a page without a title.
+	if title == "" && ctx.Err() != nil {
+		return "", ctx.Err()
+	}
+	return title, nil
+}
+
+func isZlibHeader(h []byte) bool {
+	return h[0]&0x0f == 8 && (uint16(h[0])<<8|uint16(h[1]))%31 == 0
+}
+
+// decodeBody returns a reader for the decoded body of resp. Setting
+// Accept-Encoding disables net/http's transparent decompression, and some
+// servers compress without being asked, so gzip and deflate are handled here.
+func decodeBody(resp *http.Response) (io.Reader, error) {
+	body := bufio.NewReader(resp.Body)
+	magic, _ := body.Peek(2)
+	encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	if encoding == "" && len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		encoding = "gzip"
+	}
+	switch encoding {
+	case "gzip", "x-gzip":
+		return gzip.NewReader(body)
+	case "deflate":
+		// Servers disagree on whether deflate means zlib-wrapped or raw.
+		if len(magic) == 2 && isZlibHeader(magic) {
+			return zlib.NewReader(body)
+		}
+		return flate.NewReader(body), nil
+	}
+	return body, nil
+}
+
+// isBlockedDomain reports whether rawurl's host is one of the configured
+// BlockedDomains or a subdomain of one.
+func (r *Room) isBlockedDomain(rawurl string) bool {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, domain := range r.config.BlockedDomains {
+		domain = strings.ToLower(domain)
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// maxTitlesPerMessage returns how many link titles to report per message.
+func (r *Room) maxTitlesPerMessage() int {
+	if r.config.MaxTitlesPerMessage <= 0 {
+		return 1
+	}
+	return r.config.MaxTitlesPerMessage
+}
+
+// maxQueuedTitleMessages is the most messages LinkTitleHandler queues for
+// its fetchers; messages arriving while the queue is full are skipped.
+const maxQueuedTitleMessages = 32
+
+// postLinkTitles replies to msg with the titles of the links in it, fetching
+// those not in cache, until ctx is done.
+func (r *Room) postLinkTitles(ctx context.Context, cache *titleCache, msg *Message) {
+	now := time.Now()
+	cache.expire(now)
+	urls := linkMatcher.FindAllString(msg.Content, -1)
+	fetched := make(map[string]bool)
+	reported := 0
+	for _, url := range urls {
+		if reported >= r.maxTitlesPerMessage() || ctx.Err() != nil {
+			break
+		}
+		if !strings.HasPrefix(url, "http") {
+			url = "http://" + url
+		}
+		if fetched[url] || r.isBlockedDomain(url) || cache.recentlyPosted(url, now) {
+			continue
+		}
+		fetched[url] = true
+		title, ok := cache.title(url, now)
+		if !ok {
+			var err error
+			title, err = cache.fetch(url, func() (string, error) { return r.getLinkTitle(ctx, url) })
+			if err != nil {
+				continue
+			}
+			now = time.Now()
+			cache.store(url, title, now)
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		if title != "" && !r.isIgnoredTitle(title) && cache.claimPost(url, now) {
+			r.SendText("Link title: "+SanitizeContent(title), msg.ID)
+			reported++
+		}
+	}
 }
 
 // LinkTitleHandler handles a send-event, looks for URLs, and replies with the
-// title text of a link if a valid one is found.
+// title text of a link if a valid one is found. Titles are cached, and a link's
+// title is not posted again within the LinkTitleWindow. Messages are queued
+// for MaxConcurrentFetches fetchers, so that a slow site doesn't hold up the
+// others, and a link already being fetched is not fetched again. Fetches in
+// progress are abandoned when the handler is killed.
 func LinkTitleHandler(room *Room, input chan PacketEvent, cmdChan chan string) {
+	cache := room.newTitleCache()
+	ctx, cancel := context.WithCancel(context.Background())
+	queue := make(chan *Message, maxQueuedTitleMessages)
+	var wg sync.WaitGroup
+	for i := 0; i < cap(room.fetchSem); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for msg := range queue {
+				room.postLinkTitles(ctx, cache, msg)
+			}
+		}()
+	}
+	defer func() {
+		cancel()
+		close(queue)
+		wg.Wait()
+	}()
 	for {
 		select {
 		case packet := <-input:
 			if packet.Type != SendEventType {
 				continue
 			}
+			if !room.announcing(FeatureLinkTitles) {
+				continue
+			}
 			data := GetMessagePayload(&packet)
-			urls := linkMatcher.FindAllString(data.Content, -1)
-			for _, url := range urls {
-				if !strings.HasPrefix(url, "http") {
-					url = "http://" + url
-				}
-				title, err := getLinkTitle(url)
-				if err == nil && title != "" {
-					room.SendText("Link title: "+title, data.ID)
-					break
-				}
+			select {
+			case queue <- data:
+			default:
+				room.Logger.Warningf("Link title queue is full, skipping message %s", data.ID)
 			}
 		case cmd := <-cmdChan:
 			if cmd == "kill" {
@@ -235,12 +595,10 @@ func UptimeCommandHandler(room *Room, input chan PacketEvent, cmdChan chan strin
 				continue
 			}
 			data := GetMessagePayload(&packet)
-			if data.Content == "!uptime" {
+			if name, _ := data.CommandName(room.config.CommandPrefix); name == "uptime" {
 				since := time.Since(room.uptime)
-				room.SendText(fmt.Sprintf(
-					"This bot has been up for %s.",
-					since.String()),
-					data.ID)
+				room.reply(data, room.render("uptime", map[string]interface{}{
+					"Uptime": since.String()}))
 			}
 		case cmd := <-cmdChan:
 			if cmd == "kill" {
@@ -250,6 +608,90 @@ func UptimeCommandHandler(room *Room, input chan PacketEvent, cmdChan chan strin
 	}
 }
 
+// CoinFlipCommandHandler handles a send-event and if the !flip command is
+// given replies with heads or tails.
+func CoinFlipCommandHandler(room *Room, input chan PacketEvent, cmdChan chan string) {
+	for {
+		select {
+		case packet := <-input:
+			if packet.Type != SendEventType {
+				continue
+			}
+			data := GetMessagePayload(&packet)
+			if room.commandContent(data.Content) == "!flip" {
+				heads := room.Rand.Intn(2) == 0
+				if heads {
+					room.reply(data, "heads")
+				} else {
+					room.reply(data, "tails")
+				}
+				result := GameResult{Game: "flip", User: data.Sender}
+				if heads {
+					result.Score = 1
+				}
+				room.EmitGameResult(result)
+			}
+		case cmd := <-cmdChan:
+			if cmd == "kill" {
+				return
+			}
+		}
+	}
+}
+
+const timeUsage = "Usage: !time [timezone], e.g. !time America/New_York. Without a timezone, your !tz setting is used."
+
+// loadTimezone loads an IANA timezone, rejecting "Local" so that replies never
+// depend on the bot's host.
+func loadTimezone(name string) (*time.Location, error) {
+	if name == "Local" {
+		return nil, errors.New("Unknown timezone: Local")
+	}
+	return time.LoadLocation(name)
+}
+
+// TimeCommandHandler handles a send-event and if the !time command is given
+// replies with the current time in the requested timezone, or UTC.
+func TimeCommandHandler(room *Room, input chan PacketEvent, cmdChan chan string) {
+	for {
+		select {
+		case packet := <-input:
+			if packet.Type != SendEventType {
+				continue
+			}
+			data := GetMessagePayload(&packet)
+			fields := ParseArgs(room.commandContent(data.Content))
+			if len(fields) == 0 || fields[0] != "!time" {
+				continue
+			}
+			var loc *time.Location
+			var err error
+			switch len(fields) {
+			case 1:
+				// Use the sender's !tz preference.
+				if loc, err = room.UserLocation(&data.Sender); err != nil {
+					room.errChan <- err
+					return
+				}
+			case 2:
+				if loc, err = loadTimezone(fields[1]); err != nil {
+					room.reply(data, timeUsage)
+					continue
+				}
+			default:
+				room.reply(data, timeUsage)
+				continue
+			}
+			room.reply(data, fmt.Sprintf("It is %s in %s.",
+				time.Now().In(loc).Format("Mon Jan 2 15:04 MST"), loc))
+		case cmd := <-cmdChan:
+			if cmd == "kill" {
+				return
+			}
+		}
+	}
+}
+
 func ScritchCommandHandler(room *Room, input chan PacketEvent, cmdChan chan string) {
 	for {
 		select {
@@ -258,7 +700,7 @@ func ScritchCommandHandler(room *Room, input chan PacketEvent, cmdChan chan stri
 				continue
 			}
 			data := GetMessagePayload(&packet)
-			if data.Content == "!scritch" {
+			if room.commandContent(data.Content) == "!scritch" {
 				room.SendText("/me bruxes",
 					data.ID)
 			}
@@ -296,19 +738,44 @@ func DebugHandler(room *Room, input chan PacketEvent, cmdChan chan string) {
 	}
 }
 
+// nickChange classifies a nick-event. A nick-event with an empty From is a
+// join, one with an empty To is a part, and one with both is a rename.
+type nickChange int
+
+const (
+	nickInvalid nickChange = iota
+	nickJoin
+	nickPart
+	nickRename
+)
+
+func classifyNickEvent(data *NickEvent) nickChange {
+	switch {
+	case data.From == "" && data.To == "":
+		return nickInvalid
+	case data.From == "":
+		return nickJoin
+	case data.To == "":
+		return nickPart
+	case data.From == data.To:
+		return nickInvalid
+	}
+	return nickRename
+}
+
 func NickChangeHandler(room *Room, input chan PacketEvent, cmdChan chan string) {
 	for {
 		select {
 		case packet := <-input:
-			if packet.Type != NickEventType {
+			if packet.Type != NickEventType || !room.announcing(FeatureAnnouncements) {
 				continue
 			}
 			data := GetNickEventPayload(&packet)
-			// Don't want to process joins or leaves here
-			if data.From == "" || data.To == "" {
+			if classifyNickEvent(data) != nickRename {
 				continue
 			}
-			room.SendText(fmt.Sprintf("< %s is now known as %s. >", data.From, data.To), "")
+			room.SendText(room.render("nick", map[string]interface{}{
+				"From": SanitizeContent(data.From), "To": SanitizeContent(data.To)}), "")
 		case cmd := <-cmdChan:
 			if cmd == "kill" {
 				return
@@ -317,10 +784,25 @@ func NickChangeHandler(room *Room, input chan PacketEvent, cmdChan chan string)
 	}
 }
 
+// DefaultPartGrace is how long a user must be gone before their part is
+// announced when the RoomConfig does not specify PartGrace.
+const DefaultPartGrace = time.Duration(5) * time.Minute
+
+// partDelay returns how long to wait before announcing a part: the grace
+// period plus jitter, so that announcements for users who left together are
+// spread out.
+func (r *Room) partDelay() time.Duration {
+	grace := r.config.PartGrace
+	if grace <= 0 {
+		grace = DefaultPartGrace
+	}
+	return grace + r.Jitter(r.config.PartJitter)
+}
+
 func partTimer(room *Room, user string) {
-	time.Sleep(time.Duration(5) * time.Minute)
-	if room.isUserLeaving(user) && user != "" {
-		room.SendText(fmt.Sprintf("< %s left the room. >", user), "")
+	time.Sleep(room.partDelay())
+	if room.isUserLeaving(user) && user != "" && room.announcing(FeatureAnnouncements) {
+		room.SendText(room.render("part", map[string]interface{}{"User": SanitizeContent(user)}), "")
 		room.clearUserLeaving(user)
 	}
 }
@@ -329,11 +811,22 @@ func PartEventHandler(room *Room, input chan PacketEvent, cmdChan chan string) {
 	for {
 		select {
 		case packet := <-input:
-			if packet.Type != PartEventType {
+			if !room.IsEnabled(FeatureAnnouncements) {
+				continue
+			}
+			var user string
+			switch packet.Type {
+			case PartEventType:
+				user = GetPresenceEventPayload(&packet).User.Name
+			case NickEventType:
+				data := GetNickEventPayload(&packet)
+				if classifyNickEvent(data) != nickPart {
+					continue
+				}
+				user = data.From
+			default:
 				continue
 			}
-			data := GetPresenceEventPayload(&packet)
-			user := data.User.Name
 			room.setUserLeaving(user)
 			go partTimer(room, user)
 		case cmd := <-cmdChan:
@@ -351,6 +844,9 @@ func JoinEventHandler(room *Room, input chan PacketEvent, cmdChan chan string) {
 			if packet.Type != JoinEventType && packet.Type != NickEventType {
 				continue
 			}
+			if !room.IsEnabled(FeatureAnnouncements) {
+				continue
+			}
 			switch packet.Type {
 			case JoinEventType:
 				data := GetPresenceEventPayload(&packet)
@@ -358,17 +854,17 @@ func JoinEventHandler(room *Room, input chan PacketEvent, cmdChan chan string) {
 				if user == "" {
 					continue
 				}
-				if !room.isUserLeaving(user) {
-					room.SendText(fmt.Sprintf("< %s joined the room. >", user), "")
+				if !room.isUserLeaving(user) && !room.IsQuiet(time.Now()) {
+					room.SendText(room.render("join", map[string]interface{}{"User": SanitizeContent(user)}), "")
 				}
 				room.clearUserLeaving(user)
 			case NickEventType:
 				data := GetNickEventPayload(&packet)
-				if data.From != "" {
+				if classifyNickEvent(data) != nickJoin {
 					continue
 				}
-				if !room.isUserLeaving(data.To) {
-					room.SendText(fmt.Sprintf("< %s joined the room. >", data.To), "")
+				if !room.isUserLeaving(data.To) && !room.IsQuiet(time.Now()) {
+					room.SendText(room.render("join", map[string]interface{}{"User": SanitizeContent(data.To)}), "")
 				}
 				room.clearUserLeaving(data.To)
 			}
@@ -380,19 +876,57 @@ func JoinEventHandler(room *Room, input chan PacketEvent, cmdChan chan string) {
 	}
 }
 
+// logPruneInterval is how often MessageLogHandler prunes the message log
+// when a retention window is set.
+const logPruneInterval = time.Hour
+
+// fetchTruncated fetches the full content of msg, which the server sent
+// truncated, and logs it in place of the truncated content, unless stopped is
+// closed by then.
+func (r *Room) fetchTruncated(msg *Message, stopped chan empty) {
+	full, err := r.GetMessage(msg.ID)
+	if err != nil {
+		r.Logger.Errorf("Error fetching truncated message %s: %s", msg.ID, err)
+		return
+	}
+	select {
+	case <-stopped:
+		return
+	default:
+	}
+	msgID, msgLogEvent := prepareMsgLogEvent(full)
+	r.storeMsgLogEvent(msgID, msgLogEvent)
+}
+
 func MessageLogHandler(room *Room, input chan PacketEvent, cmdChan chan string) {
+	ticker := time.NewTicker(logPruneInterval)
+	defer ticker.Stop()
+	stopped := make(chan empty)
+	defer close(stopped)
 	for {
 		select {
+		case now := <-ticker.C:
+			room.pruneExpiredLog(now)
 		case packet := <-input:
 			switch packet.Type {
 			case SendEventType:
 				data := GetMessagePayload(&packet)
 				msgID, msgLogEvent := prepareMsgLogEvent(data)
 				room.storeMsgLogEvent(msgID, msgLogEvent)
+				if data.Truncated && room.config.FetchTruncated {
+					go room.fetchTruncated(data, stopped)
+				}
 			case SendReplyType:
 				data := GetMessagePayload(&packet)
 				msgID, msgLogEvent := prepareMsgLogEvent(data)
 				room.storeMsgLogEvent(msgID, msgLogEvent)
+			case EditMessageEventType:
+				payload, err := packet.Payload()
+				if err != nil {
+					room.Logger.Errorf("Error reading edit-message-event: %s", err)
+					continue
+				}
+				room.reconcileMsgLogEvent(payload.(*EditMessageEvent))
 			}
 		case cmd := <-cmdChan:
 			if cmd == "kill" {
@@ -0,0 +1,237 @@
+package maimai
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// maxLastMessages caps the number of messages !last will return.
+const maxLastMessages = 5
+
+const lastUsage = "Usage: !last @user [n]"
+
+// maxGrepResults caps the number of messages !grep will return, and
+// maxGrepLineLength the length of each.
+const (
+	maxGrepResults    = 3
+	maxGrepLineLength = 200
+)
+
+const grepUsage = "Usage: !grep <pattern>"
+
+func formatMsgLogEvents(msgs []*MsgLogEvent) string {
+	lines := make([]string, len(msgs))
+	// msgs are newest first; reply oldest first.
+	for i, msg := range msgs {
+		lines[len(msgs)-1-i] = fmt.Sprintf("[%s] %s", SanitizeContent(msg.UserName),
+			truncate(SanitizeContent(msg.Content), maxGrepLineLength))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// userMessages returns up to n logged messages from the user whose most recent
+// message was sent under nick, newest first. Once the user is found by nick
+// their messages are matched by user ID, so earlier messages under other nicks
+// are included.
+func (r *Room) userMessages(nick string, n int) ([]*MsgLogEvent, error) {
+	normalized := strings.Replace(nick, " ", "", -1)
+	byName := func(msgID string, msg *MsgLogEvent) bool {
+		return strings.EqualFold(strings.Replace(msg.UserName, " ", "", -1), normalized) &&
+			commandOf(r.commandContent(msg.Content)) != "!last"
+	}
+	latest, err := r.retrieveMsgLogEvents(byName, 1)
+	if err != nil || len(latest) == 0 {
+		return nil, err
+	}
+	userID := latest[0].UserID
+	if userID == "" {
+		return r.retrieveMsgLogEvents(byName, n)
+	}
+	return r.retrieveMsgLogEvents(func(msgID string, msg *MsgLogEvent) bool {
+		return msg.UserID == userID && commandOf(r.commandContent(msg.Content)) != "!last"
+	}, n)
+}
+
+// LastCommandHandler handles a send-event, checks for a !last command, and
+// replies with the given user's most recent logged messages.
+func LastCommandHandler(room *Room, input chan PacketEvent, cmdChan chan string) {
+	for {
+		select {
+		case packet := <-input:
+			if packet.Type != SendEventType {
+				continue
+			}
+			data := GetMessagePayload(&packet)
+			fields := ParseArgs(room.commandContent(data.Content))
+			if len(fields) == 0 || fields[0] != "!last" {
+				continue
+			}
+			if len(fields) < 2 || len(fields) > 3 || !strings.HasPrefix(fields[1], "@") {
+				room.SendText(lastUsage, data.ID)
+				continue
+			}
+			n := 1
+			if len(fields) == 3 {
+				var err error
+				n, err = strconv.Atoi(fields[2])
+				if err != nil || n < 1 {
+					room.SendText(lastUsage, data.ID)
+					continue
+				}
+				if n > maxLastMessages {
+					n = maxLastMessages
+				}
+			}
+			msgs, err := room.userMessages(fields[1][1:], n)
+			if err != nil {
+				room.errChan <- err
+				return
+			}
+			if len(msgs) == 0 {
+				room.SendText(fmt.Sprintf("No messages found for %s.", SanitizeContent(fields[1])), data.ID)
+				continue
+			}
+			room.SendText(formatMsgLogEvents(msgs), data.ID)
+		case cmd := <-cmdChan:
+			if cmd == "kill" {
+				return
+			}
+		}
+	}
+}
+
+// compileGrepPattern compiles pattern as a case-insensitive regular
+// expression, falling back to a literal match if it is not valid.
+func compileGrepPattern(pattern string) *regexp.Regexp {
+	re, err := regexp.Compile("(?i)" + pattern)
+	if err != nil {
+		re = regexp.MustCompile("(?i)" + regexp.QuoteMeta(pattern))
+	}
+	return re
+}
+
+// grepMessages returns up to maxGrepResults logged messages matching pattern,
+// newest first. Earlier !grep commands are not matched.
+func (r *Room) grepMessages(pattern string) ([]*MsgLogEvent, error) {
+	re := compileGrepPattern(pattern)
+	return r.retrieveMsgLogEvents(func(msgID string, msg *MsgLogEvent) bool {
+		return commandOf(r.commandContent(msg.Content)) != "!grep" && re.MatchString(msg.Content)
+	}, maxGrepResults)
+}
+
+// GrepCommandHandler handles a send-event, checks for a !grep command, and
+// replies with the most recent logged messages matching the pattern.
+func GrepCommandHandler(room *Room, input chan PacketEvent, cmdChan chan string) {
+	for {
+		select {
+		case packet := <-input:
+			if packet.Type != SendEventType {
+				continue
+			}
+			data := GetMessagePayload(&packet)
+			content := room.commandContent(data.Content)
+			if commandOf(content) != "!grep" {
+				continue
+			}
+			pattern := strings.TrimSpace(strings.TrimPrefix(content, "!grep"))
+			if pattern == "" {
+				room.SendText(grepUsage, data.ID)
+				continue
+			}
+			msgs, err := room.grepMessages(pattern)
+			if err != nil {
+				room.errChan <- err
+				return
+			}
+			if len(msgs) == 0 {
+				room.SendText("No matching messages found.", data.ID)
+				continue
+			}
+			room.SendText(formatMsgLogEvents(msgs), data.ID)
+		case cmd := <-cmdChan:
+			if cmd == "kill" {
+				return
+			}
+		}
+	}
+}
+
+// maxThreadMessages caps the number of messages !thread will summarize, and
+// maxThreadLength the length of the summary.
+const (
+	maxThreadMessages = 10
+	maxThreadLength   = 1000
+)
+
+const threadUsage = "Reply to a message with !thread to summarize its thread."
+
+// threadMessages returns up to maxThreadMessages logged messages from the
+// thread ending at msgID, found by walking Parent links, newest first. more
+// reports whether older messages were left out.
+func (r *Room) threadMessages(msgID string) (msgs []*MsgLogEvent, more bool, err error) {
+	for msgID != "" {
+		if len(msgs) == maxThreadMessages {
+			return msgs, true, nil
+		}
+		msg, err := r.retrieveMsgLogEvent(msgID)
+		if err != nil || msg == nil {
+			return msgs, false, err
+		}
+		msgs = append(msgs, msg)
+		msgID = msg.Parent
+	}
+	return msgs, false, nil
+}
+
+// formatThread formats msgs, newest first, noting if older messages were
+// left out.
+func formatThread(msgs []*MsgLogEvent, more bool) string {
+	if more {
+		return "(earlier messages omitted)\n" + formatMsgLogEvents(msgs)
+	}
+	return formatMsgLogEvents(msgs)
+}
+
+// ThreadCommandHandler handles a send-event, checks for a !thread command sent
+// as a reply, and replies with a summary of the logged messages in the thread
+// above it, oldest first.
+func ThreadCommandHandler(room *Room, input chan PacketEvent, cmdChan chan string) {
+	for {
+		select {
+		case packet := <-input:
+			if packet.Type != SendEventType {
+				continue
+			}
+			data := GetMessagePayload(&packet)
+			if commandOf(room.commandContent(data.Content)) != "!thread" {
+				continue
+			}
+			if data.Parent == "" {
+				room.SendText(threadUsage, data.ID)
+				continue
+			}
+			msgs, more, err := room.threadMessages(data.Parent)
+			if err != nil {
+				room.errChan <- err
+				return
+			}
+			if len(msgs) == 0 {
+				room.SendText("That thread is not in the message log.", data.ID)
+				continue
+			}
+			summary := formatThread(msgs, more)
+			// Drop the oldest messages until the summary fits.
+			for len(msgs) > 1 && len(summary) > maxThreadLength {
+				msgs = msgs[:len(msgs)-1]
+				summary = formatThread(msgs, true)
+			}
+			room.reply(data, summary)
+		case cmd := <-cmdChan:
+			if cmd == "kill" {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package maimai
+
+import "strings"
+
+const ignoreUsage = "Usage: !ignore @user or !unignore @user (or a user ID)"
+
+// Ignore drops send-events from the user with userID before they reach any
+// handler. Users are keyed by ID rather than nick, which anyone can take.
+func (r *Room) Ignore(userID string) {
+	r.ignore(User{ID: userID})
+}
+
+// ignore ignores user, remembering their nick so that they can be unignored
+// by it once they have left.
+func (r *Room) ignore(user User) {
+	r.data.Lock()
+	r.data.ignored[user.ID] = user.Name
+	r.data.Unlock()
+}
+
+// Unignore stops ignoring the user with userID.
+func (r *Room) Unignore(userID string) {
+	r.data.Lock()
+	delete(r.data.ignored, userID)
+	r.data.Unlock()
+}
+
+// IsIgnored reports whether the user with userID is ignored.
+func (r *Room) IsIgnored(userID string) bool {
+	r.data.Lock()
+	defer r.data.Unlock()
+	_, ok := r.data.ignored[userID]
+	return ok
+}
+
+// fromIgnored reports whether packet is a send-event from an ignored user.
+func (r *Room) fromIgnored(packet *PacketEvent) bool {
+	if packet.Type != SendEventType {
+		return false
+	}
+	data := GetMessagePayload(packet)
+	return data != nil && r.IsIgnored(data.Sender.ID)
+}
+
+// presentUser returns the present user whose nick, ignoring spaces and case,
+// is nick.
+func (r *Room) presentUser(nick string) (User, bool) {
+	for _, user := range r.Users() {
+		if sameNick(user.Name, nick) {
+			return user, true
+		}
+	}
+	return User{}, false
+}
+
+// ignoredUser returns the ignored user whose nick when ignored, ignoring
+// spaces and case, is nick.
+func (r *Room) ignoredUser(nick string) (User, bool) {
+	r.data.Lock()
+	defer r.data.Unlock()
+	for id, name := range r.data.ignored {
+		if name != "" && sameNick(name, nick) {
+			return User{ID: id, Name: name}, true
+		}
+	}
+	return User{}, false
+}
+
+func sameNick(a, b string) bool {
+	return strings.EqualFold(strings.Replace(a, " ", "", -1), strings.Replace(b, " ", "", -1))
+}
+
+// isSelf reports whether userID is the bot's own.
+func (r *Room) isSelf(userID string) bool {
+	r.data.Lock()
+	defer r.data.Unlock()
+	return r.data.userID != "" && userID == r.data.userID
+}
+
+// IgnoreCommandHandler handles a send-event, checks for an !ignore or
+// !unignore command, and ignores or unignores the named user. A user to be
+// ignored must be present, and may not be an admin or the bot itself; a user
+// to be unignored may instead be named by the nick they were ignored under, or
+// by their user ID. It should be wrapped with WithAdminOnly.
+func IgnoreCommandHandler(room *Room, input chan PacketEvent, cmdChan chan string) {
+	for {
+		select {
+		case packet := <-input:
+			if packet.Type != SendEventType {
+				continue
+			}
+			data := GetMessagePayload(&packet)
+			fields := strings.Fields(room.commandContent(data.Content))
+			if len(fields) == 0 || (fields[0] != "!ignore" && fields[0] != "!unignore") {
+				continue
+			}
+			if len(fields) != 2 || (fields[0] == "!ignore" && !strings.HasPrefix(fields[1], "@")) {
+				room.SendText(ignoreUsage, data.ID)
+				continue
+			}
+			user, ok := User{ID: fields[1], Name: fields[1]}, true
+			if nick := strings.TrimPrefix(fields[1], "@"); nick != fields[1] {
+				ok = false
+				if fields[0] == "!unignore" {
+					user, ok = room.ignoredUser(nick)
+				}
+				if !ok {
+					user, ok = room.presentUser(nick)
+				}
+			}
+			if !ok {
+				room.SendTextf(data.ID, "%s is not here.", fields[1])
+				continue
+			}
+			vars := map[string]interface{}{"User": SanitizeContent(user.Name)}
+			if fields[0] == "!ignore" {
+				if room.isAdmin(user.ID) || room.isSelf(user.ID) {
+					room.SendText(room.render("ignore.deny", vars), data.ID)
+					continue
+				}
+				room.ignore(user)
+				room.Logger.Infof("User %s (%s) ignored by %s (%s)", user.Name, user.ID, data.Sender.Name, data.Sender.ID)
+				room.SendText(room.render("ignore.on", vars), data.ID)
+			} else {
+				room.Unignore(user.ID)
+				room.Logger.Infof("User %s (%s) unignored by %s (%s)", user.Name, user.ID, data.Sender.Name, data.Sender.ID)
+				room.SendText(room.render("ignore.off", vars), data.ID)
+			}
+		case cmd := <-cmdChan:
+			if cmd == "kill" {
+				return
+			}
+		}
+	}
+}
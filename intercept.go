@@ -0,0 +1,74 @@
+package maimai
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Interceptor inspects an inbound packet before it reaches the handlers and
+// reports whether it consumed the packet. A consumed packet is not passed to
+// lower-priority interceptors or to any handler, so an interceptor can, for
+// example, stop commands in spam from being acted on.
+//
+// Interceptors run in the dispatcher, in order, so they must return quickly
+// and must not wait for replies from the server; start a goroutine for that.
+type Interceptor func(room *Room, packet *PacketEvent) bool
+
+type interceptorEntry struct {
+	name        string
+	priority    int
+	interceptor Interceptor
+}
+
+type byPriority []*interceptorEntry
+
+func (p byPriority) Len() int           { return len(p) }
+func (p byPriority) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p byPriority) Less(i, j int) bool { return p[i].priority > p[j].priority }
+
+// AddInterceptor registers an Interceptor under name. Interceptors run in
+// descending order of priority, and those with equal priority in the order
+// they were added.
+func (r *Room) AddInterceptor(name string, priority int, f Interceptor) error {
+	r.handlersMu.Lock()
+	defer r.handlersMu.Unlock()
+	for _, e := range r.interceptors {
+		if e.name == name {
+			return fmt.Errorf("Interceptor already registered: %s", name)
+		}
+	}
+	interceptors := append(append([]*interceptorEntry{}, r.interceptors...),
+		&interceptorEntry{name: name, priority: priority, interceptor: f})
+	sort.Stable(byPriority(interceptors))
+	r.interceptors = interceptors
+	return nil
+}
+
+// RemoveInterceptor removes the Interceptor registered under name.
+func (r *Room) RemoveInterceptor(name string) error {
+	r.handlersMu.Lock()
+	defer r.handlersMu.Unlock()
+	for i, e := range r.interceptors {
+		if e.name == name {
+			interceptors := append([]*interceptorEntry{}, r.interceptors[:i]...)
+			r.interceptors = append(interceptors, r.interceptors[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("No interceptor registered: %s", name)
+}
+
+// intercept runs the interceptors on packet, reporting whether one consumed
+// it.
+func (r *Room) intercept(packet *PacketEvent) bool {
+	r.handlersMu.Lock()
+	interceptors := r.interceptors
+	r.handlersMu.Unlock()
+	for _, e := range interceptors {
+		if e.interceptor(r, packet) {
+			r.Logger.Debugf("Packet of type %s and ID %s consumed by %s", packet.Type, packet.ID, e.name)
+			return true
+		}
+	}
+	return false
+}
@@ -1,13 +1,32 @@
 package maimai
 
 import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+	"unicode/utf8"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/websocket"
 )
 
 type MockSenderReceiver struct {
@@ -16,12 +35,15 @@ type MockSenderReceiver struct {
 	stopFlag bool
 	room     string
 	wg       sync.WaitGroup
+	// reconnects counts calls to reconnect.
+	reconnects int32
+	closed     bool
 }
 
 func NewMockSR(room string) *MockSenderReceiver {
 	outbound := make(chan *PacketEvent, 4)
 	inbound := make(chan *PacketEvent, 4)
-	return &MockSenderReceiver{outbound, inbound, false, room, sync.WaitGroup{}}
+	return &MockSenderReceiver{outbound, inbound, false, room, sync.WaitGroup{}, 0, false}
 }
 
 func (m *MockSenderReceiver) connect(r *Room) error {
@@ -65,6 +87,16 @@ func (m *MockSenderReceiver) start(r *Room, inbound chan *PacketEvent, outbound
 	}()
 }
 
+func (m *MockSenderReceiver) reconnect(r *Room) error {
+	atomic.AddInt32(&m.reconnects, 1)
+	return nil
+}
+
+func (m *MockSenderReceiver) close() error {
+	m.closed = true
+	return nil
+}
+
 func (m *MockSenderReceiver) stop() {
 	m.stopFlag = true
 }
@@ -75,14 +107,21 @@ type TestHarness struct {
 	t        *testing.T
 }
 
-func NewTestHarness(t *testing.T) (*Room, *TestHarness) {
-	roomCfg := &RoomConfig{
+func NewTestRoomConfig() *RoomConfig {
+	return &RoomConfig{
 		DBPath:       "test.db",
 		ErrorLogPath: "test.log",
 		Join:         true,
 		MsgLog:       true,
 		Nick:         "MaiMai",
 	}
+}
+
+func NewTestHarness(t *testing.T) (*Room, *TestHarness) {
+	return NewTestHarnessWithConfig(t, NewTestRoomConfig())
+}
+
+func NewTestHarnessWithConfig(t *testing.T, roomCfg *RoomConfig) (*Room, *TestHarness) {
 	mockSR := NewMockSR("test")
 	room, err := NewRoom(roomCfg, "test", mockSR, logrus.New())
 	if err != nil {
@@ -128,6 +167,30 @@ func (th *TestHarness) AssertReceivedSendPrefix(prefix string) {
 	}
 }
 
+func (th *TestHarness) AssertNoPacket() {
+	select {
+	case packet := <-*th.outbound:
+		th.t.Fatalf("Unexpected packet of type %s.", packet.Type)
+	case <-time.After(time.Duration(300) * time.Millisecond):
+	}
+}
+
+func (th *TestHarness) ReceiveSendText() string {
+	packet := <-*th.outbound
+	if packet.Type != SendType {
+		th.t.Fatalf("Packet is not of type 'send'. Got %s", packet.Type)
+	}
+	payload, err := packet.Payload()
+	if err != nil {
+		th.t.Fatalf("Could not extract packet payload. Error: %s", err)
+	}
+	data, ok := payload.(*SendCommand)
+	if !ok {
+		th.t.Fatal("Could not assert payload as *SendCommand.")
+	}
+	return data.Content
+}
+
 func (th *TestHarness) AssertReceivedNick() {
 	packet := <-*th.outbound
 	if packet.Type != "nick" {
@@ -167,6 +230,25 @@ func (th *TestHarness) SendSendEvent(text string, parent string, sender string)
 	*th.inbound <- &msg
 }
 
+func (th *TestHarness) SendSendEventFrom(text string, parent string, sender User) {
+	payload, _ := json.Marshal(Message{
+		Content: text,
+		Parent:  parent,
+		Sender:  sender})
+	msg := PacketEvent{
+		Type: SendEventType,
+		Data: payload}
+	*th.inbound <- &msg
+}
+
+func (th *TestHarness) SendMessage(message Message) {
+	payload, _ := json.Marshal(message)
+	msg := PacketEvent{
+		Type: SendEventType,
+		Data: payload}
+	*th.inbound <- &msg
+}
+
 func (th *TestHarness) SendPingEvent() {
 	payload, _ := json.Marshal(PingEvent{
 		Time: time.Now().Unix(),
@@ -196,6 +278,42 @@ func (th *TestHarness) SendPresenceEvent(ptype PacketType, name string) {
 	*th.inbound <- &msg
 }
 
+func (th *TestHarness) SendSessionEvent(ptype PacketType, name string, sessionID string) {
+	payload, _ := json.Marshal(PresenceEvent{
+		User:      &User{ID: "agent:" + sessionID, Name: name},
+		SessionID: sessionID})
+	msg := PacketEvent{
+		Type: ptype,
+		Data: payload}
+	*th.inbound <- &msg
+}
+
+func (th *TestHarness) SendSnapshotEvent(snapshot SnapshotEvent) {
+	payload, _ := json.Marshal(snapshot)
+	msg := PacketEvent{
+		Type: SnapshotEventType,
+		Data: payload}
+	*th.inbound <- &msg
+}
+
+func WaitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timeout: condition not met.")
+		}
+		time.Sleep(time.Duration(10) * time.Millisecond)
+	}
+}
+
+func userNames(users []User) string {
+	var names []string
+	for _, user := range users {
+		names = append(names, user.Name)
+	}
+	return strings.Join(names, ",")
+}
+
 func TestConnect(t *testing.T) {
 	room, _ := NewTestHarness(t)
 	defer room.db.Close()
@@ -220,6 +338,41 @@ func TestSendText(t *testing.T) {
 	th.AssertReceivedSendText("test text")
 }
 
+func TestReadOnly(t *testing.T) {
+	room, th := NewTestHarness(t)
+	defer room.db.Close()
+	defer room.Stop()
+	go room.Run()
+	room.SetReadOnly(true)
+	room.SendText("test text", "")
+	th.SendSendEvent("!ping", "", "test")
+	th.AssertNoPacket()
+	th.SendPingEvent()
+	packet := <-*th.outbound
+	if packet.Type != PingReplyType {
+		t.Fatalf("Incorrect packet type. Expected 'ping-reply', got '%s'", packet.Type)
+	}
+	room.SetReadOnly(false)
+	room.SendText("test text", "")
+	th.AssertReceivedSendText("test text")
+}
+
+func TestRandSource(t *testing.T) {
+	roomCfg := NewTestRoomConfig()
+	roomCfg.RandSource = rand.NewSource(42)
+	room, _ := NewTestHarnessWithConfig(t, roomCfg)
+	first := []int{room.Rand.Intn(1000), room.Rand.Intn(1000), room.Rand.Intn(1000)}
+	room.db.Close()
+	roomCfg.RandSource = rand.NewSource(42)
+	room, _ = NewTestHarnessWithConfig(t, roomCfg)
+	defer room.db.Close()
+	for i, n := range first {
+		if got := room.Rand.Intn(1000); got != n {
+			t.Fatalf("Seeded Rand not reproducible at %d. Expected %d, got %d", i, n, got)
+		}
+	}
+}
+
 func TestPingCommand(t *testing.T) {
 	room, th := NewTestHarness(t)
 	defer room.db.Close()
@@ -238,6 +391,34 @@ func TestScritchCommand(t *testing.T) {
 	defer room.Stop()
 }
 
+func TestCoinFlipCommand(t *testing.T) {
+	room, th := NewTestHarness(t)
+	defer room.db.Close()
+	defer room.Stop()
+	go room.Run()
+	for i := 0; i < 5; i++ {
+		th.SendSendEvent("!flip", "", "test")
+		if text := th.ReceiveSendText(); text != "heads" && text != "tails" {
+			t.Fatalf("Unexpected coin flip result: '%s'", text)
+		}
+	}
+}
+
+func TestTimeCommand(t *testing.T) {
+	room, th := NewTestHarness(t)
+	defer room.db.Close()
+	defer room.Stop()
+	go room.Run()
+	th.SendSendEvent("!time", "", "test")
+	th.AssertReceivedSendPrefix("It is ")
+	th.SendSendEvent("!time UTC", "", "test")
+	th.AssertReceivedSendPrefix("It is ")
+	th.SendSendEvent("!time Not/A_Zone", "", "test")
+	th.AssertReceivedSendText(timeUsage)
+	th.SendSendEvent("!time Local", "", "test")
+	th.AssertReceivedSendText(timeUsage)
+}
+
 func TestSeenCommand(t *testing.T) {
 	room, th := NewTestHarness(t)
 	defer room.db.Close()
@@ -249,6 +430,100 @@ func TestSeenCommand(t *testing.T) {
 	defer room.Stop()
 }
 
+func TestBlankContent(t *testing.T) {
+	for _, content := range []string{"!seen", "!seen ", "!seen@", "!seen  "} {
+		if isValidSeenCommand(content) {
+			t.Errorf("%q was accepted as a !seen command.", content)
+		}
+	}
+	room, th := NewTestHarness(t)
+	defer room.db.Close()
+	defer room.Stop()
+	var reached int32
+	room.AddHandler("counter", WithNonBlankContent(func(room *Room, input chan PacketEvent, cmdChan chan string) {
+		for {
+			select {
+			case packet := <-input:
+				if packet.Type == SendEventType {
+					atomic.AddInt32(&reached, 1)
+				}
+			case cmd := <-cmdChan:
+				if cmd == "kill" {
+					return
+				}
+			}
+		}
+	}))
+	go room.Run()
+	for _, content := range []string{"", "   ", "\n\t", "!seen", "!seen "} {
+		th.SendSendEvent(content, "", "test")
+	}
+	th.SendMessage(Message{ID: "blank-1", Sender: User{ID: "agent:test", Name: "test"}, Time: 100})
+	th.AssertNoPacket()
+	if n := atomic.LoadInt32(&reached); n != 2 {
+		t.Fatalf("Expected only the two !seen messages to reach the handler, got %d", n)
+	}
+	if msg, _ := room.retrieveMsgLogEvent("blank-1"); msg == nil {
+		t.Fatal("Blank message was not logged.")
+	}
+}
+
+func TestEncryptedMessage(t *testing.T) {
+	msg := Message{Content: "!ping", EncryptionKeyID: "key-1"}
+	if !msg.IsEncrypted() || (&Message{Content: "!ping"}).IsEncrypted() {
+		t.Fatal("Incorrect IsEncrypted.")
+	}
+	room, th := NewTestHarness(t)
+	defer room.db.Close()
+	defer room.Stop()
+	go room.Run()
+	th.SendMessage(Message{ID: "enc-1", Content: "!ping", EncryptionKeyID: "key-1",
+		Sender: User{ID: "agent:test", Name: "test"}, Time: 100})
+	th.AssertNoPacket()
+	if msg, _ := room.retrieveMsgLogEvent("enc-1"); msg == nil || msg.EncryptionKeyID != "key-1" {
+		t.Fatalf("Encrypted message was not logged: %+v", msg)
+	}
+	th.SendSendEvent("!ping", "", "test")
+	th.AssertReceivedSendText("pong!")
+}
+
+func TestResolveNick(t *testing.T) {
+	room, th := NewTestHarness(t)
+	defer room.db.Close()
+	defer room.Stop()
+	for _, nick := range []string{"bartholomew", "bartholomaw"} {
+		if err := room.StoreSeen(nick, time.Now().Add(-3*time.Hour)); err != nil {
+			t.Fatalf("Could not store seen: %s", err)
+		}
+	}
+	go room.Run()
+	th.SendSnapshotEvent(SnapshotEvent{SessionID: "self", Listing: []PresenceEvent{
+		{User: &User{ID: "agent:lisa", Name: "Lisa Simpson123"}, SessionID: "s1"}}})
+	WaitFor(t, func() bool { return len(room.Users()) == 1 })
+	for nick, want := range map[string]string{
+		"bartholomew":    "bartholomew",
+		"bartholmew":     "bartholomew",
+		"bartholomow":    "bartholomaw bartholomew",
+		"lisasimpson123": "LisaSimpson123",
+		"bartholomewxyz": "",
+		"xqzv":           "",
+	} {
+		matches, err := room.ResolveNick(nick)
+		if err != nil {
+			t.Fatalf("ResolveNick failed: %s", err)
+		}
+		if got := strings.Join(matches, " "); got != want {
+			t.Errorf("ResolveNick(%q) = %q, want %q", nick, got, want)
+		}
+	}
+	th.SendSendEvent("!seen @bartholmew", "", "test")
+	th.AssertReceivedSendText("Assuming you meant @bartholomew: seen 3 hours ago.")
+	th.SendSendEvent("!seen @bartholomow", "", "test")
+	th.AssertReceivedSendText("Did you mean @bartholomaw or @bartholomew?")
+	th.SendSendEvent("!seen @xqzv", "", "test")
+	th.AssertReceivedSendText("User has not been seen yet.")
+}
+
 func TestUptimeCommand(t *testing.T) {
 	room, th := NewTestHarness(t)
 	defer room.db.Close()
@@ -346,6 +621,80 @@ func TestNickChange(t *testing.T) {
 	defer room.Stop()
 }
 
+func TestClassifyNickEvent(t *testing.T) {
+	cases := []struct {
+		from, to string
+		kind     nickChange
+	}{
+		{"", "test1", nickJoin},
+		{"test1", "", nickPart},
+		{"test1", "test2", nickRename},
+		{"test1", "test1", nickInvalid},
+		{"", "", nickInvalid},
+	}
+	for _, c := range cases {
+		if kind := classifyNickEvent(&NickEvent{From: c.from, To: c.to}); kind != c.kind {
+			t.Fatalf("Incorrect classification of '%s' -> '%s'. Expected %d, got %d", c.from, c.to, c.kind, kind)
+		}
+	}
+}
+
+func TestNickEventAnnouncements(t *testing.T) {
+	room, th := NewTestHarness(t)
+	defer room.db.Close()
+	defer room.Stop()
+	go room.Run()
+	th.SendNickEvent("", "nickjoin")
+	th.AssertReceivedSendText("< nickjoin joined the room. >")
+	th.AssertNoPacket()
+	th.SendNickEvent("nickfrom", "nickto")
+	th.AssertReceivedSendText("< nickfrom is now known as nickto. >")
+	th.AssertNoPacket()
+	th.SendNickEvent("nickpart", "")
+	th.AssertNoPacket()
+	if !room.isUserLeaving("nickpart") {
+		t.Fatal("Part via nick-event did not mark user as leaving.")
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	roomCfg := NewTestRoomConfig()
+	roomCfg.Templates = map[string]string{
+		"join": "* {{.User}} arrived *",
+		"nick": "{{.Broken",
+	}
+	room, th := NewTestHarnessWithConfig(t, roomCfg)
+	defer room.db.Close()
+	defer room.Stop()
+	go room.Run()
+	th.SendPresenceEvent("join-event", "tmpl")
+	th.AssertReceivedSendText("* tmpl arrived *")
+	th.SendNickEvent("tmpl", "tmpl2")
+	th.AssertReceivedSendText("< tmpl is now known as tmpl2. >")
+	th.SendSendEvent("!seen @nobodyatall", "", "test")
+	th.AssertReceivedSendText("User has not been seen yet.")
+}
+
+func TestLocale(t *testing.T) {
+	RegisterLocale("fr", map[string]string{
+		"join": "< {{.User}} a rejoint la salle. >",
+	})
+	room, th := NewTestHarness(t)
+	defer room.db.Close()
+	defer room.Stop()
+	go room.Run()
+	if err := room.SetLocale("xx"); err == nil {
+		t.Fatal("Expected error setting unregistered locale.")
+	}
+	if err := room.SetLocale("fr"); err != nil {
+		t.Fatalf("Could not set locale: %s", err)
+	}
+	th.SendPresenceEvent("join-event", "locale")
+	th.AssertReceivedSendText("< locale a rejoint la salle. >")
+	th.SendSendEvent("!seen @nobodyatall", "", "test")
+	th.AssertReceivedSendText("User has not been seen yet.")
+}
+
 func TestJoin(t *testing.T) {
 	room, th := NewTestHarness(t)
 	defer room.db.Close()
@@ -358,10 +707,9 @@ func TestJoin(t *testing.T) {
 }
 
 func TestPart(t *testing.T) {
-	if testing.Short() {
-		t.Skip("skipping test in short mode.")
-	}
-	room, th := NewTestHarness(t)
+	roomCfg := NewTestRoomConfig()
+	roomCfg.PartGrace = time.Duration(50) * time.Millisecond
+	room, th := NewTestHarnessWithConfig(t, roomCfg)
 	defer room.db.Close()
 	defer room.Stop()
 	go room.Run()
@@ -371,7 +719,7 @@ func TestPart(t *testing.T) {
 		if msg.Type != SendType {
 			t.Fatalf("Incorrect packet type. Expected 'send', got '%s'.", msg.Type)
 		}
-	case <-time.After(time.Duration(65) * time.Second):
+	case <-time.After(time.Duration(2) * time.Second):
 		t.Fatal("Timeout: expecting send packet.")
 	}
 }
@@ -402,3 +750,3267 @@ func TestSendAuth(t *testing.T) {
 	room.SendAuth()
 	th.AssertReceivedAuth()
 }
+
+func NewTitleServer(titles map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		title, ok := titles[req.URL.Path]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		fmt.Fprintf(w, "<html><head><title>%s</title></head><body></body></html>", title)
+	}))
+}
+
+func TestIgnoredTitles(t *testing.T) {
+	server := NewTitleServer(map[string]string{
+		"/real":        "Real Title",
+		"/boilerplate": "Nothing To See Here",
+		"/imgur":       "Imgur",
+	})
+	defer server.Close()
+	roomCfg := NewTestRoomConfig()
+	roomCfg.IgnoredTitles = append(DefaultIgnoredTitles, "nothing to see here")
+	room, th := NewTestHarnessWithConfig(t, roomCfg)
+	defer room.db.Close()
+	defer room.Stop()
+	go room.Run()
+	th.SendSendEvent(server.URL+"/real", "", "test")
+	th.AssertReceivedSendText("Link title: Real Title")
+	th.SendSendEvent(server.URL+"/boilerplate", "", "test")
+	th.AssertNoPacket()
+	th.SendSendEvent(server.URL+"/imgur", "", "test")
+	th.AssertNoPacket()
+}
+
+func TestMaxTitlesPerMessage(t *testing.T) {
+	server := NewTitleServer(map[string]string{
+		"/a": "Title A",
+		"/b": "Title B",
+		"/c": "Title C",
+	})
+	defer server.Close()
+	roomCfg := NewTestRoomConfig()
+	roomCfg.MaxTitlesPerMessage = 2
+	room, th := NewTestHarnessWithConfig(t, roomCfg)
+	defer room.db.Close()
+	defer room.Stop()
+	go room.Run()
+	th.SendSendEvent(fmt.Sprintf("%[1]s/a %[1]s/a %[1]s/b %[1]s/c", server.URL), "", "test")
+	th.AssertReceivedSendText("Link title: Title A")
+	th.AssertReceivedSendText("Link title: Title B")
+	th.AssertNoPacket()
+}
+
+func TestBlockedDomains(t *testing.T) {
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		fmt.Fprint(w, "<html><head><title>Blocked</title></head></html>")
+	}))
+	defer server.Close()
+	roomCfg := NewTestRoomConfig()
+	roomCfg.BlockedDomains = []string{"example.com", "127.0.0.1"}
+	room, th := NewTestHarnessWithConfig(t, roomCfg)
+	defer room.db.Close()
+	for url, blocked := range map[string]bool{
+		"http://example.com/a":        true,
+		"http://sub.example.com/a":    true,
+		"https://SUB.Example.com:443": true,
+		"http://notexample.com/a":     false,
+		"http://example.com.evil.org": false,
+	} {
+		if room.isBlockedDomain(url) != blocked {
+			t.Fatalf("Incorrect blocklist result for %s. Expected %v", url, blocked)
+		}
+	}
+	defer room.Stop()
+	go room.Run()
+	th.SendSendEvent(server.URL+"/page", "", "test")
+	th.AssertNoPacket()
+	if n := atomic.LoadInt32(&hits); n != 0 {
+		t.Fatalf("Blocked link was fetched %d times.", n)
+	}
+}
+
+type FakeDictionary map[string]string
+
+func (d FakeDictionary) Define(word string) (string, error) {
+	if word == "broken" {
+		return "", errors.New("dictionary offline")
+	}
+	return d[word], nil
+}
+
+func TestDefineCommand(t *testing.T) {
+	roomCfg := NewTestRoomConfig()
+	roomCfg.Dictionary = FakeDictionary{
+		"bot":  "A program that chats.",
+		"long": strings.Repeat("a", 1000),
+	}
+	room, th := NewTestHarnessWithConfig(t, roomCfg)
+	defer room.db.Close()
+	defer room.Stop()
+	go room.Run()
+	th.SendSendEvent("!define bot", "", "test")
+	th.AssertReceivedSendText("bot: A program that chats.")
+	th.SendSendEvent("!define xyzzy", "", "test")
+	th.AssertReceivedSendText("No definition found for xyzzy.")
+	th.SendSendEvent("!define broken", "", "test")
+	th.AssertReceivedSendText("Sorry, the dictionary is unavailable right now.")
+	th.SendSendEvent("!define", "", "test")
+	th.AssertReceivedSendText("Usage: !define <word>")
+	th.SendSendEvent("!define long", "", "test")
+	th.AssertReceivedSendText("long: " + strings.Repeat("a", maxDefinitionLength-3) + "...")
+}
+
+func TestParseReminder(t *testing.T) {
+	now := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+	cases := []struct {
+		content string
+		due     time.Time
+		text    string
+	}{
+		{"!remind me in 10m to stretch", now.Add(10 * time.Minute), "stretch"},
+		{"!remind me at 13:30 to eat lunch", time.Date(2015, 6, 1, 13, 30, 0, 0, time.UTC), "eat lunch"},
+		{"!remind me at 11:00 to wake up", time.Date(2015, 6, 2, 11, 0, 0, 0, time.UTC), "wake up"},
+		{"!remind me at 2015-07-04 09:00 to celebrate", time.Date(2015, 7, 4, 9, 0, 0, 0, time.UTC), "celebrate"},
+	}
+	for _, c := range cases {
+		reminder, err := parseReminder(c.content, now)
+		if err != nil {
+			t.Fatalf("Could not parse '%s': %s", c.content, err)
+		}
+		if !time.Unix(0, reminder.Due).Equal(c.due) {
+			t.Fatalf("Incorrect due time for '%s'. Expected %s, got %s", c.content, c.due, time.Unix(0, reminder.Due))
+		}
+		if reminder.Text != c.text {
+			t.Fatalf("Incorrect text for '%s'. Expected '%s', got '%s'", c.content, c.text, reminder.Text)
+		}
+	}
+	for _, content := range []string{"!remind me in soon to x", "!remind me in 10m", "!remind you in 10m to x", "!remind me in -5m to x"} {
+		if _, err := parseReminder(content, now); err == nil {
+			t.Fatalf("Expected error parsing '%s'.", content)
+		}
+	}
+}
+
+func TestRemindCommand(t *testing.T) {
+	room, th := NewTestHarness(t)
+	defer room.db.Close()
+	defer room.Stop()
+	go room.Run()
+	th.SendSendEvent("!remind me in 10 minutes to x", "", "test")
+	th.AssertReceivedSendText(remindUsage)
+	th.SendSendEvent("!remind me in 100ms to check the oven", "", "test user")
+	th.AssertReceivedSendPrefix("Reminder set for")
+	th.AssertReceivedSendText("@testuser reminder: check the oven")
+	// Commands that merely start with !remind are not reminders.
+	th.SendSendEvent("!reminders", "", "test")
+	th.SendSendEvent("!remindme in 1m to x", "", "test")
+	th.AssertNoPacket()
+}
+
+func TestRemindersRescheduled(t *testing.T) {
+	room, th := NewTestHarness(t)
+	defer room.db.Close()
+	defer room.Stop()
+	_, err := room.storeReminder(&Reminder{
+		User: "test",
+		Due:  time.Now().Add(-time.Minute).UnixNano(),
+		Text: "this was persisted"})
+	if err != nil {
+		t.Fatalf("Could not store reminder: %s", err)
+	}
+	go room.Run()
+	th.AssertReceivedSendText("@test reminder: this was persisted")
+}
+
+func TestUsers(t *testing.T) {
+	roomCfg := NewTestRoomConfig()
+	roomCfg.Join = false
+	room, th := NewTestHarnessWithConfig(t, roomCfg)
+	defer room.db.Close()
+	defer room.Stop()
+	go room.Run()
+	th.SendSnapshotEvent(SnapshotEvent{Listing: []PresenceEvent{
+		{User: &User{ID: "agent:1", Name: "alice"}, SessionID: "1"},
+		{User: &User{ID: "agent:2", Name: "bob"}, SessionID: "2"},
+	}})
+	WaitFor(t, func() bool { return userNames(room.Users()) == "alice,bob" })
+	th.SendSessionEvent(JoinEventType, "carol", "3")
+	WaitFor(t, func() bool { return userNames(room.Users()) == "alice,bob,carol" })
+	payload, _ := json.Marshal(NickEvent{SessionID: "1", ID: "agent:1", From: "alice", To: "dave"})
+	*th.inbound <- &PacketEvent{Type: NickEventType, Data: payload}
+	WaitFor(t, func() bool { return userNames(room.Users()) == "bob,carol,dave" })
+	th.SendSessionEvent(PartEventType, "bob", "2")
+	WaitFor(t, func() bool { return userNames(room.Users()) == "carol,dave" })
+}
+
+func EchoCommandHandler(room *Room, input chan PacketEvent, cmdChan chan string) {
+	for {
+		select {
+		case packet := <-input:
+			if packet.Type != SendEventType {
+				continue
+			}
+			data := GetMessagePayload(&packet)
+			if data.Content == "!echo" {
+				room.SendText("echo", data.ID)
+			}
+		case cmd := <-cmdChan:
+			if cmd == "kill" {
+				return
+			}
+		}
+	}
+}
+
+func TestAddRemoveHandler(t *testing.T) {
+	room, th := NewTestHarness(t)
+	defer room.db.Close()
+	defer room.Stop()
+	go room.Run()
+	th.SendSendEvent("!echo", "", "test")
+	th.AssertNoPacket()
+	if err := room.AddHandler("echo", EchoCommandHandler); err != nil {
+		t.Fatalf("Could not add handler: %s", err)
+	}
+	if err := room.AddHandler("echo", EchoCommandHandler); err == nil {
+		t.Fatal("Expected error adding duplicate handler.")
+	}
+	th.SendSendEvent("!echo", "", "test")
+	th.AssertReceivedSendText("echo")
+	if err := room.RemoveHandler("echo"); err != nil {
+		t.Fatalf("Could not remove handler: %s", err)
+	}
+	if err := room.RemoveHandler("echo"); err == nil {
+		t.Fatal("Expected error removing unregistered handler.")
+	}
+	th.SendSendEvent("!echo", "", "test")
+	th.AssertNoPacket()
+}
+
+func TestAdminOnly(t *testing.T) {
+	room, th := NewTestHarness(t)
+	defer room.db.Close()
+	defer room.Stop()
+	go room.Run()
+	room.AddHandler("echo", WithAdminOnly(EchoCommandHandler, []string{"agent:admin"}, "!echo"))
+	th.SendSendEventFrom("!echo", "", User{ID: "agent:admin", Name: "admin"})
+	th.AssertReceivedSendText("echo")
+	th.SendSendEventFrom("!echo", "", User{ID: "agent:other", Name: "admin"})
+	th.AssertReceivedSendText("You are not authorized to do that.")
+	th.AssertNoPacket()
+	th.SendSendEventFrom("hello", "", User{ID: "agent:other", Name: "other"})
+	th.AssertNoPacket()
+}
+
+func TestShutdownCommand(t *testing.T) {
+	roomCfg := NewTestRoomConfig()
+	roomCfg.Admins = []string{"agent:admin"}
+	room, th := NewTestHarnessWithConfig(t, roomCfg)
+	defer room.db.Close()
+	stopped := make(chan empty)
+	go func() {
+		room.Run()
+		close(stopped)
+	}()
+	th.SendSendEventFrom("!shutdown", "", User{ID: "agent:other", Name: "other"})
+	th.AssertReceivedSendText("You are not authorized to do that.")
+	th.SendSendEventFrom("!shutdown", "", User{ID: "agent:admin", Name: "admin"})
+	th.AssertReceivedSendText("Goodbye!")
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Timeout: room did not shut down.")
+	}
+	room.wg.Wait()
+}
+
+func TestSysStatsCommand(t *testing.T) {
+	roomCfg := NewTestRoomConfig()
+	roomCfg.Admins = []string{"agent:admin"}
+	roomCfg.Handlers = []string{"sysstats"}
+	room, th := NewTestHarnessWithConfig(t, roomCfg)
+	defer room.db.Close()
+	defer room.Stop()
+	go room.Run()
+	th.SendSendEventFrom("!sysstats", "", User{ID: "agent:other", Name: "other"})
+	th.AssertReceivedSendText("You are not authorized to do that.")
+	th.SendSendEventFrom("!sysstats", "", User{ID: "agent:admin", Name: "admin"})
+	report := th.ReceiveSendText()
+	re := regexp.MustCompile(`^Up \d+s: \d+ goroutines, \d+\.\d [KMG]iB heap, 1 handlers, 2 packets processed\.$`)
+	if !re.MatchString(report) {
+		t.Fatalf("Malformed report: %s", report)
+	}
+	for n, want := range map[uint64]string{0: "0 B", 1023: "1023 B", 1536: "1.5 KiB", 5 << 30: "5.0 GiB"} {
+		if got := formatBytes(n); got != want {
+			t.Errorf("formatBytes(%d) = %s, want %s", n, got, want)
+		}
+	}
+}
+
+func TestIgnoreCommand(t *testing.T) {
+	roomCfg := NewTestRoomConfig()
+	roomCfg.Admins = []string{"agent:admin"}
+	roomCfg.Handlers = []string{"ignore", "ping"}
+	room, th := NewTestHarnessWithConfig(t, roomCfg)
+	defer room.db.Close()
+	defer room.Stop()
+	go room.Run()
+	admin := User{ID: "agent:admin", Name: "admin"}
+	spammer := User{ID: "agent:spammer", Name: "spam bot"}
+	self := User{ID: "bot:self", Name: "MaiMai"}
+	payload, _ := json.Marshal(HelloEvent{ID: self.ID, Session: SessionView{User: self, SessionID: "self"}})
+	*th.inbound <- &PacketEvent{Type: HelloEventType, Data: payload}
+	th.SendSnapshotEvent(SnapshotEvent{SessionID: "self", Listing: []PresenceEvent{
+		{User: &spammer, SessionID: "s1"}, {User: &admin, SessionID: "s2"},
+		{User: &self, SessionID: "s3"}}})
+	th.SendSendEventFrom("!ignore @nobody", "", admin)
+	th.AssertReceivedSendText("@nobody is not here.")
+	th.SendSendEventFrom("!ignore @admin", "", admin)
+	th.AssertReceivedSendText("admin can't be ignored.")
+	th.SendSendEventFrom("!ignore @MaiMai", "", admin)
+	th.AssertReceivedSendText("MaiMai can't be ignored.")
+	if room.IsIgnored("agent:admin") || room.IsIgnored("bot:self") {
+		t.Fatal("An admin or the bot was ignored.")
+	}
+	th.SendSendEventFrom("!ignore @SpamBot", "", admin)
+	th.AssertReceivedSendText("Ignoring spam bot.")
+	if !room.IsIgnored("agent:spammer") {
+		t.Fatal("User was not ignored.")
+	}
+	th.SendSendEventFrom("!ping", "", spammer)
+	th.AssertNoPacket()
+	// Ignoring is by ID, so another user taking the nick is heard.
+	th.SendSendEventFrom("!ping", "", User{ID: "agent:other", Name: "spam bot"})
+	th.AssertReceivedSendText("pong!")
+	// Once they have left, they are unignored by the nick they were ignored
+	// under, or by their user ID.
+	th.SendSnapshotEvent(SnapshotEvent{SessionID: "self", Listing: []PresenceEvent{
+		{User: &admin, SessionID: "s2"}}})
+	th.SendSendEventFrom("!unignore @spambot", "", admin)
+	th.AssertReceivedSendText("No longer ignoring spam bot.")
+	th.SendSendEventFrom("!ping", "", spammer)
+	th.AssertReceivedSendText("pong!")
+	room.Ignore("agent:spammer")
+	th.SendSendEventFrom("!unignore agent:spammer", "", admin)
+	th.AssertReceivedSendText("No longer ignoring agent:spammer.")
+	if room.IsIgnored("agent:spammer") {
+		t.Fatal("User was not unignored by ID.")
+	}
+}
+
+func TestMaxConcurrentFetches(t *testing.T) {
+	var active, peak int32
+	release := make(chan empty)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		n := atomic.AddInt32(&active, 1)
+		defer atomic.AddInt32(&active, -1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		<-release
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<html><head><title>slow</title></head></html>"))
+	}))
+	defer server.Close()
+	roomCfg := NewTestRoomConfig()
+	roomCfg.MaxConcurrentFetches = 2
+	roomCfg.Handlers = []string{"link-title"}
+	room, th := NewTestHarnessWithConfig(t, roomCfg)
+	defer room.db.Close()
+	defer room.Stop()
+	go room.Run()
+	const fetches = 5
+	for i := 0; i < fetches; i++ {
+		th.SendSendEvent(fmt.Sprintf("%s/%d", server.URL, i), "", "test")
+	}
+	// The handler fetches in the background, so more than one fetch is in
+	// progress, but no more than MaxConcurrentFetches.
+	WaitFor(t, func() bool { return atomic.LoadInt32(&active) == 2 })
+	time.Sleep(time.Duration(100) * time.Millisecond)
+	if n := atomic.LoadInt32(&active); n != 2 {
+		t.Fatalf("Expected 2 fetches in progress, got %d", n)
+	}
+	close(release)
+	for i := 0; i < fetches; i++ {
+		th.AssertReceivedSendText("Link title: slow")
+	}
+	if p := atomic.LoadInt32(&peak); p != 2 {
+		t.Fatalf("Expected at most 2 concurrent fetches, saw %d", p)
+	}
+}
+
+func TestLinkTitleFetchers(t *testing.T) {
+	var hits int32
+	release := make(chan empty)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		if req.URL.Path == "/hang" {
+			<-req.Context().Done()
+			return
+		}
+		<-release
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<html><head><title>same</title></head></html>"))
+	}))
+	defer server.Close()
+	roomCfg := NewTestRoomConfig()
+	roomCfg.Handlers = []string{"link-title"}
+	room, th := NewTestHarnessWithConfig(t, roomCfg)
+	defer room.db.Close()
+	go room.Run()
+	// A link already being fetched is not fetched again.
+	th.SendSendEvent(server.URL+"/same", "", "test")
+	th.SendSendEvent(server.URL+"/same", "", "test")
+	WaitFor(t, func() bool { return atomic.LoadInt32(&hits) == 1 })
+	time.Sleep(time.Duration(100) * time.Millisecond)
+	close(release)
+	th.AssertReceivedSendText("Link title: same")
+	th.AssertNoPacket()
+	if n := atomic.LoadInt32(&hits); n != 1 {
+		t.Fatalf("Expected one fetch, got %d", n)
+	}
+	// Stopping abandons fetches in progress, and nothing is posted after.
+	th.SendSendEvent(server.URL+"/hang", "", "test")
+	WaitFor(t, func() bool { return atomic.LoadInt32(&hits) == 2 })
+	start := time.Now()
+	room.Stop()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Stop waited %s for the fetch", elapsed)
+	}
+	th.AssertNoPacket()
+}
+
+func TestLinkTitleTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, "<html><head>")
+		for {
+			select {
+			case <-req.Context().Done():
+				return
+			case <-time.After(time.Duration(20) * time.Millisecond):
+			}
+			if _, err := fmt.Fprint(w, " "); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer server.Close()
+	roomCfg := NewTestRoomConfig()
+	roomCfg.LinkTitleTimeout = time.Duration(200) * time.Millisecond
+	room, _ := NewTestHarnessWithConfig(t, roomCfg)
+	defer room.db.Close()
+	start := time.Now()
+	if _, err := room.getLinkTitle(context.Background(), server.URL); err == nil {
+		t.Fatal("Expected the slow fetch to be abandoned.")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Fetch took %s, well past its deadline", elapsed)
+	}
+}
+
+func TestWithPermission(t *testing.T) {
+	roomCfg := NewTestRoomConfig()
+	roomCfg.Handlers = []string{}
+	roomCfg.Admins = []string{"agent:admin"}
+	roomCfg.RegularMessages = 3
+	room, th := NewTestHarnessWithConfig(t, roomCfg)
+	defer room.db.Close()
+	defer room.Stop()
+	for _, level := range []Permission{PermissionEveryone, PermissionRegular, PermissionManager, PermissionAdmin} {
+		command := "!" + level.String()
+		room.AddHandler(level.String(), WithPermission(level, func(room *Room, input chan PacketEvent, cmdChan chan string) {
+			for {
+				select {
+				case packet := <-input:
+					if packet.Type != SendEventType {
+						continue
+					}
+					data := GetMessagePayload(&packet)
+					if room.commandContent(data.Content) == command {
+						room.SendText("ok "+command, data.ID)
+					}
+				case cmd := <-cmdChan:
+					if cmd == "kill" {
+						return
+					}
+				}
+			}
+		}, command))
+	}
+	go room.Run()
+	newbie := User{ID: "agent:newbie", Name: "newbie"}
+	manager := User{ID: "agent:manager", Name: "manager", IsManager: true}
+	admin := User{ID: "agent:admin", Name: "admin"}
+	th.SendSendEventFrom("!everyone", "", newbie)
+	th.AssertReceivedSendText("ok !everyone")
+	th.SendSendEventFrom("!regular", "", newbie)
+	th.AssertReceivedSendText("Only regulars can do that.")
+	th.SendSendEventFrom("!regular", "", newbie)
+	th.AssertReceivedSendText("ok !regular")
+	th.SendSendEventFrom("!manager", "", newbie)
+	th.AssertReceivedSendText("Only managers can do that.")
+	th.SendSendEventFrom("!manager", "", manager)
+	th.AssertReceivedSendText("ok !manager")
+	th.SendSendEventFrom("!regular", "", manager)
+	th.AssertReceivedSendText("ok !regular")
+	th.SendSendEventFrom("!admin", "", manager)
+	th.AssertReceivedSendText("Only admins can do that.")
+	th.SendSendEventFrom("!admin", "", admin)
+	th.AssertReceivedSendText("ok !admin")
+	// Counting stops at the threshold, and once maxCountedUsers are counted
+	// new users are not.
+	for i := 0; i < 3; i++ {
+		th.SendSendEventFrom("!everyone", "", newbie)
+		th.AssertReceivedSendText("ok !everyone")
+	}
+	room.data.Lock()
+	count := room.data.msgCounts[newbie.ID]
+	for i := len(room.data.msgCounts); i < maxCountedUsers; i++ {
+		room.data.msgCounts[fmt.Sprint("agent:filler", i)] = 1
+	}
+	room.data.Unlock()
+	if count != roomCfg.RegularMessages {
+		t.Fatalf("Expected the count to stop at %d, got %d", roomCfg.RegularMessages, count)
+	}
+	th.SendSendEventFrom("!other", "", User{ID: "agent:new", Name: "new"})
+	th.AssertNoPacket()
+	room.data.Lock()
+	_, counted := room.data.msgCounts["agent:new"]
+	room.data.Unlock()
+	if counted {
+		t.Fatal("A new user was counted past maxCountedUsers.")
+	}
+}
+
+func TestBroadcastCommand(t *testing.T) {
+	roomCfg := NewTestRoomConfig()
+	roomCfg.Admins = []string{"agent:admin"}
+	roomCfg.Handlers = []string{"announce"}
+	room, th := NewTestHarnessWithConfig(t, roomCfg)
+	defer room.db.Close()
+	defer room.Stop()
+	go room.Run()
+	admin := User{ID: "agent:admin", Name: "admin"}
+	th.SendSnapshotEvent(SnapshotEvent{SessionID: "self", Listing: []PresenceEvent{
+		{User: &User{ID: "agent:a", Name: "Ann Marie"}, SessionID: "s1"},
+		{User: &User{ID: "agent:a", Name: "Ann Marie"}, SessionID: "s2"},
+		{User: &User{ID: "agent:b", Name: "bob"}, SessionID: "s3"}}})
+	expectTopLevel := func(text string) {
+		packet := <-*th.outbound
+		var cmd SendCommand
+		json.Unmarshal(packet.Data, &cmd)
+		if cmd.Content != text || cmd.Parent != "" {
+			t.Fatalf("Expected top-level %q, got %+v", text, cmd)
+		}
+	}
+	th.SendSendEventFrom("!announce hi all", "", User{ID: "agent:other", Name: "other"})
+	th.AssertReceivedSendText("You are not authorized to do that.")
+	th.SendSendEventFrom("!announce", "", admin)
+	th.AssertReceivedSendText(announceUsage)
+	th.SendSendEventFrom("!announce @everyone  meeting at noon", "", admin)
+	expectTopLevel("@AnnMarie @bob meeting at noon")
+	th.SendSendEventFrom("!announce again", "", admin)
+	th.AssertReceivedSendText("Please wait 1m0s before announcing again.")
+}
+
+func TestSpamFilter(t *testing.T) {
+	if _, err := NewSpamFilterHandler([]string{"("}, SpamWarn); err == nil {
+		t.Fatal("Expected an error from an invalid spam pattern.")
+	}
+	roomCfg := NewTestRoomConfig()
+	roomCfg.Handlers = []string{"spam-filter"}
+	roomCfg.SpamPatterns = []string{"["}
+	if _, err := NewRoom(roomCfg, "test", NewMockSR("test"), logrus.New()); err == nil || !strings.Contains(err.Error(), "spam pattern") {
+		t.Fatalf("Expected an invalid spam pattern error, got %v", err)
+	}
+	roomCfg.SpamPatterns = []string{`(?i)buy cheap`, `https?://spam\.example`}
+	roomCfg.SpamAction = SpamWarn
+	room, th := NewTestHarnessWithConfig(t, roomCfg)
+	defer room.db.Close()
+	defer room.Stop()
+	go room.Run()
+	th.SendSendEvent("hello there", "", "test")
+	th.AssertNoPacket()
+	th.SendSendEvent("BUY CHEAP watches", "", "test")
+	th.AssertReceivedSendText("test, that message looks like spam.")
+	room.RemoveHandler("spam-filter")
+	handler, err := NewSpamFilterHandler(roomCfg.SpamPatterns, SpamDelete)
+	if err != nil {
+		t.Fatal(err)
+	}
+	room.AddHandler("spam-filter", handler)
+	th.SendMessage(Message{ID: "m1", Content: "see http://spam.example", Sender: User{Name: "test"}})
+	packet := <-*th.outbound
+	if packet.Type != EditMessageType || string(packet.Data) != `{"id":"m1","delete":true,"announce":true}` {
+		t.Fatalf("Unexpected delete packet: %s %s", packet.Type, packet.Data)
+	}
+	*th.inbound <- &PacketEvent{ID: packet.ID, Type: EditMessageReplyType,
+		Data: json.RawMessage(`{"id":"m1","deleted":1445000000}`)}
+	th.AssertNoPacket()
+	th.SendMessage(Message{ID: "m2", Content: "buy cheap pills", Sender: User{Name: "test"}})
+	packet = <-*th.outbound
+	*th.inbound <- &PacketEvent{ID: packet.ID, Type: EditMessageReplyType, Error: "access denied"}
+	th.AssertReceivedSendText("test, that message looks like spam.")
+}
+
+func TestLinkTitleHeaders(t *testing.T) {
+	headers := make(chan http.Header, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		headers <- req.Header
+		fmt.Fprint(w, "<html><head><title>Headers</title></head></html>")
+	}))
+	defer server.Close()
+	roomCfg := NewTestRoomConfig()
+	room, th := NewTestHarnessWithConfig(t, roomCfg)
+	defer room.db.Close()
+	defer room.Stop()
+	go room.Run()
+	th.SendSendEvent(server.URL+"/default", "", "test")
+	th.AssertReceivedSendText("Link title: Headers")
+	header := <-headers
+	if ua := header.Get("User-Agent"); ua != DefaultUserAgent {
+		t.Fatalf("Incorrect User-Agent. Expected '%s', got '%s'", DefaultUserAgent, ua)
+	}
+	if accept := header.Get("Accept"); accept != "text/html" {
+		t.Fatalf("Incorrect Accept header. Expected 'text/html', got '%s'", accept)
+	}
+	roomCfg.UserAgent = "custom-agent/2.0"
+	th.SendSendEvent(server.URL+"/custom", "", "test")
+	th.AssertReceivedSendText("Link title: Headers")
+	if ua := (<-headers).Get("User-Agent"); ua != "custom-agent/2.0" {
+		t.Fatalf("Incorrect User-Agent. Expected 'custom-agent/2.0', got '%s'", ua)
+	}
+}
+
+func TestLinkTitleEncodings(t *testing.T) {
+	page := []byte("<html><head><title>Compressed</title></head></html>")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var buf bytes.Buffer
+		switch req.URL.Path {
+		case "/gzip":
+			w.Header().Set("Content-Encoding", "gzip")
+			zw := gzip.NewWriter(&buf)
+			zw.Write(page)
+			zw.Close()
+		case "/deflate":
+			w.Header().Set("Content-Encoding", "deflate")
+			zw := zlib.NewWriter(&buf)
+			zw.Write(page)
+			zw.Close()
+		case "/rawdeflate":
+			w.Header().Set("Content-Encoding", "deflate")
+			zw, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+			zw.Write(page)
+			zw.Close()
+		case "/unannounced":
+			zw := gzip.NewWriter(&buf)
+			zw.Write(page)
+			zw.Close()
+		}
+		w.Write(buf.Bytes())
+	}))
+	defer server.Close()
+	room, th := NewTestHarness(t)
+	defer room.db.Close()
+	defer room.Stop()
+	go room.Run()
+	for _, path := range []string{"/gzip", "/deflate", "/rawdeflate", "/unannounced"} {
+		th.SendSendEvent(server.URL+path, "", "test")
+		th.AssertReceivedSendText("Link title: Compressed")
+	}
+}
+
+func TestLinkTitleCharset(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/header":
+			w.Header().Set("Content-Type", "text/html; charset=ISO-8859-1")
+			w.Write([]byte("<html><head><title>Caf\xe9 cr\xe8me</title></head></html>"))
+		case "/meta":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<html><head><meta charset=\"iso-8859-1\"><title>Caf\xe9 cr\xe8me</title></head></html>"))
+		}
+	}))
+	defer server.Close()
+	room, th := NewTestHarness(t)
+	defer room.db.Close()
+	defer room.Stop()
+	go room.Run()
+	for _, path := range []string{"/header", "/meta"} {
+		th.SendSendEvent(server.URL+path, "", "test")
+		th.AssertReceivedSendText("Link title: Café crème")
+	}
+}
+
+func TestLastCommand(t *testing.T) {
+	room, th := NewTestHarness(t)
+	defer room.db.Close()
+	defer room.Stop()
+	go room.Run()
+	lastUser := User{ID: "agent:lastuser", Name: "last user"}
+	th.SendMessage(Message{ID: "last-1", Sender: lastUser, Content: "first"})
+	th.SendMessage(Message{ID: "last-2", Sender: User{ID: "agent:other", Name: "other"}, Content: "interjection"})
+	th.SendMessage(Message{ID: "last-3", Sender: lastUser, Content: "second"})
+	lastUser.Name = "renamed"
+	th.SendMessage(Message{ID: "last-4", Sender: lastUser, Content: "third"})
+	WaitFor(t, func() bool {
+		msg, _ := room.retrieveMsgLogEvent("last-4")
+		return msg != nil
+	})
+	th.SendSendEvent("!last @renamed", "", "test")
+	th.AssertReceivedSendText("[renamed] third")
+	th.SendSendEvent("!last @renamed 10", "", "test")
+	th.AssertReceivedSendText("[last user] first\n[last user] second\n[renamed] third")
+	th.SendSendEvent("!last @nobodyatall", "", "test")
+	th.AssertReceivedSendText("No messages found for @nobodyatall.")
+	th.SendSendEvent("!last renamed", "", "test")
+	th.AssertReceivedSendText(lastUsage)
+}
+
+func TestGrepCommand(t *testing.T) {
+	room, th := NewTestHarness(t)
+	defer room.db.Close()
+	defer room.Stop()
+	go room.Run()
+	th.SendMessage(Message{ID: "grep-1", Sender: User{ID: "agent:a", Name: "alice"}, Content: "I saw a Zebra today"})
+	th.SendMessage(Message{ID: "grep-2", Sender: User{ID: "agent:b", Name: "bob"}, Content: "nothing to report"})
+	th.SendMessage(Message{ID: "grep-3", Sender: User{ID: "agent:b", Name: "bob"}, Content: "zebras are striped (mostly"})
+	th.SendMessage(Message{ID: "grep-4", Sender: User{ID: "agent:c", Name: "carol"}, Content: strings.Repeat("zebra ", 100)})
+	WaitFor(t, func() bool {
+		msg, _ := room.retrieveMsgLogEvent("grep-4")
+		return msg != nil
+	})
+	th.SendMessage(Message{ID: "grep-5", Sender: User{ID: "agent:a", Name: "alice"}, Content: "!grep striped (mostly"})
+	th.AssertReceivedSendText("[bob] zebras are striped (mostly")
+	th.SendSendEvent("!grep ZEBRA", "", "test")
+	th.AssertReceivedSendText("[alice] I saw a Zebra today\n[bob] zebras are striped (mostly\n[carol] " +
+		truncate(strings.Repeat("zebra ", 100), maxGrepLineLength))
+	th.SendSendEvent("!grep xylophone-quokka", "", "test")
+	th.AssertReceivedSendText("No matching messages found.")
+	th.SendSendEvent("!grep", "", "test")
+	th.AssertReceivedSendText(grepUsage)
+}
+
+func TestThreadCommand(t *testing.T) {
+	room, th := NewTestHarness(t)
+	defer room.db.Close()
+	defer room.Stop()
+	// thread-a <- thread-b <- thread-c
+	room.storeMsgLogEvent("thread-a", &MsgLogEvent{UserName: "alice", Content: "shall we?"})
+	room.storeMsgLogEvent("thread-b", &MsgLogEvent{Parent: "thread-a", UserName: "bob", Content: "we shall"})
+	room.storeMsgLogEvent("thread-c", &MsgLogEvent{Parent: "thread-b", UserName: "alice", Content: "great\nlet's go"})
+	for i := 0; i < 12; i++ {
+		parent := ""
+		if i > 0 {
+			parent = fmt.Sprintf("deep-%d", i-1)
+		}
+		room.storeMsgLogEvent(fmt.Sprintf("deep-%d", i), &MsgLogEvent{Parent: parent, UserName: "carol", Content: fmt.Sprint(i)})
+		room.storeMsgLogEvent(fmt.Sprintf("long-%d", i), &MsgLogEvent{Parent: strings.Replace(parent, "deep", "long", 1),
+			UserName: "dave", Content: strings.Repeat("x", maxGrepLineLength)})
+	}
+	go room.Run()
+	th.SendSendEvent("!thread", "thread-c", "test")
+	th.AssertReceivedSendText("[alice] shall we?\n[bob] we shall\n[alice] great\nlet's go")
+	th.SendSendEvent("!thread", "deep-11", "test")
+	th.AssertReceivedSendText("(earlier messages omitted)\n[carol] 2\n[carol] 3\n[carol] 4\n[carol] 5\n" +
+		"[carol] 6\n[carol] 7\n[carol] 8\n[carol] 9\n[carol] 10\n[carol] 11")
+	th.SendSendEvent("!thread", "long-11", "test")
+	if summary := th.ReceiveSendText(); len(summary) > maxThreadLength ||
+		!strings.HasPrefix(summary, "(earlier messages omitted)\n[dave] xxx") {
+		t.Fatalf("Incorrect capped summary (%d bytes): %q", len(summary), summary)
+	}
+	th.SendSendEvent("!thread", "", "test")
+	th.AssertReceivedSendText(threadUsage)
+	th.SendSendEvent("!thread", "thread-missing", "test")
+	th.AssertReceivedSendText("That thread is not in the message log.")
+}
+
+func TestQuoteCommand(t *testing.T) {
+	roomCfg := NewTestRoomConfig()
+	roomCfg.RandSource = rand.NewSource(1)
+	room, th := NewTestHarnessWithConfig(t, roomCfg)
+	room.name = fmt.Sprintf("quotetest-%d", time.Now().UnixNano())
+	defer room.db.Close()
+	defer room.Stop()
+	go room.Run()
+	th.SendSendEvent("!quote", "", "test")
+	th.AssertReceivedSendText("No quotes have been recorded yet.")
+	th.SendSendEvent("!quote add   to be or not to be", "", "test")
+	th.AssertReceivedSendText("Quote #1 added.")
+	th.SendSendEvent("!quote add that is the question", "", "test")
+	th.AssertReceivedSendText("Quote #2 added.")
+	th.SendSendEvent("!quote 1", "", "test")
+	th.AssertReceivedSendText("#1: to be or not to be")
+	th.SendSendEvent("!quote #2", "", "test")
+	th.AssertReceivedSendText("#2: that is the question")
+	th.SendSendEvent("!quote 3", "", "test")
+	th.AssertReceivedSendText("There is no quote #3.")
+	th.SendSendEvent("!quote add", "", "test")
+	th.AssertReceivedSendText(quoteUsage)
+	random := regexp.MustCompile("^#(1: to be or not to be|2: that is the question)$")
+	for i := 0; i < 5; i++ {
+		th.SendSendEvent("!quote", "", "test")
+		if text := th.ReceiveSendText(); !random.MatchString(text) {
+			t.Fatalf("Unexpected random quote: '%s'", text)
+		}
+	}
+}
+
+func TestRawSend(t *testing.T) {
+	room, th := NewTestHarness(t)
+	defer room.db.Close()
+	defer room.Stop()
+	go room.Run()
+	id, err := room.RawSend("who", struct{}{})
+	if err != nil {
+		t.Fatalf("Could not send: %s", err)
+	}
+	packet := <-*th.outbound
+	if packet.Type != "who" || packet.ID != id || string(packet.Data) != "{}" {
+		t.Fatalf("Unexpected packet: %+v", packet)
+	}
+	type reply struct {
+		data json.RawMessage
+		err  error
+	}
+	replies := make(chan reply)
+	for _, errText := range []string{"", "not allowed"} {
+		go func() {
+			data, err := room.RawSendAndWait("who", struct{}{})
+			replies <- reply{data, err}
+		}()
+		packet = <-*th.outbound
+		*th.inbound <- &PacketEvent{ID: packet.ID, Type: "who-reply",
+			Data: json.RawMessage(`{"listing":[]}`), Error: errText}
+		r := <-replies
+		if string(r.data) != `{"listing":[]}` {
+			t.Fatalf("Incorrect reply data: %s", r.data)
+		}
+		if (errText == "") != (r.err == nil) {
+			t.Fatalf("Incorrect reply error for '%s': %v", errText, r.err)
+		}
+	}
+}
+
+func TestUnknownPackets(t *testing.T) {
+	room, th := NewTestHarness(t)
+	defer room.db.Close()
+	defer room.Stop()
+	go room.Run()
+	*th.inbound <- &PacketEvent{ID: "1", Type: "future-event", Data: json.RawMessage(`{"x":1}`)}
+	*th.inbound <- &PacketEvent{Type: BounceEventType, Data: json.RawMessage(`{"reason":5}`)}
+	th.SendPingEvent()
+	for _, expected := range []PacketType{"future-event", BounceEventType} {
+		select {
+		case packet := <-room.UnknownPackets():
+			if packet.Type != expected {
+				t.Fatalf("Incorrect unknown packet type. Expected '%s', got '%s'", expected, packet.Type)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timeout: expecting unknown packet of type %s.", expected)
+		}
+	}
+	<-*th.outbound
+	select {
+	case packet := <-room.UnknownPackets():
+		t.Fatalf("Unexpected unknown packet of type %s.", packet.Type)
+	case <-time.After(time.Duration(100) * time.Millisecond):
+	}
+}
+
+func TestMessageLogEdits(t *testing.T) {
+	room, th := NewTestHarness(t)
+	defer room.db.Close()
+	defer room.Stop()
+	go room.Run()
+	sender := User{ID: "agent:editor", Name: "editor"}
+	th.SendMessage(Message{ID: "edit-1", Sender: sender, Time: 100, Content: "helo"})
+	WaitFor(t, func() bool {
+		msg, _ := room.retrieveMsgLogEvent("edit-1")
+		return msg != nil
+	})
+	sendEdit := func(edit EditMessageEvent) {
+		payload, _ := json.Marshal(edit)
+		*th.inbound <- &PacketEvent{Type: EditMessageEventType, Data: payload}
+	}
+	sendEdit(EditMessageEvent{EditID: "e1", Message: Message{ID: "edit-1", Sender: sender,
+		Time: 100, Content: "hello", Edited: 150}})
+	WaitFor(t, func() bool {
+		msg, _ := room.retrieveMsgLogEvent("edit-1")
+		return msg.Content == "hello" && msg.Edited == 150 && msg.Time == 100
+	})
+	sendEdit(EditMessageEvent{EditID: "e2", Message: Message{ID: "edit-1", Sender: sender,
+		Time: 100, Content: "hello", Deleted: 200}})
+	WaitFor(t, func() bool {
+		msg, _ := room.retrieveMsgLogEvent("edit-1")
+		return msg.Deleted == 200
+	})
+}
+
+func TestSetNickRetry(t *testing.T) {
+	room, th := NewTestHarness(t)
+	defer room.db.Close()
+	defer room.Stop()
+	go room.Run()
+	chosen := make(chan string)
+	go func() {
+		nick, err := room.SetNick("MaiMai")
+		if err != nil {
+			t.Errorf("Could not set nick: %s", err)
+		}
+		chosen <- nick
+	}()
+	for _, expected := range []string{"MaiMai", "MaiMai2"} {
+		packet := <-*th.outbound
+		if packet.Type != NickType {
+			t.Fatalf("Incorrect packet type. Expected 'nick', got '%s'", packet.Type)
+		}
+		var cmd NickCommand
+		json.Unmarshal(packet.Data, &cmd)
+		if cmd.Name != expected {
+			t.Fatalf("Incorrect nick. Expected '%s', got '%s'", expected, cmd.Name)
+		}
+		if expected == "MaiMai" {
+			*th.inbound <- &PacketEvent{ID: packet.ID, Type: NickReplyType, Error: "nick in use"}
+			continue
+		}
+		payload, _ := json.Marshal(NickReply{From: "", To: cmd.Name})
+		*th.inbound <- &PacketEvent{ID: packet.ID, Type: NickReplyType, Data: payload}
+	}
+	if nick := <-chosen; nick != "MaiMai2" {
+		t.Fatalf("Incorrect chosen nick. Expected 'MaiMai2', got '%s'", nick)
+	}
+	// With negative NickRetries the nick is tried once, without retries.
+	room.config.NickRetries = -1
+	errs := make(chan error)
+	go func() {
+		_, err := room.SetNick("MaiMai")
+		errs <- err
+	}()
+	packet := <-*th.outbound
+	if packet.Type != NickType {
+		t.Fatalf("Incorrect packet type. Expected 'nick', got '%s'", packet.Type)
+	}
+	*th.inbound <- &PacketEvent{ID: packet.ID, Type: NickReplyType, Error: "nick in use"}
+	if err := <-errs; err == nil {
+		t.Fatal("Expected an error when the only nick is rejected.")
+	}
+	th.AssertNoPacket()
+}
+
+func TestExportedAccessors(t *testing.T) {
+	room, _ := NewTestHarness(t)
+	defer room.db.Close()
+	if room.Name() != "test" {
+		t.Fatalf("Incorrect room name. Expected 'test', got '%s'", room.Name())
+	}
+	if room.Uptime().After(time.Now()) {
+		t.Fatal("Uptime is in the future.")
+	}
+	seen := time.Unix(time.Now().Unix(), 0)
+	if err := room.StoreSeen("accessor", seen); err != nil {
+		t.Fatalf("Could not store seen: %s", err)
+	}
+	if last, err := room.LastSeen("accessor"); err != nil || !last.Equal(seen) {
+		t.Fatalf("Incorrect last seen. Expected %s, got %s (%v)", seen, last, err)
+	}
+	if last, err := room.LastSeen("neverseenaccessor"); err != nil || !last.IsZero() {
+		t.Fatalf("Expected zero last seen, got %s (%v)", last, err)
+	}
+	expected := errors.New("handler failed")
+	go room.ReportError(expected)
+	if err := <-room.errChan; err != expected {
+		t.Fatalf("Incorrect reported error: %v", err)
+	}
+}
+
+func bouncePacket() PacketEvent {
+	payload, _ := json.Marshal(BounceEvent{Reason: "authentication required", AuthOptions: []string{"passcode"}})
+	return PacketEvent{Type: BounceEventType, Data: payload}
+}
+
+func TestBounceWithoutPassword(t *testing.T) {
+	room, _ := NewTestHarness(t)
+	defer room.db.Close()
+	input := make(chan PacketEvent, 1)
+	go BounceHandler(room, input, make(chan string, 1))
+	input <- bouncePacket()
+	select {
+	case err := <-room.errChan:
+		if err != ErrAuthRequired {
+			t.Fatalf("Incorrect error. Expected ErrAuthRequired, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timeout: expecting ErrAuthRequired.")
+	}
+}
+
+func TestBounceWithPassword(t *testing.T) {
+	room, _ := NewTestHarness(t)
+	defer room.db.Close()
+	room.config.Password = "test"
+	input := make(chan PacketEvent, 1)
+	cmdChan := make(chan string, 1)
+	go BounceHandler(room, input, cmdChan)
+	defer func() { cmdChan <- "kill" }()
+	input <- bouncePacket()
+	packet := <-room.outbound
+	if packet.Type != AuthType {
+		t.Fatalf("Incorrect packet type. Expected 'auth', got '%s'", packet.Type)
+	}
+	payload, _ := json.Marshal(AuthReply{Success: true})
+	input <- PacketEvent{Type: AuthReplyType, Data: payload}
+	input <- bouncePacket()
+	if packet := <-room.outbound; packet.Type != AuthType {
+		t.Fatalf("Incorrect packet type. Expected 'auth', got '%s'", packet.Type)
+	}
+}
+
+func sendPingEvent(input chan PacketEvent, t, next int64) {
+	payload, _ := json.Marshal(PingEvent{Time: t, Next: next})
+	input <- PacketEvent{Type: PingEventType, Data: payload}
+}
+
+func TestPingWatchdog(t *testing.T) {
+	cfg := NewTestRoomConfig()
+	cfg.PingGraceMultiplier = 0.2
+	room, _ := NewTestHarnessWithConfig(t, cfg)
+	defer room.db.Close()
+	mockSR := room.sr.(*MockSenderReceiver)
+	input := make(chan PacketEvent, 1)
+	cmdChan := make(chan string, 1)
+	go PingWatchdogHandler(room, input, cmdChan)
+	defer func() { cmdChan <- "kill" }()
+
+	now := time.Now().Unix()
+	sendPingEvent(input, now, now+30)
+	time.Sleep(time.Duration(300) * time.Millisecond)
+	if n := atomic.LoadInt32(&mockSR.reconnects); n != 0 {
+		t.Fatalf("Reconnected before the next ping was due: %d reconnects.", n)
+	}
+
+	// The next ping was due a second ago and the grace period is 200ms.
+	sendPingEvent(input, now-1, now)
+	WaitFor(t, func() bool { return atomic.LoadInt32(&mockSR.reconnects) == 1 })
+}
+
+func TestPingLatency(t *testing.T) {
+	room, th := NewTestHarness(t)
+	defer room.db.Close()
+	now := time.Now()
+	room.recordPingEvent(&PingEvent{Time: now.Unix() - 2, Next: now.Unix() + 28}, time.Unix(now.Unix(), 0))
+	if latency := room.PingLatency(); latency != time.Duration(2)*time.Second {
+		t.Fatalf("Incorrect latency. Expected 2s, got %s", latency)
+	}
+	room.recordPingEvent(&PingEvent{Time: now.Unix() + 5}, now)
+	if latency := room.PingLatency(); latency != 0 {
+		t.Fatalf("Incorrect latency for skewed clock. Expected 0, got %s", latency)
+	}
+
+	defer room.Stop()
+	go room.Run()
+	errs := make(chan error)
+	go func() { errs <- room.Ping() }()
+	packet := <-*th.outbound
+	if packet.Type != PingType {
+		t.Fatalf("Incorrect packet type. Expected 'ping', got '%s'", packet.Type)
+	}
+	time.Sleep(time.Duration(20) * time.Millisecond)
+	*th.inbound <- &PacketEvent{ID: packet.ID, Type: PingReplyType, Data: packet.Data}
+	if err := <-errs; err != nil {
+		t.Fatalf("Ping failed: %s", err)
+	}
+	if latency := room.PingLatency(); latency < time.Duration(20)*time.Millisecond || latency > time.Second {
+		t.Fatalf("Incorrect round-trip latency: %s", latency)
+	}
+}
+
+func TestMakePacketWireFormat(t *testing.T) {
+	golden := []struct {
+		msgType PacketType
+		payload interface{}
+		wire    string
+	}{
+		{SendType, SendCommand{Content: "hi <&>", Parent: "p1"},
+			`{"id":"1","type":"send","data":{"content":"hi \u003c\u0026\u003e","parent":"p1"}}`},
+		{NickType, NickCommand{Name: "MaiMai"},
+			`{"id":"1","type":"nick","data":{"name":"MaiMai"}}`},
+		{PingReplyType, PingReply{},
+			`{"id":"1","type":"ping-reply","data":{}}`},
+		{"who", nil,
+			`{"id":"1","type":"who","data":null}`},
+	}
+	for _, g := range golden {
+		packet, err := MakePacket("1", g.msgType, g.payload)
+		if err != nil {
+			t.Fatalf("Could not make %s packet: %s", g.msgType, err)
+		}
+		wire, err := json.Marshal(packet)
+		if err != nil {
+			t.Fatalf("Could not marshal %s packet: %s", g.msgType, err)
+		}
+		if string(wire) != g.wire {
+			t.Fatalf("Incorrect wire format. Expected %s, got %s", g.wire, wire)
+		}
+	}
+	if _, err := MakePacket("1", SendType, make(chan int)); err == nil {
+		t.Fatal("Expected an error marshalling an unsupported payload.")
+	}
+}
+
+func TestPayloadError(t *testing.T) {
+	packet := &PacketEvent{ID: "42", Type: SendEventType, Data: json.RawMessage(`{"id":"abc","content":"hi`)}
+	_, err := packet.Payload()
+	if err == nil {
+		t.Fatal("Expected an error for truncated JSON.")
+	}
+	for _, want := range []string{"send-event", "'42'"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("Error does not mention %s: %s", want, err)
+		}
+	}
+}
+
+func TestListingPayloads(t *testing.T) {
+	session := `{"session_id":"a1b2","id":"agent:a1","name":"alice","server_id":"heim.1","server_era":"era1"}`
+	message := `{"id":"m1","parent":"","time":1445000000,"sender":` + session + `,"content":"hi"}`
+	for _, data := range []string{`{"listing":[` + session + `]}`, `[` + session + `]`} {
+		payload, err := (&PacketEvent{Type: WhoReplyType, Data: json.RawMessage(data)}).Payload()
+		reply, ok := payload.(*WhoReply)
+		if err != nil || !ok || len(reply.Listing) != 1 || reply.Listing[0].SessionID != "a1b2" ||
+			reply.Listing[0].Name != "alice" {
+			t.Fatalf("Incorrect who-reply from %s: %+v (%v)", data, payload, err)
+		}
+	}
+	for _, data := range []string{`{"log":[` + message + `],"before":"m2"}`, ` [` + message + `]`} {
+		payload, err := (&PacketEvent{Type: LogReplyType, Data: json.RawMessage(data)}).Payload()
+		reply, ok := payload.(*LogReply)
+		if err != nil || !ok || len(reply.Log) != 1 || reply.Log[0].ID != "m1" || reply.Log[0].Sender.Name != "alice" {
+			t.Fatalf("Incorrect log-reply from %s: %+v (%v)", data, payload, err)
+		}
+	}
+	packet := &PacketEvent{Type: SnapshotEventType, Data: json.RawMessage(`{"identity":"agent:bot","session_id":"self",
+		"version":"v1","listing":[` + session + `],"log":[` + message + `]}`)}
+	snapshot := GetSnapshotEventPayload(packet)
+	if len(snapshot.Listing) != 1 || snapshot.Listing[0].User == nil || snapshot.Listing[0].Name != "alice" ||
+		snapshot.Listing[0].SessionID != "a1b2" || len(snapshot.Log) != 1 || snapshot.Log[0].Content != "hi" {
+		t.Fatalf("Incorrect snapshot-event: %+v", snapshot)
+	}
+	if _, err := (&PacketEvent{Type: WhoReplyType, Data: json.RawMessage(`{"listing":{}}`)}).Payload(); err == nil {
+		t.Fatal("Expected an error for a malformed listing.")
+	}
+}
+
+func TestLoginLogout(t *testing.T) {
+	room, th := NewTestHarness(t)
+	defer room.db.Close()
+	defer room.Stop()
+	go room.Run()
+	errs := make(chan error)
+	for _, reply := range []string{`{"success":false,"reason":"bad password"}`, `{"success":true,"account_id":"a1"}`} {
+		go func() { errs <- room.Login("bot@example.com", "hunter2") }()
+		packet := <-*th.outbound
+		payload, err := packet.Payload()
+		if err != nil {
+			t.Fatalf("Could not extract login payload: %s", err)
+		}
+		cmd := payload.(*LoginCommand)
+		if packet.Type != LoginType || cmd.Namespace != "email" || cmd.ID != "bot@example.com" || cmd.Password != "hunter2" {
+			t.Fatalf("Unexpected login packet: %s %s", packet.Type, packet.Data)
+		}
+		if strings.Contains(fmt.Sprintf("%v", *cmd), "hunter2") {
+			t.Fatal("Password is not redacted when formatted.")
+		}
+		*th.inbound <- &PacketEvent{ID: packet.ID, Type: LoginReplyType, Data: json.RawMessage(reply)}
+		err = <-errs
+		if strings.Contains(reply, "false") {
+			if err == nil || !strings.Contains(err.Error(), "bad password") {
+				t.Fatalf("Expected login failure with reason, got %v", err)
+			}
+		} else if err != nil {
+			t.Fatalf("Login failed: %s", err)
+		}
+	}
+	go func() { errs <- room.Logout() }()
+	packet := <-*th.outbound
+	if packet.Type != LogoutType {
+		t.Fatalf("Incorrect packet type. Expected 'logout', got '%s'", packet.Type)
+	}
+	*th.inbound <- &PacketEvent{ID: packet.ID, Type: LogoutReplyType, Data: json.RawMessage(`{}`)}
+	if err := <-errs; err != nil {
+		t.Fatalf("Logout failed: %s", err)
+	}
+}
+
+func TestFeatures(t *testing.T) {
+	server := NewTitleServer(map[string]string{"/page": "Page Title"})
+	defer server.Close()
+	roomCfg := NewTestRoomConfig()
+	roomCfg.Admins = []string{"agent:admin"}
+	roomCfg.Features = map[string]bool{FeatureAnnouncements: false}
+	room, th := NewTestHarnessWithConfig(t, roomCfg)
+	defer room.db.Close()
+	defer room.Stop()
+	go room.Run()
+	admin := User{ID: "agent:admin", Name: "admin"}
+
+	th.SendSessionEvent(JoinEventType, "alice", "s1")
+	th.AssertNoPacket()
+	th.SendSendEvent(server.URL+"/page", "", "test")
+	th.AssertReceivedSendText("Link title: Page Title")
+
+	th.SendSendEventFrom("!feature off", "", admin)
+	th.AssertReceivedSendText(featureUsage)
+	th.SendSendEventFrom("!feature off "+FeatureLinkTitles, "", User{ID: "agent:other", Name: "other"})
+	th.AssertReceivedSendText("You are not authorized to do that.")
+	th.SendSendEventFrom("!feature off linktitle", "", admin)
+	th.AssertReceivedSendText("Unknown feature linktitle. Features are announcements, link-titles.")
+	th.SendSendEventFrom("!feature off "+FeatureLinkTitles, "", admin)
+	th.AssertReceivedSendText("Feature link-titles is now off.")
+	th.SendSendEvent(server.URL+"/page", "", "test")
+	th.AssertNoPacket()
+
+	th.SendSendEventFrom("!feature on "+FeatureAnnouncements, "", admin)
+	th.AssertReceivedSendText("Feature announcements is now on.")
+	th.SendSessionEvent(JoinEventType, "bob", "s2")
+	th.AssertReceivedSendText("< bob joined the room. >")
+}
+
+func TestReadConfig(t *testing.T) {
+	cfg, err := ReadConfig(strings.NewReader(`{
+		"room": "test", "passcode": "secret", "store": "test.db",
+		"handlers": ["ping", "flip"], "command_prefix": "?",
+		"templates": {"join": "hi {{.User}}"}}`))
+	if err != nil {
+		t.Fatalf("Could not read config: %s", err)
+	}
+	roomCfg := cfg.RoomConfig()
+	if roomCfg.Nick != "MaiMai" || roomCfg.Password != "secret" || roomCfg.DBPath != "test.db" ||
+		roomCfg.CommandPrefix != "?" || len(roomCfg.Handlers) != 2 || roomCfg.Templates["join"] != "hi {{.User}}" {
+		t.Fatalf("Incorrect RoomConfig: %+v", roomCfg)
+	}
+	for _, bad := range []string{`{"nick": "MaiMai"}`, `{"room": "test", "nik": "MaiMai"}`, `{"room":`} {
+		if _, err := ReadConfig(strings.NewReader(bad)); err == nil {
+			t.Fatalf("Expected an error for config %s", bad)
+		}
+	}
+	roomCfg.Handlers = []string{"ping", "karma"}
+	if _, err := NewRoom(roomCfg, "test", NewMockSR("test"), logrus.New()); err == nil || !strings.Contains(err.Error(), "karma") {
+		t.Fatalf("Expected an unknown handler error, got %v", err)
+	}
+}
+
+func TestCommandPrefix(t *testing.T) {
+	roomCfg := NewTestRoomConfig()
+	roomCfg.Handlers = []string{"ping"}
+	roomCfg.CommandPrefix = "?"
+	room, th := NewTestHarnessWithConfig(t, roomCfg)
+	defer room.db.Close()
+	defer room.Stop()
+	go room.Run()
+	th.SendSendEvent("!ping", "", "test")
+	th.AssertNoPacket()
+	th.SendSendEvent("?ping", "", "test")
+	th.AssertReceivedSendText("pong!")
+	th.SendSendEvent("?flip", "", "test")
+	th.AssertNoPacket()
+}
+
+func TestCommandName(t *testing.T) {
+	for _, c := range []struct {
+		content, prefix, name, args string
+	}{
+		{"!ping", "", "ping", ""},
+		{"!remind me  in 5m ", "", "remind", "me  in 5m"},
+		{"!tz\tset UTC", "!", "tz", "set UTC"},
+		{"?ping now", "?", "ping", "now"},
+		{"!ping", "?", "", ""},
+		{"hello !ping", "", "", ""},
+		{"!", "", "", ""},
+		{"! ping", "", "", ""},
+		{"", "", "", ""},
+	} {
+		msg := Message{Content: c.content}
+		if name, args := msg.CommandName(c.prefix); name != c.name || args != c.args {
+			t.Errorf("CommandName(%q) of %q = %q, %q; want %q, %q", c.prefix, c.content, name, args, c.name, c.args)
+		}
+		if msg.IsCommand(c.prefix) != (c.name != "") {
+			t.Errorf("IsCommand(%q) of %q = %v", c.prefix, c.content, !(c.name != ""))
+		}
+	}
+}
+
+func TestEvalCalc(t *testing.T) {
+	for expression, want := range map[string]float64{
+		"1 + 2 * 3":     7,
+		"(1 + 2) * 3":   9,
+		"10 - 4 - 3":    3,
+		"12 / 4 / 3":    1,
+		"2 ^ 3 ^ 2":     512,
+		"-2^2":          -4,
+		"2 * -3":        -6,
+		" 1.5*(2+2) ":   6,
+		"2^-1":          0.5,
+		"((((7))))":     7,
+		"3 + 4 * 2 / 8": 4,
+	} {
+		got, err := evalCalc(expression)
+		if err != nil {
+			t.Fatalf("Could not evaluate %s: %s", expression, err)
+		}
+		if got != want {
+			t.Fatalf("Incorrect value for %s. Expected %v, got %v", expression, want, got)
+		}
+	}
+	for _, expression := range []string{"1 / 0", "1 / (2 - 2)", "(1 + 2", "1 +", "2 $ 3", "1 2",
+		"", "10 ^ 1000", "1.2.3", strings.Repeat("1+", maxCalcLength)} {
+		if _, err := evalCalc(expression); err == nil {
+			t.Fatalf("Expected an error evaluating %q", expression)
+		}
+	}
+	if _, err := evalCalc("2 \u00d7 3"); err == nil || err.Error() != "Unexpected '\u00d7' at position 3." {
+		t.Fatalf("Incorrect error for a non-ASCII character: %v", err)
+	}
+	if _, err := evalCalc("2 + 1.2.3"); err == nil || err.Error() != "Invalid number '1.2.3' at position 5." {
+		t.Fatalf("Incorrect error for a malformed number: %v", err)
+	}
+}
+
+func TestCalcCommand(t *testing.T) {
+	room, th := NewTestHarness(t)
+	defer room.db.Close()
+	defer room.Stop()
+	go room.Run()
+	th.SendSendEvent("!calc 2 + 3 * 4", "", "test")
+	th.AssertReceivedSendText("14")
+	th.SendSendEvent("!calc 1/0", "", "test")
+	th.AssertReceivedSendText("Could not evaluate: " + errDivisionByZero.Error())
+	th.SendSendEvent("!calc 1..2", "", "test")
+	th.AssertReceivedSendText("Could not evaluate: Invalid number '1..2' at position 1.")
+	th.SendSendEvent("!calc", "", "test")
+	th.AssertReceivedSendText(calcUsage)
+}
+
+func TestDiceModifiers(t *testing.T) {
+	for _, bad := range []string{"3d6x", "3d6k1", "2d20kh3", "2d20kl0", "4d6dl4", "0d6", "d1", "101d6", "3d6!!"} {
+		if _, err := parseDice(bad); err == nil {
+			t.Errorf("Expected %s to be rejected.", bad)
+		}
+	}
+	rnd := rand.New(rand.NewSource(1))
+	parse := func(notation string) *diceRoll {
+		roll, err := parseDice(notation)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return roll
+	}
+	advantage, disadvantage, dropLowest, exploding := parse("2d20kh1"), parse("2d20KL1"), parse("4d6dl1"), parse("3d6!")
+	for i := 0; i < 1000; i++ {
+		dice, kept, total := advantage.roll(rnd)
+		if total < dice[0] || total < dice[1] || kept[0] == kept[1] {
+			t.Fatalf("2d20kh1 rolled %v (kept %v) for %d", dice, kept, total)
+		}
+		dice, kept, total = disadvantage.roll(rnd)
+		if total > dice[0] || total > dice[1] || kept[0] == kept[1] {
+			t.Fatalf("2d20kl1 rolled %v (kept %v) for %d", dice, kept, total)
+		}
+		dice, kept, total = dropLowest.roll(rnd)
+		sum, lowest, dropped := 0, dice[0], 0
+		for j, die := range dice {
+			sum += die
+			if die < lowest {
+				lowest = die
+			}
+			if !kept[j] {
+				dropped++
+			}
+		}
+		if total != sum-lowest || dropped != 1 {
+			t.Fatalf("4d6dl1 rolled %v (kept %v) for %d", dice, kept, total)
+		}
+		dice, _, total = exploding.roll(rnd)
+		sum = 0
+		for _, die := range dice {
+			// A die showing its highest face always rolls again, adding at
+			// least 1, so no die's value is a multiple of the sides.
+			if die < 1 || die%6 == 0 {
+				t.Fatalf("3d6! rolled %v", dice)
+			}
+			sum += die
+		}
+		if total != sum {
+			t.Fatalf("3d6! rolled %v for %d", dice, total)
+		}
+	}
+	roomCfg := NewTestRoomConfig()
+	roomCfg.RandSource = rand.NewSource(1)
+	room, th := NewTestHarnessWithConfig(t, roomCfg)
+	defer room.db.Close()
+	defer room.Stop()
+	go room.Run()
+	th.SendSendEvent("!roll 2d20kh1", "", "test")
+	th.AssertReceivedSendPrefix("2d20kh1: ")
+	th.SendSendEvent("!roll 3d6x", "", "test")
+	th.AssertReceivedSendText("Invalid dice '3d6x'. " + rollUsage)
+	th.SendSendEvent("!roll", "", "test")
+	th.AssertReceivedSendText(rollUsage)
+}
+
+func TestSenderAccount(t *testing.T) {
+	packet := &PacketEvent{Type: SendEventType, Data: json.RawMessage(`{"id":"m1","content":"hi",
+		"sender":{"id":"account:0123abc","name":"mod","server_id":"heim.1","server_era":"era","is_manager":true}}`)}
+	msg := GetMessagePayload(packet)
+	if !msg.IsFromManager() || msg.IsFromStaff() || msg.Sender.AccountID() != "0123abc" {
+		t.Fatalf("Incorrect sender: %+v", msg.Sender)
+	}
+	packet.Data = json.RawMessage(`{"id":"m2","content":"hi","sender":{"id":"agent:xyz","name":"guest"}}`)
+	msg = GetMessagePayload(packet)
+	if msg == nil || msg.IsFromManager() || msg.IsFromStaff() || msg.Sender.AccountID() != "" {
+		t.Fatalf("Incorrect sender: %+v", msg)
+	}
+}
+
+func TestNormalizeNick(t *testing.T) {
+	for nick, want := range map[string]string{
+		"MaiMai":         "MaiMai",
+		"Mai Mai":        "MaiMai",
+		"  you, me & i!": "youmei",
+		"\"quoted\"":     "quoted",
+		"ünï cödé":       "ünïcödé",
+	} {
+		if got := NormalizeNick(nick); got != want {
+			t.Fatalf("Incorrect normalized nick for %q. Expected %q, got %q", nick, want, got)
+		}
+	}
+}
+
+func TestReplyMention(t *testing.T) {
+	roomCfg := NewTestRoomConfig()
+	roomCfg.MentionReplies = []string{"!ping"}
+	room, th := NewTestHarnessWithConfig(t, roomCfg)
+	defer room.db.Close()
+	defer room.Stop()
+	go room.Run()
+	th.SendSendEventFrom("!ping", "", User{ID: "agent:a", Name: "Some One!"})
+	th.AssertReceivedSendText("@SomeOne pong!")
+	th.SendSendEvent("!uptime", "", "Some One")
+	th.AssertReceivedSendPrefix("This bot has been up for")
+}
+
+func TestFloodTracker(t *testing.T) {
+	tracker := newFloodTracker(3, time.Duration(3)*time.Second)
+	start := time.Unix(1000, 0)
+	at := func(ms int) time.Time { return start.Add(time.Duration(ms) * time.Millisecond) }
+	for i, ms := range []int{0, 500, 1000} {
+		if tracker.record("a", at(ms)) {
+			t.Fatalf("Tripped on message %d within the limit.", i+1)
+		}
+	}
+	if !tracker.record("a", at(1500)) {
+		t.Fatal("Did not trip on exceeding the limit.")
+	}
+	if tracker.record("a", at(2000)) {
+		t.Fatal("Tripped twice for the same flood.")
+	}
+	if tracker.record("b", at(2000)) {
+		t.Fatal("Another user's messages were counted.")
+	}
+	// By 5.5s the earlier messages have left the window, so the flood is over.
+	if tracker.record("a", at(5500)) {
+		t.Fatal("Tripped after the rate fell within the limit.")
+	}
+	for _, ms := range []int{5600, 5700} {
+		tracker.record("a", at(ms))
+	}
+	if !tracker.record("a", at(5800)) {
+		t.Fatal("Did not trip again on a new flood.")
+	}
+	tracker.expire(at(10000))
+	if len(tracker.recent) != 0 || len(tracker.warned) != 0 {
+		t.Fatalf("Idle users were not expired: %v %v", tracker.recent, tracker.warned)
+	}
+}
+
+func TestFloodGuard(t *testing.T) {
+	flooded := make(chan User, 1)
+	roomCfg := NewTestRoomConfig()
+	roomCfg.Handlers = []string{"flood-guard"}
+	roomCfg.FloodLimit = 2
+	roomCfg.OnFlood = func(room *Room, user User) { flooded <- user }
+	room, th := NewTestHarnessWithConfig(t, roomCfg)
+	defer room.db.Close()
+	defer room.Stop()
+	go room.Run()
+	spammer := User{ID: "agent:spam", Name: "spammer"}
+	for i := 0; i < 4; i++ {
+		th.SendSendEventFrom("spam", "", spammer)
+	}
+	th.AssertReceivedSendText("spammer, please slow down.")
+	th.AssertNoPacket()
+	select {
+	case user := <-flooded:
+		if user.ID != spammer.ID {
+			t.Fatalf("OnFlood called for the wrong user: %+v", user)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timeout: OnFlood was not called.")
+	}
+}
+
+func TestBanUnban(t *testing.T) {
+	room, th := NewTestHarness(t)
+	defer room.db.Close()
+	defer room.Stop()
+	go room.Run()
+	errs := make(chan error)
+	reply := func(replyType PacketType, errText string) *PacketEvent {
+		packet := <-*th.outbound
+		*th.inbound <- &PacketEvent{ID: packet.ID, Type: replyType, Data: packet.Data, Error: errText}
+		return packet
+	}
+
+	go func() { errs <- room.Ban("agent:spam", 60) }()
+	packet := reply(BanReplyType, "")
+	if packet.Type != BanType || string(packet.Data) != `{"ident":"agent:spam","seconds":60}` {
+		t.Fatalf("Unexpected ban packet: %s %s", packet.Type, packet.Data)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("Ban failed: %s", err)
+	}
+
+	go func() { errs <- room.Unban("agent:spam") }()
+	packet = reply(UnbanReplyType, "access denied")
+	if packet.Type != UnbanType || string(packet.Data) != `{"ident":"agent:spam"}` {
+		t.Fatalf("Unexpected unban packet: %s %s", packet.Type, packet.Data)
+	}
+	if err := <-errs; err == nil || !strings.Contains(err.Error(), "access denied") {
+		t.Fatalf("Expected a permission error, got %v", err)
+	}
+}
+
+func TestTimestamp(t *testing.T) {
+	msg := &Message{Time: 1445000000}
+	if !msg.Timestamp().Equal(time.Date(2015, 10, 16, 12, 53, 20, 0, time.UTC)) {
+		t.Fatalf("Incorrect message timestamp: %s", msg.Timestamp())
+	}
+	_, event := prepareMsgLogEvent(msg)
+	if !event.Timestamp().Equal(msg.Timestamp()) {
+		t.Fatalf("Incorrect log event timestamp: %s", event.Timestamp())
+	}
+}
+
+func TestParseArgs(t *testing.T) {
+	for content, want := range map[string][]string{
+		`!quote add "hello world"`:   {"!quote", "add", "hello world"},
+		`!define 'ice cream'  extra`: {"!define", "ice cream", "extra"},
+		`!time America/New\ York`:    {"!time", "America/New York"},
+		`say "he said \"hi\""`:       {"say", `he said "hi"`},
+		`it's fine`:                  {"it's", "fine"},
+		`'single \ backslash'`:       {`single \ backslash`},
+		`mid"dle quo"ted`:            {"middle quoted"},
+		`empty "" arg`:               {"empty", "", "arg"},
+		"  \tspaced   out \n":        {"spaced", "out"},
+		`escaped \"quote`:            {"escaped", `"quote`},
+		`trailing backslash \`:       {"trailing", "backslash", `\`},
+	} {
+		got := ParseArgs(content)
+		if strings.Join(got, "|") != strings.Join(want, "|") || len(got) != len(want) {
+			t.Fatalf("Incorrect args for %s. Expected %q, got %q", content, want, got)
+		}
+	}
+	if args := ParseArgs(""); len(args) != 0 {
+		t.Fatalf("Expected no args, got %q", args)
+	}
+	if text := unquote(`"hello world"`); text != "hello world" {
+		t.Fatalf("Incorrect unquoted text: %s", text)
+	}
+	if text := unquote(`"hi" she said`); text != `"hi" she said` {
+		t.Fatalf("Text with several args was unquoted: %s", text)
+	}
+}
+
+func TestClose(t *testing.T) {
+	room, th := NewTestHarness(t)
+	go room.Run()
+	exited := make(chan empty)
+	WaitFor(t, func() bool {
+		room.handlersMu.Lock()
+		defer room.handlersMu.Unlock()
+		return room.running
+	})
+	room.AddHandler("exit-check", func(room *Room, input chan PacketEvent, cmdChan chan string) {
+		defer close(exited)
+		for {
+			select {
+			case <-input:
+			case cmd := <-cmdChan:
+				if cmd == "kill" {
+					return
+				}
+			}
+		}
+	})
+	if err := room.StoreSeen("closer", time.Unix(1445000000, 0)); err != nil {
+		t.Fatalf("Could not store seen: %s", err)
+	}
+	room.SendText("bye", "")
+	if err := room.Close(); err != nil {
+		t.Fatalf("Close failed: %s", err)
+	}
+	th.AssertReceivedSendText("bye")
+	select {
+	case <-exited:
+	default:
+		t.Fatal("Handler did not exit before Close returned.")
+	}
+	if !room.sr.(*MockSenderReceiver).closed {
+		t.Fatal("Connection was not closed.")
+	}
+	db, err := bolt.Open("test.db", 0666, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		t.Fatalf("Store is still open: %s", err)
+	}
+	defer db.Close()
+	db.View(func(tx *bolt.Tx) error {
+		if seen := tx.Bucket([]byte("Seen")).Get([]byte("closer")); string(seen) != "1445000000" {
+			t.Fatalf("Seen time was not persisted: %s", seen)
+		}
+		return nil
+	})
+}
+
+func TestRestartPolicy(t *testing.T) {
+	cfg := NewTestRoomConfig()
+	cfg.Handlers = []string{}
+	cfg.RestartPolicy = &RestartPolicy{MaxRestarts: 2, Window: time.Minute}
+	room, th := NewTestHarnessWithConfig(t, cfg)
+	defer room.db.Close()
+	defer room.Stop()
+	go room.Run()
+	WaitFor(t, func() bool {
+		room.handlersMu.Lock()
+		defer room.handlersMu.Unlock()
+		return room.running
+	})
+	var starts int32
+	room.AddHandler("crasher", func(room *Room, input chan PacketEvent, cmdChan chan string) {
+		atomic.AddInt32(&starts, 1)
+		for {
+			select {
+			case packet := <-input:
+				if packet.Type == SendEventType && GetMessagePayload(&packet).Content == "crash" {
+					room.errChan <- errors.New("Crashed.")
+					return
+				}
+			case cmd := <-cmdChan:
+				if cmd == "kill" {
+					return
+				}
+			}
+		}
+	})
+	for want := int32(2); want <= 3; want++ {
+		th.SendSendEvent("crash", "", "tester")
+		WaitFor(t, func() bool { return atomic.LoadInt32(&starts) == want })
+	}
+	th.SendSendEvent("crash", "", "tester")
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt32(&starts); n != 3 {
+		t.Fatalf("Handler was restarted past MaxRestarts: %d starts", n)
+	}
+
+	atomic.StoreInt32(&starts, 0)
+	room.AddHandler("killed", func(room *Room, input chan PacketEvent, cmdChan chan string) {
+		atomic.AddInt32(&starts, 1)
+		for {
+			select {
+			case <-input:
+			case cmd := <-cmdChan:
+				if cmd == "kill" {
+					return
+				}
+			}
+		}
+	})
+	WaitFor(t, func() bool { return atomic.LoadInt32(&starts) == 1 })
+	if err := room.RemoveHandler("killed"); err != nil {
+		t.Fatalf("Could not remove handler: %s", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt32(&starts); n != 1 {
+		t.Fatalf("Killed handler was restarted: %d starts", n)
+	}
+}
+
+func TestWSOptions(t *testing.T) {
+	ws := NewWSSenderReceiver("test", logrus.New())
+	if url := ws.roomURL(); url != "wss://euphoria.io/room/test/ws" {
+		t.Fatalf("Incorrect default room URL: %s", url)
+	}
+	ws = NewWSSenderReceiver("test", logrus.New(), WithEndpoint("ws://localhost:8080/"))
+	if url := ws.roomURL(); url != "ws://localhost:8080/room/test/ws" {
+		t.Fatalf("Incorrect room URL: %s", url)
+	}
+	for _, endpoint := range []string{"https://euphoria.io", "euphoria.io", "::"} {
+		ws = NewWSSenderReceiver("test", logrus.New(), WithEndpoint(endpoint))
+		if err := ws.connect(nil); err == nil {
+			t.Fatalf("Expected an error connecting to endpoint %s", endpoint)
+		}
+	}
+
+	paths := make(chan string, 1)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		paths <- req.URL.Path
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, req, nil)
+		if err == nil {
+			conn.Close()
+		}
+	}))
+	defer server.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+	endpoint := strings.Replace(server.URL, "https://", "wss://", 1)
+	ws = NewWSSenderReceiver("test", logrus.New(), WithEndpoint(endpoint), WithTLSConfig(&tls.Config{RootCAs: pool}))
+	if err := ws.connectOnce(nil); err != nil {
+		t.Fatalf("Could not connect to %s: %s", endpoint, err)
+	}
+	ws.conn.Close()
+	if path := <-paths; path != "/room/test/ws" {
+		t.Fatalf("Incorrect request path: %s", path)
+	}
+}
+
+func TestDailyPick(t *testing.T) {
+	var items []string
+	for i := 0; i < 100; i++ {
+		items = append(items, fmt.Sprint(i))
+	}
+	loc := time.FixedZone("UTC-5", -5*60*60)
+	morning := time.Date(2015, 10, 16, 0, 0, 1, 0, loc)
+	pick := dailyPick("!fortune", items, morning, loc)
+	for _, later := range []time.Duration{time.Hour, 12 * time.Hour, 24*time.Hour - 2*time.Second} {
+		if got := dailyPick("!fortune", items, morning.Add(later), loc); got != pick {
+			t.Fatalf("Pick changed within the day: %s at +%s, %s at midnight", got, later, pick)
+		}
+	}
+	// 04:59 UTC on the 17th is still the 16th in loc.
+	if got := dailyPick("!fortune", items, time.Date(2015, 10, 17, 4, 59, 0, 0, time.UTC), loc); got != pick {
+		t.Fatalf("Pick did not honor the day boundary in loc: %s, expected %s", got, pick)
+	}
+	changed := false
+	for day := 1; day <= 5; day++ {
+		if dailyPick("!fortune", items, morning.AddDate(0, 0, day), loc) != pick {
+			changed = true
+		}
+	}
+	if !changed {
+		t.Fatal("Pick did not change across days.")
+	}
+	if got := dailyPick("!fortune", nil, morning, loc); got != "" {
+		t.Fatalf("Expected no pick from no items, got %s", got)
+	}
+}
+
+func TestDailyCommand(t *testing.T) {
+	roomCfg := NewTestRoomConfig()
+	roomCfg.Handlers = []string{}
+	room, th := NewTestHarnessWithConfig(t, roomCfg)
+	defer room.db.Close()
+	defer room.Stop()
+	go room.Run()
+	room.AddHandler("fortune", NewDailyCommandHandler("!fortune", []string{"only fortune"}, nil))
+	th.SendSendEvent("!fortune", "", "test")
+	th.AssertReceivedSendText("only fortune")
+	th.SendSendEvent("!fortunes", "", "test")
+	th.AssertNoPacket()
+}
+
+func TestSendTimeout(t *testing.T) {
+	roomCfg := NewTestRoomConfig()
+	roomCfg.SendTimeout = time.Duration(100) * time.Millisecond
+	room, _ := NewTestHarnessWithConfig(t, roomCfg)
+	defer room.db.Close()
+	// Nothing drains outbound, as if the writer were wedged.
+	atomic.StoreInt32(&room.connected, 1)
+	for i := 0; i < outboundSize; i++ {
+		if err := room.SendText("filler", ""); err != nil {
+			t.Fatalf("Send with room in the queue failed: %s", err)
+		}
+	}
+	start := time.Now()
+	if err := room.SendText("stuck", ""); err != ErrSendTimeout {
+		t.Fatalf("Expected ErrSendTimeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < roomCfg.SendTimeout || elapsed > time.Second {
+		t.Fatalf("Send timed out after %s", elapsed)
+	}
+	if n := atomic.LoadInt32(&room.pendingSends); n != 0 {
+		t.Fatalf("Timed-out send is still counted as pending: %d", n)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	roomCfg := NewTestRoomConfig()
+	roomCfg.Handlers = []string{"ping-event", "ping"}
+	room, _ := NewTestHarnessWithConfig(t, roomCfg)
+	session := `{"id":"","type":"ping-event","data":{"time":1445000000,"next":1445000030}}
+{"id":"","type":"send-event","data":{"id":"m1","content":"!ping","sender":{"id":"agent:a","name":"alice"}}}
+
+{"id":"","type":"send-event","data":{"id":"m2","content":"hello","sender":{"id":"agent:a","name":"alice"}}}
+`
+	sent, err := room.Replay(strings.NewReader(session))
+	room.db.Close()
+	if err != nil {
+		t.Fatalf("Replay failed: %s", err)
+	}
+	var got []string
+	for _, packet := range sent {
+		got = append(got, string(packet.Type)+" "+string(packet.Data))
+	}
+	sort.Strings(got)
+	want := `ping-reply {"time":1445000000}; send {"content":"pong!","parent":"m1"}`
+	if strings.Join(got, "; ") != want {
+		t.Fatalf("Incorrect packets sent during replay: %v", got)
+	}
+
+	room, _ = NewTestHarnessWithConfig(t, roomCfg)
+	defer room.db.Close()
+	if _, err := room.Replay(strings.NewReader("{\"type\":\"ping-event\",\"data\":{\"time\":1}}\nnot json\n")); err == nil {
+		t.Fatal("Expected an error for a malformed recording.")
+	}
+}
+
+func TestRecordTo(t *testing.T) {
+	roomCfg := NewTestRoomConfig()
+	roomCfg.Handlers = []string{"ping"}
+	room, th := NewTestHarnessWithConfig(t, roomCfg)
+	go room.Run()
+	th.SendSendEvent("!ping", "", "test")
+	th.AssertReceivedSendText("pong!")
+	var recording bytes.Buffer
+	room.RecordTo(&recording)
+	th.SendMessage(Message{ID: "m1", Content: "!ping", Sender: User{ID: "agent:a", Name: "alice"}})
+	th.AssertReceivedSendText("pong!")
+	room.RecordTo(nil)
+	th.SendSendEvent("!ping", "", "test")
+	th.AssertReceivedSendText("pong!")
+	room.Stop()
+	room.db.Close()
+	lines := strings.Split(strings.TrimSpace(recording.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("Expected one recorded packet, got %d: %q", len(lines), lines)
+	}
+	var packet PacketEvent
+	if err := json.Unmarshal([]byte(lines[0]), &packet); err != nil || packet.Type != SendEventType ||
+		GetMessagePayload(&packet).ID != "m1" {
+		t.Fatalf("Incorrect recorded packet: %s (%v)", lines[0], err)
+	}
+
+	// The recording replays to the same replies.
+	room, _ = NewTestHarnessWithConfig(t, roomCfg)
+	defer room.db.Close()
+	sent, err := room.Replay(&recording)
+	if err != nil || len(sent) != 1 || string(sent[0].Data) != `{"content":"pong!","parent":"m1"}` {
+		t.Fatalf("Recording did not replay: %v (%v)", sent, err)
+	}
+}
+
+func TestSendOrdering(t *testing.T) {
+	room, th := NewTestHarness(t)
+	defer room.db.Close()
+	defer room.Stop()
+	go room.Run()
+	const senders, perSender = 10, 20
+	for g := 0; g < senders; g++ {
+		go func(g int) {
+			for i := 0; i < perSender; i++ {
+				room.SendText(fmt.Sprintf("%d %d", g, i), "")
+			}
+		}(g)
+	}
+	next := make([]int, senders)
+	for n := 0; n < senders*perSender; n++ {
+		packet := <-*th.outbound
+		var cmd SendCommand
+		json.Unmarshal(packet.Data, &cmd)
+		var g, i int
+		fmt.Sscanf(cmd.Content, "%d %d", &g, &i)
+		if i != next[g] {
+			t.Fatalf("Sender %d's messages out of order: got %d, expected %d", g, i, next[g])
+		}
+		next[g]++
+	}
+
+	msgs := make(chan *Message)
+	go func() {
+		msg, err := room.SendTextAndWait("hello", "p1")
+		if err != nil {
+			t.Errorf("SendTextAndWait failed: %s", err)
+		}
+		msgs <- msg
+	}()
+	packet := <-*th.outbound
+	*th.inbound <- &PacketEvent{ID: packet.ID, Type: SendReplyType,
+		Data: json.RawMessage(`{"id":"m1","parent":"p1","content":"hello"}`)}
+	if msg := <-msgs; msg == nil || msg.ID != "m1" {
+		t.Fatalf("Incorrect sent message: %+v", msg)
+	}
+	room.SetReadOnly(true)
+	if _, err := room.SendTextAndWait("hello", ""); err != ErrReadOnly {
+		t.Fatalf("Expected ErrReadOnly, got %v", err)
+	}
+}
+
+func TestSend(t *testing.T) {
+	roomCfg := NewTestRoomConfig()
+	roomCfg.Handlers = []string{}
+	room, th := NewTestHarnessWithConfig(t, roomCfg)
+	defer room.db.Close()
+	defer room.Stop()
+	ids := make(chan string, 1)
+	room.AddHandler("sender", func(room *Room, input chan PacketEvent, cmdChan chan string) {
+		for {
+			select {
+			case packet := <-input:
+				if packet.Type != SendEventType || GetMessagePayload(&packet).Content != "!custom" {
+					continue
+				}
+				id, err := room.Send(SendCommand{Content: "custom", Parent: "p2"})
+				if err != nil {
+					t.Errorf("Send failed: %s", err)
+				}
+				ids <- id
+			case cmd := <-cmdChan:
+				if cmd == "kill" {
+					return
+				}
+			}
+		}
+	})
+	go room.Run()
+	th.SendSendEvent("!custom", "", "test")
+	packet := <-*th.outbound
+	if packet.Type != SendType || string(packet.Data) != `{"content":"custom","parent":"p2"}` {
+		t.Fatalf("Unexpected send packet: %s %s", packet.Type, packet.Data)
+	}
+	// A handler waiting in Send does not hold up the reply, however many
+	// events arrive meanwhile.
+	for i := 0; i < 20; i++ {
+		th.SendSendEvent("chatter", "", "test")
+	}
+	*th.inbound <- &PacketEvent{ID: packet.ID, Type: SendReplyType,
+		Data: json.RawMessage(`{"id":"m2","parent":"p2","content":"custom"}`)}
+	if id := <-ids; id != "m2" {
+		t.Fatalf("Incorrect message ID: %q", id)
+	}
+	room.SetReadOnly(true)
+	if _, err := room.Send(SendCommand{Content: "hello"}); err != ErrReadOnly {
+		t.Fatalf("Expected ErrReadOnly, got %v", err)
+	}
+}
+
+func TestPartJitter(t *testing.T) {
+	roomCfg := NewTestRoomConfig()
+	roomCfg.PartGrace = time.Duration(50) * time.Millisecond
+	roomCfg.PartJitter = time.Duration(500) * time.Millisecond
+	roomCfg.RandSource = rand.NewSource(1)
+	room, th := NewTestHarnessWithConfig(t, roomCfg)
+	defer room.db.Close()
+	defer room.Stop()
+	go room.Run()
+	start := time.Now()
+	const parts = 8
+	for i := 0; i < parts; i++ {
+		th.SendSessionEvent(PartEventType, fmt.Sprintf("user%d", i), fmt.Sprintf("s%d", i))
+	}
+	var first, last time.Duration
+	for i := 0; i < parts; i++ {
+		th.AssertReceivedSendPrefix("< user")
+		elapsed := time.Since(start)
+		if i == 0 {
+			first = elapsed
+		}
+		last = elapsed
+	}
+	if first < roomCfg.PartGrace || last > roomCfg.PartGrace+roomCfg.PartJitter+time.Duration(200)*time.Millisecond {
+		t.Fatalf("Announcements outside the grace window: first %s, last %s", first, last)
+	}
+	if last-first < time.Duration(100)*time.Millisecond {
+		t.Fatalf("Announcements were not spread out: first %s, last %s", first, last)
+	}
+	if room.Jitter(0) != 0 {
+		t.Fatal("Expected no jitter for a zero maximum.")
+	}
+}
+
+func TestMaxLogContentLength(t *testing.T) {
+	roomCfg := NewTestRoomConfig()
+	roomCfg.Handlers = []string{"message-log"}
+	roomCfg.MaxLogContentLength = 100
+	room, th := NewTestHarnessWithConfig(t, roomCfg)
+	defer room.db.Close()
+	defer room.Stop()
+	go room.Run()
+	sender := User{ID: "agent:paster", Name: "paster"}
+	long := strings.Repeat("wall of text ", 800)[:10000]
+	th.SendMessage(Message{ID: "long-1", Sender: sender, Time: 100, Content: long})
+	th.SendMessage(Message{ID: "short-1", Sender: sender, Time: 101, Content: "short"})
+	var msg *MsgLogEvent
+	WaitFor(t, func() bool {
+		msg, _ = room.retrieveMsgLogEvent("short-1")
+		return msg != nil
+	})
+	if msg.Truncated || msg.Content != "short" {
+		t.Fatalf("Short message was altered: %+v", msg)
+	}
+	msg, _ = room.retrieveMsgLogEvent("long-1")
+	if !msg.Truncated || len([]rune(msg.Content)) != 100 || !strings.HasPrefix(long, strings.TrimSuffix(msg.Content, "...")) {
+		t.Fatalf("Long message was not truncated to 100 characters: %d %v", len(msg.Content), msg.Truncated)
+	}
+
+	fetched := make(chan *Message)
+	go func() {
+		full, err := room.GetMessage("long-1")
+		if err != nil {
+			t.Errorf("GetMessage failed: %s", err)
+		}
+		fetched <- full
+	}()
+	packet := <-*th.outbound
+	if packet.Type != GetMessageType || string(packet.Data) != `{"id":"long-1"}` {
+		t.Fatalf("Unexpected get-message packet: %s %s", packet.Type, packet.Data)
+	}
+	payload, _ := json.Marshal(Message{ID: "long-1", Sender: sender, Time: 100, Content: long})
+	*th.inbound <- &PacketEvent{ID: packet.ID, Type: GetMessageReplyType, Data: payload}
+	if full := <-fetched; full == nil || full.Content != long {
+		t.Fatal("GetMessage did not return the full content.")
+	}
+}
+
+func TestFetchTruncated(t *testing.T) {
+	roomCfg := NewTestRoomConfig()
+	roomCfg.Handlers = []string{"message-log"}
+	roomCfg.FetchTruncated = true
+	room, th := NewTestHarnessWithConfig(t, roomCfg)
+	defer room.db.Close()
+	defer room.Stop()
+	go room.Run()
+	sender := User{ID: "agent:paster", Name: "paster"}
+	long := strings.Repeat("wall of text ", 800)
+	th.SendMessage(Message{ID: "cut-1", Sender: sender, Time: 100, Content: long[:64], Truncated: true})
+	packet := <-*th.outbound
+	if packet.Type != GetMessageType || string(packet.Data) != `{"id":"cut-1"}` {
+		t.Fatalf("Unexpected get-message packet: %s %s", packet.Type, packet.Data)
+	}
+	// The handler goes on logging while the fetch is in flight.
+	for i := 0; i < 10; i++ {
+		th.SendMessage(Message{ID: fmt.Sprint("during-", i), Sender: sender, Time: 100, Content: "meanwhile"})
+	}
+	WaitFor(t, func() bool {
+		msg, _ := room.retrieveMsgLogEvent("during-9")
+		return msg != nil
+	})
+	if msg, _ := room.retrieveMsgLogEvent("cut-1"); msg == nil || msg.Content != long[:64] {
+		t.Fatal("The truncated content was not logged while fetching.")
+	}
+	payload, _ := json.Marshal(Message{ID: "cut-1", Sender: sender, Time: 100, Content: long})
+	*th.inbound <- &PacketEvent{ID: packet.ID, Type: GetMessageReplyType, Data: payload}
+	WaitFor(t, func() bool {
+		msg, _ := room.retrieveMsgLogEvent("cut-1")
+		return msg != nil && msg.Content == long
+	})
+	th.SendMessage(Message{ID: "whole-1", Sender: sender, Time: 101, Content: "short"})
+	th.AssertNoPacket()
+}
+
+func TestPruneLog(t *testing.T) {
+	room, _ := NewTestHarness(t)
+	defer room.db.Close()
+	now := time.Unix(1445000000, 0)
+	for i, age := range []time.Duration{72 * time.Hour, 49 * time.Hour, 47 * time.Hour, time.Minute} {
+		room.storeMsgLogEvent(fmt.Sprintf("prune-%d", i), &MsgLogEvent{Time: now.Add(-age).Unix(), Content: "msg"})
+	}
+	remaining := func() []string {
+		var ids []string
+		room.retrieveMsgLogEvents(func(msgID string, msg *MsgLogEvent) bool {
+			if strings.HasPrefix(msgID, "prune-") {
+				ids = append(ids, msgID)
+			}
+			return false
+		}, 0)
+		return ids
+	}
+
+	room.pruneExpiredLog(now)
+	if ids := remaining(); len(ids) != 4 {
+		t.Fatalf("Messages pruned without a retention window: %v", ids)
+	}
+	room.SetLogRetention(48 * time.Hour)
+	room.pruneExpiredLog(now)
+	if ids := strings.Join(remaining(), ","); ids != "prune-3,prune-2" {
+		t.Fatalf("Incorrect messages remain after pruning: %s", ids)
+	}
+	// Other tests share the store, so more messages may be pruned.
+	n, err := room.PruneLog(now)
+	if err != nil || n < 2 {
+		t.Fatalf("Expected at least 2 messages pruned, got %d (%v)", n, err)
+	}
+	if ids := remaining(); len(ids) != 0 {
+		t.Fatalf("Messages remain after pruning: %v", ids)
+	}
+}
+
+func TestNick(t *testing.T) {
+	room, th := NewTestHarness(t)
+	defer room.db.Close()
+	defer room.Stop()
+	go room.Run()
+	if nick := room.Nick(); nick != "" {
+		t.Fatalf("Expected no nick before one is set, got %s", nick)
+	}
+	th.SendSnapshotEvent(SnapshotEvent{SessionID: "bot-session"})
+	*th.inbound <- &PacketEvent{ID: "1", Type: NickReplyType,
+		Data: json.RawMessage(`{"session_id":"bot-session","id":"bot:1","from":"","to":"MaiMai"}`)}
+	WaitFor(t, func() bool { return room.Nick() == "MaiMai" })
+	*th.inbound <- &PacketEvent{ID: "2", Type: NickReplyType, Error: "nick taken",
+		Data: json.RawMessage(`{"to":"Taken"}`)}
+	payload, _ := json.Marshal(NickEvent{SessionID: "other-session", ID: "agent:x", From: "x", To: "Impostor"})
+	*th.inbound <- &PacketEvent{Type: NickEventType, Data: payload}
+	WaitFor(t, func() bool { return strings.Contains(userNames(room.Users()), "Impostor") })
+	if nick := room.Nick(); nick != "MaiMai" {
+		t.Fatalf("Nick changed by a rejected reply or another session: %s", nick)
+	}
+	payload, _ = json.Marshal(NickEvent{SessionID: "bot-session", ID: "bot:1", From: "MaiMai", To: "MaiMai2"})
+	*th.inbound <- &PacketEvent{Type: NickEventType, Data: payload}
+	WaitFor(t, func() bool { return room.Nick() == "MaiMai2" })
+}
+
+func TestRenamedByHost(t *testing.T) {
+	changes := make(chan string, 4)
+	roomCfg := NewTestRoomConfig()
+	roomCfg.Handlers = []string{}
+	roomCfg.OnNickChange = func(room *Room, from, to string) {
+		if from == "" {
+			// A slow first call must not let the second overtake it.
+			time.Sleep(time.Duration(50) * time.Millisecond)
+		}
+		changes <- from + " -> " + to
+	}
+	room, th := NewTestHarnessWithConfig(t, roomCfg)
+	defer room.db.Close()
+	defer room.Stop()
+	go room.Run()
+	payload, _ := json.Marshal(HelloEvent{ID: "bot:1",
+		Session: SessionView{User: User{ID: "bot:1"}, SessionID: "hello-session"}})
+	*th.inbound <- &PacketEvent{Type: HelloEventType, Data: payload}
+	*th.inbound <- &PacketEvent{ID: "1", Type: NickReplyType,
+		Data: json.RawMessage(`{"session_id":"hello-session","id":"bot:1","from":"","to":"MaiMai"}`)}
+	payload, _ = json.Marshal(NickEvent{SessionID: "hello-session", ID: "bot:1", From: "MaiMai", To: "HostPicked"})
+	*th.inbound <- &PacketEvent{Type: NickEventType, Data: payload}
+	WaitFor(t, func() bool { return room.Nick() == "HostPicked" })
+	for _, expected := range []string{" -> MaiMai", "MaiMai -> HostPicked"} {
+		select {
+		case change := <-changes:
+			if change != expected {
+				t.Fatalf("Incorrect nick change: got %q, expected %q", change, expected)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Timeout: OnNickChange was not called.")
+		}
+	}
+}
+
+func TestAlias(t *testing.T) {
+	roomCfg := NewTestRoomConfig()
+	roomCfg.Handlers = []string{"alias"}
+	roomCfg.Admins = []string{"agent:admin"}
+	room, th := NewTestHarnessWithConfig(t, roomCfg)
+	defer room.db.Close()
+	defer room.Stop()
+	go room.Run()
+	admin := User{ID: "agent:admin", Name: "admin"}
+	other := User{ID: "agent:other", Name: "other"}
+
+	th.SendSendEventFrom("!alias add !hi Hello there!", "", other)
+	th.AssertReceivedSendText("You are not authorized to do that.")
+	th.SendSendEventFrom("!alias add !hi Hello there!", "", admin)
+	th.AssertReceivedSendText("Alias !hi added.")
+	th.SendSendEventFrom("!hi", "", other)
+	th.AssertReceivedSendText("Hello there!")
+	th.SendSendEventFrom("!hi everyone", "", other)
+	th.AssertReceivedSendText("Hello there!")
+	th.SendSendEventFrom("!hiya", "", other)
+	th.AssertNoPacket()
+
+	th.SendSendEventFrom("!alias add !ping pong?", "", admin)
+	th.AssertReceivedSendText("!ping is a built-in command.")
+	th.SendSendEventFrom("!alias add !loop !hi", "", admin)
+	th.AssertReceivedSendText("An alias may not respond with a command.")
+	th.SendSendEventFrom("!alias add hi Hello", "", admin)
+	th.AssertReceivedSendText(aliasUsage)
+	th.SendSendEventFrom("!alias list", "", other)
+	th.AssertReceivedSendText("Aliases: !hi")
+
+	th.SendSendEventFrom("!alias remove !hi", "", admin)
+	th.AssertReceivedSendText("Alias !hi removed.")
+	th.SendSendEventFrom("!hi", "", other)
+	th.AssertNoPacket()
+	th.SendSendEventFrom("!alias remove !hi", "", admin)
+	th.AssertReceivedSendText("There is no alias !hi.")
+}
+
+func TestEditMessageCommand(t *testing.T) {
+	packet, _ := MakePacket("7", EditMessageType, EditMessageCommand{ID: "m1", Delete: true, Announce: true})
+	wire, _ := json.Marshal(packet)
+	if string(wire) != `{"id":"7","type":"edit-message","data":{"id":"m1","delete":true,"announce":true}}` {
+		t.Fatalf("Incorrect wire format: %s", wire)
+	}
+
+	room, th := NewTestHarness(t)
+	defer room.db.Close()
+	defer room.Stop()
+	go room.Run()
+	type result struct {
+		msg *Message
+		err error
+	}
+	results := make(chan result)
+	go func() {
+		msg, err := room.DeleteMessage("m1")
+		results <- result{msg, err}
+	}()
+	packet = <-*th.outbound
+	if packet.Type != EditMessageType || string(packet.Data) != `{"id":"m1","delete":true,"announce":true}` {
+		t.Fatalf("Unexpected delete packet: %s %s", packet.Type, packet.Data)
+	}
+	*th.inbound <- &PacketEvent{ID: packet.ID, Type: EditMessageReplyType,
+		Data: json.RawMessage(`{"edit_id":"e1","id":"m1","content":"spam","deleted":1445000000}`)}
+	r := <-results
+	if r.err != nil || r.msg.ID != "m1" || r.msg.Deleted != 1445000000 {
+		t.Fatalf("Incorrect deleted message: %+v (%v)", r.msg, r.err)
+	}
+
+	go func() {
+		msg, err := room.EditMessage("m2", "fixed")
+		results <- result{msg, err}
+	}()
+	packet = <-*th.outbound
+	if string(packet.Data) != `{"id":"m2","content":"fixed","delete":false,"announce":true}` {
+		t.Fatalf("Unexpected edit packet: %s", packet.Data)
+	}
+	*th.inbound <- &PacketEvent{ID: packet.ID, Type: EditMessageReplyType, Error: "access denied"}
+	if r := <-results; r.err == nil {
+		t.Fatal("Expected an error from a rejected edit.")
+	}
+
+	go func() {
+		msg, err := room.EditMessage("m3", "quietly fixed", Silently())
+		results <- result{msg, err}
+	}()
+	packet = <-*th.outbound
+	if string(packet.Data) != `{"id":"m3","content":"quietly fixed","delete":false,"announce":false}` {
+		t.Fatalf("Unexpected silent edit packet: %s", packet.Data)
+	}
+	*th.inbound <- &PacketEvent{ID: packet.ID, Type: EditMessageReplyType,
+		Data: json.RawMessage(`{"edit_id":"e3","id":"m3","content":"quietly fixed"}`)}
+	if r := <-results; r.err != nil || r.msg.Content != "quietly fixed" {
+		t.Fatalf("Incorrect silently edited message: %+v (%v)", r.msg, r.err)
+	}
+}
+
+func TestThreadRootReplies(t *testing.T) {
+	roomCfg := NewTestRoomConfig()
+	roomCfg.ThreadRootReplies = []string{"!ping"}
+	room, th := NewTestHarnessWithConfig(t, roomCfg)
+	defer room.db.Close()
+	defer room.Stop()
+	go room.Run()
+	// root <- middle <- !ping
+	th.SendMessage(Message{ID: "ping", Parent: "middle", Content: "!ping", Sender: User{Name: "a"}})
+	for _, m := range []Message{{ID: "middle", Parent: "root"}, {ID: "root"}} {
+		packet := <-*th.outbound
+		if packet.Type != GetMessageType || !strings.Contains(string(packet.Data), m.ID) {
+			t.Fatalf("Expected get-message for '%s', got %s %s", m.ID, packet.Type, packet.Data)
+		}
+		data, _ := json.Marshal(m)
+		*th.inbound <- &PacketEvent{ID: packet.ID, Type: GetMessageReplyType, Data: data}
+	}
+	packet := <-*th.outbound
+	var cmd SendCommand
+	json.Unmarshal(packet.Data, &cmd)
+	if cmd.Content != "pong!" || cmd.Parent != "root" {
+		t.Fatalf("Expected pong! under root, got %+v", cmd)
+	}
+	// Logged parents are found without a get-message.
+	room.storeMsgLogEvent("logged-middle", &MsgLogEvent{Parent: "logged-root", Content: "middle"})
+	room.storeMsgLogEvent("logged-root", &MsgLogEvent{Content: "root"})
+	th.SendMessage(Message{ID: "logged-ping", Parent: "logged-middle", Content: "!ping", Sender: User{Name: "a"}})
+	packet = <-*th.outbound
+	json.Unmarshal(packet.Data, &cmd)
+	if packet.Type != SendType || cmd.Content != "pong!" || cmd.Parent != "logged-root" {
+		t.Fatalf("Expected pong! under logged-root, got %s %+v", packet.Type, cmd)
+	}
+	// The walk stops at the first lookup that times out.
+	th.SendMessage(Message{ID: "lost-ping", Parent: "lost", Content: "!ping", Sender: User{Name: "a"}})
+	if packet = <-*th.outbound; packet.Type != GetMessageType {
+		t.Fatalf("Expected get-message for 'lost', got %s", packet.Type)
+	}
+	packet = <-*th.outbound
+	json.Unmarshal(packet.Data, &cmd)
+	if packet.Type != SendType || cmd.Content != "pong!" || cmd.Parent != "lost-ping" {
+		t.Fatalf("Expected pong! under lost-ping after the timeout, got %s %+v", packet.Type, cmd)
+	}
+	// Other commands still reply under the triggering message.
+	th.SendMessage(Message{ID: "flip", Parent: "middle", Content: "!flip", Sender: User{Name: "a"}})
+	packet = <-*th.outbound
+	json.Unmarshal(packet.Data, &cmd)
+	if packet.Type != SendType || cmd.Parent != "flip" {
+		t.Fatalf("Expected a reply under the message, got %s %+v", packet.Type, cmd)
+	}
+}
+
+func TestSnapshotSeenBackfill(t *testing.T) {
+	room, th := NewTestHarness(t)
+	defer room.db.Close()
+	defer room.Stop()
+	// test.db persists between runs, so reset both records first.
+	if err := room.storeSeen("BackfillEarlier", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := room.storeSeen("BackfillLater", 2000); err != nil {
+		t.Fatal(err)
+	}
+	go room.Run()
+	th.SendSnapshotEvent(SnapshotEvent{Log: []Message{
+		{Time: 1000, Sender: User{Name: "Backfill Earlier"}},
+		{Time: 1100, Sender: User{Name: "Backfill Earlier"}},
+		{Time: 1500, Sender: User{Name: "BackfillLater"}},
+	}})
+	WaitFor(t, func() bool {
+		seen, err := room.LastSeen("BackfillEarlier")
+		return err == nil && seen.Unix() == 1100
+	})
+	seen, _ := room.LastSeen("BackfillLater")
+	if seen.Unix() != 2000 {
+		t.Fatalf("A later seen record was overwritten, got %d", seen.Unix())
+	}
+}
+
+func TestClosestCommand(t *testing.T) {
+	if d := levenshtein("kitten", "sitting"); d != 3 {
+		t.Fatalf("Expected distance 3, got %d", d)
+	}
+	cases := map[string]string{
+		"!pign":   "!ping",
+		"!qoute":  "!quote",
+		"!uptim":  "!uptime",
+		"!foobar": "",
+	}
+	for cmd, expected := range cases {
+		if got := closestCommand(cmd, builtinCommands); got != expected {
+			t.Errorf("closestCommand(%q) = %q, expected %q", cmd, got, expected)
+		}
+	}
+}
+
+func TestUnknownCommand(t *testing.T) {
+	roomCfg := NewTestRoomConfig()
+	roomCfg.OnUnknownCommand = SuggestCommand
+	roomCfg.KnownCommands = []string{"!custom"}
+	roomCfg.Handlers = []string{"unknown-command"}
+	room, th := NewTestHarnessWithConfig(t, roomCfg)
+	defer room.db.Close()
+	defer room.Stop()
+	go room.Run()
+	th.SendSendEvent("!pnig", "", "a")
+	th.AssertReceivedSendText("Unknown command !pnig. Did you mean !ping?")
+	th.SendSendEvent("!ping", "", "a")
+	th.SendSendEvent("!custom", "", "a")
+	th.SendSendEvent("!completelyunrelated", "", "a")
+	th.SendSendEvent("not a command", "", "a")
+	th.AssertNoPacket()
+}
+
+func TestSanitizeContent(t *testing.T) {
+	cases := map[string]string{
+		"ad\u200bmin":            "admin",
+		"\u202enimda":            "nimda",
+		"a\u200d\ufeffb\x00\x1b": "ab",
+		"two\nlines\tok":         "two\nlines\tok",
+		"héllo wörld":            "héllo wörld",
+	}
+	for in, expected := range cases {
+		if got := SanitizeContent(in); got != expected {
+			t.Errorf("SanitizeContent(%q) = %q, expected %q", in, got, expected)
+		}
+	}
+
+	roomCfg := NewTestRoomConfig()
+	roomCfg.Dictionary = FakeDictionary{"bot": "A program \u202ethat chats."}
+	room, th := NewTestHarnessWithConfig(t, roomCfg)
+	defer room.db.Close()
+	defer room.Stop()
+	go room.Run()
+	th.SendNickEvent("spoof\u202e", "ad\u200bmin")
+	th.AssertReceivedSendText("< spoof is now known as admin. >")
+	th.SendSendEvent("!define xy\u200bzzy", "", "test")
+	th.AssertReceivedSendText("No definition found for xyzzy.")
+	th.SendSendEvent("!define bot", "", "test")
+	th.AssertReceivedSendText("bot: A program that chats.")
+	th.SendSendEvent("!remind me in 100ms to check \u202ethe oven", "", "te\u200bst")
+	th.AssertReceivedSendPrefix("Reminder set for")
+	th.AssertReceivedSendText("@test reminder: check the oven")
+}
+
+func TestLinkTitleSuppression(t *testing.T) {
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		fmt.Fprint(w, "<html><head><title>Repeated</title></head></html>")
+	}))
+	defer server.Close()
+	roomCfg := NewTestRoomConfig()
+	roomCfg.LinkTitleWindow = time.Duration(500) * time.Millisecond
+	room, th := NewTestHarnessWithConfig(t, roomCfg)
+	defer room.db.Close()
+	defer room.Stop()
+	go room.Run()
+	th.SendSendEvent(server.URL+"/same", "", "a")
+	th.AssertReceivedSendText("Link title: Repeated")
+	th.SendSendEvent("look: "+server.URL+"/same", "", "b")
+	th.AssertNoPacket()
+	// After the window the title is posted again, but from the cache.
+	time.Sleep(time.Duration(300) * time.Millisecond)
+	th.SendSendEvent(server.URL+"/same", "", "c")
+	th.AssertReceivedSendText("Link title: Repeated")
+	if n := atomic.LoadInt32(&hits); n != 1 {
+		t.Fatalf("Expected one fetch, got %d", n)
+	}
+}
+
+func TestTitleCacheExpire(t *testing.T) {
+	cache := newTitleCache(time.Duration(10)*time.Second, time.Duration(5)*time.Second)
+	start := time.Unix(1000, 0)
+	cache.store("u", "T", start)
+	if !cache.claimPost("u", start) || cache.claimPost("u", start.Add(time.Duration(4)*time.Second)) {
+		t.Fatal("Title was not claimed once within the window.")
+	}
+	if title, ok := cache.title("u", start.Add(time.Duration(9)*time.Second)); !ok || title != "T" {
+		t.Fatal("Title was not cached within the ttl.")
+	}
+	if cache.recentlyPosted("u", start.Add(time.Duration(5)*time.Second)) {
+		t.Fatal("Title was suppressed after the window.")
+	}
+	cache.expire(start.Add(time.Duration(10) * time.Second))
+	if len(cache.entries) != 0 {
+		t.Fatal("Expired entry was not removed.")
+	}
+}
+
+type fakeSecretProvider map[string]string
+
+func (p fakeSecretProvider) Passcode(room string) (string, error) {
+	return p[room], nil
+}
+
+// lockedBuffer is a bytes.Buffer that may be read while a logger writes it.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestSecretProvider(t *testing.T) {
+	roomCfg := NewTestRoomConfig()
+	roomCfg.Password = ""
+	roomCfg.Secrets = fakeSecretProvider{"test": "from-provider"}
+	room, th := NewTestHarnessWithConfig(t, roomCfg)
+	defer room.db.Close()
+	defer room.Stop()
+	var logs lockedBuffer
+	room.Logger.Out = &logs
+	room.Logger.Level = logrus.DebugLevel
+	go room.Run()
+	errs := make(chan error)
+	go func() { errs <- room.Authenticate() }()
+	packet := <-*th.outbound
+	var cmd AuthCommand
+	json.Unmarshal(packet.Data, &cmd)
+	if packet.Type != AuthType || cmd.Passcode != "from-provider" {
+		t.Fatalf("Expected the provider's passcode, got %s %s", packet.Type, packet.Data)
+	}
+	*th.inbound <- &PacketEvent{ID: packet.ID, Type: AuthReplyType, Data: json.RawMessage(`{"success":true}`)}
+	if err := <-errs; err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	go func() { errs <- room.Authenticate() }()
+	packet = <-*th.outbound
+	*th.inbound <- &PacketEvent{ID: packet.ID, Type: AuthReplyType, Data: json.RawMessage(`{"success":false,"reason":"bad"}`)}
+	if err := <-errs; err == nil {
+		t.Fatal("Expected an error from a rejected passcode.")
+	}
+	if s := fmt.Sprint(cmd); strings.Contains(s, "from-provider") {
+		t.Fatalf("Passcode is not redacted when formatted: %s", s)
+	}
+	if strings.Contains(logs.String(), "from-provider") {
+		t.Fatal("Passcode was logged.")
+	}
+
+	room.config.Secrets = fakeSecretProvider{}
+	if err := room.Authenticate(); err != ErrAuthRequired {
+		t.Fatalf("Expected ErrAuthRequired, got %v", err)
+	}
+}
+
+func TestEnvSecretProvider(t *testing.T) {
+	os.Setenv("MAIMAI_PASSCODE_MY_ROOM", "env-passcode")
+	defer os.Unsetenv("MAIMAI_PASSCODE_MY_ROOM")
+	p := EnvSecretProvider{}
+	if passcode, _ := p.Passcode("my-room"); passcode != "env-passcode" {
+		t.Fatalf("Expected env-passcode, got %q", passcode)
+	}
+	os.Setenv("MAIMAI_PASSCODE", "shared")
+	defer os.Unsetenv("MAIMAI_PASSCODE")
+	if passcode, _ := p.Passcode("other"); passcode != "" {
+		t.Fatalf("Expected no passcode for another room, got %q", passcode)
+	}
+}
+
+func TestExtractEmotes(t *testing.T) {
+	emotes := extractEmotes("nice :+1: :heart::HEART: 10:30 12:30:45 :not an emote: :-1: :100:")
+	expected := []string{":+1:", ":heart:", ":heart:", ":-1:", ":100:"}
+	if strings.Join(emotes, " ") != strings.Join(expected, " ") {
+		t.Fatalf("Expected %v, got %v", expected, emotes)
+	}
+}
+
+func TestEmoteStats(t *testing.T) {
+	room, th := NewTestHarness(t)
+	defer room.db.Close()
+	defer room.Stop()
+	// test.db persists between runs, so start from no tallies.
+	room.db.Update(func(tx *bolt.Tx) error {
+		tx.Bucket([]byte("Emotes")).DeleteBucket([]byte(room.name))
+		return nil
+	})
+	go room.Run()
+	th.SendSendEvent("!emotestats", "", "a")
+	th.AssertReceivedSendText("No emotes have been used yet.")
+	th.SendSendEvent(":heart: :+1:", "", "a")
+	th.SendSendEvent(":+1: :+1:", "", "b")
+	th.SendSendEvent("just :tada:", "", "c")
+	th.SendSendEvent("!emotestats", "", "a")
+	th.AssertReceivedSendText("Top emotes: :+1: 3, :heart: 1, :tada: 1")
+}
+
+func TestRequest(t *testing.T) {
+	room, th := NewTestHarness(t)
+	defer room.db.Close()
+	defer room.Stop()
+	go room.Run()
+	type result struct {
+		reply *PacketEvent
+		err   error
+	}
+	results := make(chan result)
+	go func() {
+		reply, err := room.request(PingType, PingCommand{UnixTime: 1}, time.Second)
+		results <- result{reply, err}
+	}()
+	packet := <-*th.outbound
+	// A reply with another ID is not correlated with the request.
+	*th.inbound <- &PacketEvent{ID: packet.ID + "0", Type: PingReplyType, Data: json.RawMessage(`{"time":2}`)}
+	*th.inbound <- &PacketEvent{ID: packet.ID, Type: PingReplyType, Data: json.RawMessage(`{"time":1}`)}
+	r := <-results
+	if r.err != nil || r.reply.ID != packet.ID || string(r.reply.Data) != `{"time":1}` {
+		t.Fatalf("Incorrect reply: %+v (%v)", r.reply, r.err)
+	}
+
+	start := time.Now()
+	go func() {
+		reply, err := room.request(PingType, PingCommand{}, time.Duration(100)*time.Millisecond)
+		results <- result{reply, err}
+	}()
+	<-*th.outbound
+	if r := <-results; r.err != ErrReplyTimeout || time.Since(start) > replyTimeout {
+		t.Fatalf("Expected a prompt ErrReplyTimeout, got %v", r.err)
+	}
+	room.data.Lock()
+	pending := len(room.data.pending)
+	room.data.Unlock()
+	if pending != 0 {
+		t.Fatalf("Expected no pending requests, got %d", pending)
+	}
+}
+
+func TestPacketIDsUnique(t *testing.T) {
+	room, th := NewTestHarness(t)
+	defer room.db.Close()
+	defer room.Stop()
+	if id := room.LastPacketID(); id != "" {
+		t.Fatalf("Expected no last packet ID, got %q", id)
+	}
+	go room.Run()
+	// Sends before the room connects are dropped once the queue is full.
+	WaitFor(t, func() bool { return atomic.LoadInt32(&room.connected) == 1 })
+	const n = 1000
+	done := make(chan bool)
+	go func() {
+		ids := make(map[string]bool)
+		for i := 0; i < n; i++ {
+			ids[(<-*th.outbound).ID] = true
+		}
+		if len(ids) != n {
+			t.Errorf("Expected %d distinct IDs, got %d", n, len(ids))
+		}
+		done <- true
+	}()
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			room.RawSend(PingType, PingCommand{})
+		}()
+	}
+	wg.Wait()
+	<-done
+	if id := room.LastPacketID(); id != fmt.Sprint(n-1) {
+		t.Fatalf("Expected last packet ID %d, got %q", n-1, id)
+	}
+}
+
+func TestSendBeforeConnect(t *testing.T) {
+	room, th := NewTestHarness(t)
+	defer room.db.Close()
+	defer room.Stop()
+	for i := 0; i < outboundSize; i++ {
+		if _, err := room.RawSend(SendType, SendCommand{Content: fmt.Sprint(i)}); err != nil {
+			t.Fatalf("Send %d before connecting failed: %s", i, err)
+		}
+	}
+	if _, err := room.RawSend(SendType, SendCommand{Content: "overflow"}); err != ErrNotConnected {
+		t.Fatalf("Expected ErrNotConnected, got %v", err)
+	}
+	go room.Run()
+	for i := 0; i < outboundSize; i++ {
+		th.AssertReceivedSendText(fmt.Sprint(i))
+	}
+	room.SendText("after", "")
+	th.AssertReceivedSendText("after")
+}
+
+func TestPollTally(t *testing.T) {
+	p := parsePoll(ParseArgs(`!poll "Best fruit?" apple | banana split | cherry`))
+	if p == nil || p.question != "Best fruit?" || strings.Join(p.options, ",") != "apple,banana split,cherry" {
+		t.Fatalf("Incorrectly parsed poll: %+v", p)
+	}
+	for _, bad := range []string{`!poll`, `!poll "Q?"`, `!poll "Q?" only`, `!poll "Q?" a |`} {
+		if parsePoll(ParseArgs(bad)) != nil {
+			t.Errorf("Parsed invalid poll %q", bad)
+		}
+	}
+	p.vote("agent:a", 1)
+	p.vote("agent:b", 1)
+	p.vote("agent:a", 3)
+	if p.vote("agent:c", 4) || p.vote("agent:c", 0) {
+		t.Fatal("Accepted a vote for a nonexistent option.")
+	}
+	if tally := fmt.Sprint(p.tally()); tally != "[1 0 1]" {
+		t.Fatalf("Expected [1 0 1], got %s", tally)
+	}
+}
+
+func TestPollCommand(t *testing.T) {
+	roomCfg := NewTestRoomConfig()
+	roomCfg.PollDuration = time.Duration(500) * time.Millisecond
+	roomCfg.Handlers = []string{"poll"}
+	room, th := NewTestHarnessWithConfig(t, roomCfg)
+	defer room.db.Close()
+	defer room.Stop()
+	go room.Run()
+	th.SendSendEvent("!vote 1", "", "a")
+	th.AssertReceivedSendText("There is no poll running.")
+	th.SendSendEvent(`!poll "Lunch?" pizza | tacos`, "", "a")
+	th.AssertReceivedSendText("Poll: Lunch?\n1. pizza\n2. tacos\nVote with !vote <number>.")
+	th.SendSendEvent(`!poll "Again?" a | b`, "", "b")
+	th.AssertReceivedSendText("A poll is already running.")
+	th.SendSendEventFrom("!vote 1", "", User{ID: "agent:a", Name: "a"})
+	th.SendSendEventFrom("!vote 2", "", User{ID: "agent:b", Name: "b"})
+	th.SendSendEventFrom("!vote 2", "", User{ID: "agent:a", Name: "a renamed"})
+	th.SendSendEventFrom("!vote 9", "", User{ID: "agent:c", Name: "c"})
+	th.AssertReceivedSendText(voteUsage)
+	th.AssertReceivedSendText("Poll results: Lunch?\n1. pizza: 0\n2. tacos: 2")
+}
+
+type customEvent struct {
+	Score int    `json:"score"`
+	Who   string `json:"who"`
+}
+
+func TestRegisterPacketType(t *testing.T) {
+	const customEventType = "x-custom-event"
+	packet := &PacketEvent{Type: customEventType, Data: json.RawMessage(`{"score":3,"who":"a"}`)}
+	if _, err := packet.Payload(); err == nil {
+		t.Fatal("Unregistered type was unmarshalled.")
+	}
+	RegisterPacketType(customEventType, func() interface{} { return &customEvent{} })
+	payload, err := packet.Payload()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	data, ok := payload.(*customEvent)
+	if !ok || data.Score != 3 || data.Who != "a" {
+		t.Fatalf("Incorrect payload: %#v", payload)
+	}
+	out, err := MakePacket("9", customEventType, data)
+	if err != nil || string(out.Data) != string(packet.Data) {
+		t.Fatalf("Payload did not round-trip: %s (%v)", out.Data, err)
+	}
+}
+
+func TestTimezoneCommand(t *testing.T) {
+	room, th := NewTestHarness(t)
+	defer room.db.Close()
+	defer room.Stop()
+	user := User{ID: "agent:tz-test", Name: "tz"}
+	if err := room.storeTimezone(&user, ""); err != nil {
+		t.Fatal(err)
+	}
+	go room.Run()
+	th.SendSendEventFrom("!tz", "", user)
+	th.AssertReceivedSendText("You have not set a timezone, so UTC is used.")
+	th.SendSendEventFrom("!tz set Not/A_Zone", "", user)
+	th.AssertReceivedSendPrefix("Unknown timezone Not/A_Zone.")
+	th.SendSendEventFrom("!tz set Local", "", user)
+	th.AssertReceivedSendPrefix("Unknown timezone Local.")
+	th.SendSendEventFrom("!tz set America/New_York", "", user)
+	th.AssertReceivedSendText("Timezone set to America/New_York.")
+	th.SendSendEventFrom("!tz", "", user)
+	th.AssertReceivedSendText("Your timezone is America/New_York.")
+	// Another user with the same nick does not share the preference.
+	th.SendSendEventFrom("!tz", "", User{ID: "agent:other", Name: "tz"})
+	th.AssertReceivedSendText("You have not set a timezone, so UTC is used.")
+	th.SendSendEventFrom("!time", "", user)
+	if text := th.ReceiveSendText(); !strings.HasSuffix(text, " in America/New_York.") {
+		t.Fatalf("!time did not use the preference: %s", text)
+	}
+	loc, err := room.UserLocation(&user)
+	if err != nil || loc.String() != "America/New_York" {
+		t.Fatalf("Incorrect location %v (%v)", loc, err)
+	}
+	reminder, err := parseReminderIn("!remind me at 2015-10-01 09:00 to x", time.Now(), loc)
+	if err != nil || time.Unix(0, reminder.Due).UTC().Hour() != 13 {
+		t.Fatalf("Reminder time was not interpreted in the user's zone: %+v (%v)", reminder, err)
+	}
+	th.SendSendEventFrom("!tz clear", "", user)
+	th.AssertReceivedSendText("Timezone cleared, UTC will be used.")
+}
+
+func TestInterceptors(t *testing.T) {
+	room, th := NewTestHarness(t)
+	defer room.db.Close()
+	defer room.Stop()
+	var mu sync.Mutex
+	var order []string
+	record := func(name string, consume bool) Interceptor {
+		return func(room *Room, packet *PacketEvent) bool {
+			if packet.Type != SendEventType {
+				return false
+			}
+			mu.Lock()
+			order = append(order, name)
+			mu.Unlock()
+			return consume && GetMessagePayload(packet).Sender.Name == "spammer"
+		}
+	}
+	room.AddInterceptor("low", 1, record("low", false))
+	room.AddInterceptor("moderation", 10, record("moderation", true))
+	room.AddInterceptor("middle", 5, record("middle", false))
+	if err := room.AddInterceptor("middle", 5, record("middle", false)); err == nil {
+		t.Fatal("Registered a duplicate interceptor.")
+	}
+	go room.Run()
+	th.SendSendEvent("!ping", "", "spammer")
+	th.AssertNoPacket()
+	th.SendSendEvent("!ping", "", "someone")
+	th.AssertReceivedSendText("pong!")
+	mu.Lock()
+	got := strings.Join(order, ",")
+	mu.Unlock()
+	if got != "moderation,moderation,middle,low" {
+		t.Fatalf("Incorrect interceptor order: %s", got)
+	}
+	if err := room.RemoveInterceptor("moderation"); err != nil {
+		t.Fatal(err)
+	}
+	th.SendSendEvent("!ping", "", "spammer")
+	th.AssertReceivedSendText("pong!")
+}
+
+func TestSeenHereNow(t *testing.T) {
+	room, th := NewTestHarness(t)
+	defer room.db.Close()
+	defer room.Stop()
+	if err := room.StoreSeen("Present", time.Now().Add(-5*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := room.StoreSeen("Absent", time.Now().Add(-5*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	go room.Run()
+	th.SendSnapshotEvent(SnapshotEvent{SessionID: "self", Listing: []PresenceEvent{
+		{User: &User{ID: "agent:p", Name: "Present"}, SessionID: "s1"}}})
+	th.SendSendEvent("!seen @Present", "", "a")
+	th.AssertReceivedSendText("Present is here now.")
+	th.SendSendEvent("!seen @Absent", "", "a")
+	th.AssertReceivedSendText("Seen 5 hours ago.")
+}
+
+func TestStoreUnavailable(t *testing.T) {
+	roomCfg := NewTestRoomConfig()
+	roomCfg.Handlers = []string{"seen"}
+	room, th := NewTestHarnessWithConfig(t, roomCfg)
+	defer room.db.Close()
+	defer room.Stop()
+	attempts := 0
+	err := room.retryStore("test", func() error {
+		attempts++
+		if attempts <= 2 {
+			return errors.New("database is locked")
+		}
+		return nil
+	})
+	if err != nil || attempts != 3 {
+		t.Fatalf("Expected success on the third attempt, got %v after %d", err, attempts)
+	}
+	attempts = 0
+	if err := room.retryStore("test", func() error {
+		attempts++
+		return errors.New("disk full")
+	}); err == nil || attempts != storeAttempts {
+		t.Fatalf("Expected to give up after %d attempts, got %v after %d", storeAttempts, err, attempts)
+	}
+	if err := room.StoreSeen("Recovered", time.Now().Add(-2*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	go room.Run()
+	WaitFor(t, func() bool { return atomic.LoadInt32(&room.connected) == 1 })
+	th.SendSendEvent("!seen @Recovered", "", "test")
+	th.AssertReceivedSendText("Seen 2 hours ago.")
+	// Once the store fails, !seen says so rather than stopping the handler,
+	// which goes on answering.
+	room.db.Close()
+	for i := 0; i < 2; i++ {
+		th.SendSendEvent("!seen @Recovered", "", "test")
+		th.AssertReceivedSendText("Sorry, that is temporarily unavailable.")
+	}
+}
+
+func TestSeenUsesMessageTime(t *testing.T) {
+	room, th := NewTestHarness(t)
+	defer room.db.Close()
+	defer room.Stop()
+	if err := room.storeSeen("ServerTime", 0); err != nil {
+		t.Fatal(err)
+	}
+	go room.Run()
+	sent := time.Now().Add(-time.Duration(3) * time.Hour).Unix()
+	th.SendMessage(Message{Time: sent, Content: "hello", Sender: User{Name: "Server Time"}})
+	WaitFor(t, func() bool {
+		seen, err := room.LastSeen("ServerTime")
+		return err == nil && seen.Unix() == sent
+	})
+	th.SendSendEvent("!seen @ServerTime", "", "a")
+	th.AssertReceivedSendText("Seen 3 hours ago.")
+}
+
+func TestSeenFlushInterval(t *testing.T) {
+	roomCfg := NewTestRoomConfig()
+	roomCfg.Handlers = []string{"seen-record"}
+	roomCfg.SeenFlushInterval = time.Hour
+	room, th := NewTestHarnessWithConfig(t, roomCfg)
+	defer room.db.Close()
+	go room.Run()
+	const updates = 50
+	before := room.db.Stats().TxStats.Write
+	for i := 1; i <= updates; i++ {
+		th.SendMessage(Message{Time: int64(i), Content: "hello", Sender: User{Name: "Rapid Fire"}})
+	}
+	WaitFor(t, func() bool {
+		seen, err := room.LastSeen("RapidFire")
+		return err == nil && seen.Unix() == updates
+	})
+	if writes := room.db.Stats().TxStats.Write - before; writes != 0 {
+		t.Fatalf("Expected no writes before the flush, got %d", writes)
+	}
+	room.Stop()
+	if writes := room.db.Stats().TxStats.Write - before; writes == 0 || writes >= updates {
+		t.Fatalf("Expected far fewer than %d writes, got %d", updates, writes)
+	}
+	room.data.Lock()
+	pending := len(room.data.pendingSeen)
+	room.data.Unlock()
+	if pending != 0 {
+		t.Fatalf("Expected the seen records to be flushed on shutdown, %d are pending", pending)
+	}
+	if seen, err := room.LastSeen("RapidFire"); err != nil || seen.Unix() != updates {
+		t.Fatalf("Expected seen at %d, got %d (%v)", updates, seen.Unix(), err)
+	}
+	// A later record backfilled meanwhile is not reverted by the flush.
+	room.batchSeen("Backfilled", 5)
+	if err := room.backfillSeen([]Message{{Time: 10, Sender: User{Name: "Backfilled"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := room.flushSeen(); err != nil {
+		t.Fatal(err)
+	}
+	if seen, err := room.LastSeen("Backfilled"); err != nil || seen.Unix() != 10 {
+		t.Fatalf("Expected the backfilled time 10 to be kept, got %d (%v)", seen.Unix(), err)
+	}
+	room.batchSeen("Late", 1)
+	room.db.Close()
+	if err := room.flushSeen(); err == nil {
+		t.Fatal("Expected flushing to a closed store to fail.")
+	}
+	if seen, _ := room.pendingSeenTime("Late"); seen != 1 {
+		t.Fatal("Seen record was dropped by a failed flush.")
+	}
+}
+
+func TestSendInThread(t *testing.T) {
+	room, th := NewTestHarness(t)
+	defer room.db.Close()
+	defer room.Stop()
+	go room.Run()
+	for _, msg := range []Message{{ID: "top", Parent: ""}, {ID: "reply", Parent: "thread"}} {
+		room.SendInThread(&msg, "sibling")
+		packet := <-*th.outbound
+		var cmd SendCommand
+		json.Unmarshal(packet.Data, &cmd)
+		if cmd.Content != "sibling" || cmd.Parent != msg.Parent {
+			t.Fatalf("Expected a reply with parent %q, got %+v", msg.Parent, cmd)
+		}
+	}
+}
+
+func TestGameStats(t *testing.T) {
+	room, th := NewTestHarness(t)
+	defer room.db.Close()
+	defer room.Stop()
+	// test.db persists between runs, so start from no stats.
+	room.db.Update(func(tx *bolt.Tx) error {
+		tx.Bucket([]byte("GameStats")).DeleteBucket([]byte(room.name))
+		return nil
+	})
+	alice, bob := User{ID: "agent:alice", Name: "alice"}, User{ID: "agent:bob", Name: "bob"}
+	for _, r := range []GameResult{
+		{Game: "roll", User: alice, Score: 3},
+		{Game: "roll", User: alice, Score: 6},
+		{Game: "roll", User: alice, Score: 2},
+		{Game: "roll", User: bob, Score: 6},
+		{Game: "other", User: bob, Score: 100},
+	} {
+		if err := room.recordGameResult(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	board, err := room.leaderboard("roll", maxLeaderboardEntries)
+	if err != nil || len(board) != 2 {
+		t.Fatalf("Incorrect leaderboard: %+v (%v)", board, err)
+	}
+	if board[0] != (GameStats{Name: "alice", Plays: 3, Best: 6, Total: 11}) ||
+		board[1] != (GameStats{Name: "bob", Plays: 1, Best: 6, Total: 6}) {
+		t.Fatalf("Incorrect stats: %+v", board)
+	}
+
+	go room.Run()
+	th.SendSendEvent("!leaderboard flip", "", "a")
+	th.AssertReceivedSendText("No one has played flip yet.")
+	th.SendSendEventFrom("!flip", "", alice)
+	result := th.ReceiveSendText()
+	WaitFor(t, func() bool {
+		board, err = room.leaderboard("flip", maxLeaderboardEntries)
+		return err == nil && len(board) == 1
+	})
+	if heads := board[0].Total == 1; board[0].Plays != 1 || heads != (result == "heads") {
+		t.Fatalf("Recorded %+v for %s", board[0], result)
+	}
+	th.SendSendEvent("!leaderboard !flip", "", "a")
+	th.AssertReceivedSendPrefix("Leaderboard for flip:\n1. alice: best ")
+	// An actual !roll reaches the stats.
+	carol := User{ID: "agent:carol-roller", Name: "carol"}
+	th.SendSendEventFrom("!roll 1d1000", "", carol)
+	result = th.ReceiveSendText()
+	WaitFor(t, func() bool {
+		board, err = room.leaderboard("roll", maxLeaderboardEntries)
+		return err == nil && len(board) == 3
+	})
+	var rolled GameStats
+	for _, stats := range board {
+		if stats.Name == "carol" {
+			rolled = stats
+		}
+	}
+	if rolled.Plays != 1 || !strings.HasSuffix(result, fmt.Sprintf("= %d", rolled.Total)) {
+		t.Fatalf("Recorded %+v for %s", rolled, result)
+	}
+}
+
+func TestEventBus(t *testing.T) {
+	room, th := NewTestHarness(t)
+	defer room.db.Close()
+	defer room.Stop()
+	ready := make(chan bool)
+	room.AddHandler("publisher", func(room *Room, input chan PacketEvent, cmdChan chan string) {
+		for {
+			select {
+			case packet := <-input:
+				if packet.Type == SendEventType {
+					room.Publish("greeting", GetMessagePayload(&packet).Content)
+				}
+			case <-cmdChan:
+				return
+			}
+		}
+	})
+	room.AddHandler("subscriber", func(room *Room, input chan PacketEvent, cmdChan chan string) {
+		greetings := room.Subscribe("greeting")
+		defer room.Unsubscribe("greeting", greetings)
+		ready <- true
+		for {
+			select {
+			case v := <-greetings:
+				room.SendText("heard "+v.(string), "")
+			case <-input:
+			case <-cmdChan:
+				return
+			}
+		}
+	})
+	go room.Run()
+	<-ready
+	th.SendSendEvent("hello", "", "a")
+	th.AssertReceivedSendText("heard hello")
+
+	// Publishing never blocks, even for a subscriber that does not read.
+	stuck := room.Subscribe("stuck")
+	for i := 0; i < subscriptionSize+5; i++ {
+		room.Publish("stuck", i)
+	}
+	if len(stuck) != subscriptionSize {
+		t.Fatalf("Expected %d buffered events, got %d", subscriptionSize, len(stuck))
+	}
+	room.Unsubscribe("stuck", stuck)
+	room.Publish("stuck", "after")
+	if len(stuck) != subscriptionSize {
+		t.Fatal("Received an event after unsubscribing.")
+	}
+}
+
+func TestInvalidUTF8(t *testing.T) {
+	cases := map[string]string{
+		"ok":            "ok",
+		"a\xffb":        "a�b",
+		"trunc\xe2\x82": "trunc��",
+		"né\xc3":        "né�",
+	}
+	for in, expected := range cases {
+		if got := ValidUTF8(in); got != expected {
+			t.Errorf("ValidUTF8(%q) = %q, expected %q", in, got, expected)
+		}
+		if got := SanitizeContent(in); !utf8.ValidString(got) {
+			t.Errorf("SanitizeContent(%q) = %q is not valid UTF-8", in, got)
+		}
+	}
+	_, logged := prepareMsgLogEvent(&Message{Content: "bad \xff", Sender: User{Name: "n\xc3"}})
+	if logged.Content != "bad �" || logged.UserName != "n�" {
+		t.Fatalf("Logged invalid UTF-8: %q %q", logged.Content, logged.UserName)
+	}
+
+	room, th := NewTestHarness(t)
+	defer room.db.Close()
+	defer room.Stop()
+	go room.Run()
+	room.SendText("echo \xff\xfe", "")
+	packet := <-*th.outbound
+	if !utf8.Valid(packet.Data) || !strings.Contains(string(packet.Data), "echo ��") {
+		t.Fatalf("Sent invalid content: %q", packet.Data)
+	}
+}
+
+func TestSendTextf(t *testing.T) {
+	room, th := NewTestHarness(t)
+	defer room.db.Close()
+	defer room.Stop()
+	go room.Run()
+	args := []interface{}{7, "quo\u200bte", []string{"x"}}
+	room.SendTextf("p1", "#%d: %s (%v)", args...)
+	packet := <-*th.outbound
+	var cmd SendCommand
+	json.Unmarshal(packet.Data, &cmd)
+	if cmd.Content != "#7: quote ([x])" || cmd.Parent != "p1" {
+		t.Fatalf("Incorrect message: %+v", cmd)
+	}
+	if args[1] != "quo\u200bte" {
+		t.Fatalf("Caller's args were modified: %q", args[1])
+	}
+}
+
+func TestRequestFromBusyHandler(t *testing.T) {
+	roomCfg := NewTestRoomConfig()
+	roomCfg.Handlers = []string{}
+	room, th := NewTestHarnessWithConfig(t, roomCfg)
+	defer room.db.Close()
+	defer room.Stop()
+	room.AddHandler("asker", func(room *Room, input chan PacketEvent, cmdChan chan string) {
+		for {
+			select {
+			case packet := <-input:
+				if packet.Type != SendEventType || GetMessagePayload(&packet).Content != "!ask" {
+					continue
+				}
+				if _, err := room.request(GetMessageType, GetMessageCommand{ID: "m"}, 0); err != nil {
+					room.SendText("failed: "+err.Error(), "")
+					continue
+				}
+				room.SendText("answered", "")
+			case cmd := <-cmdChan:
+				if cmd == "kill" {
+					return
+				}
+			}
+		}
+	})
+	go room.Run()
+	th.SendSendEvent("!ask", "", "test")
+	packet := <-*th.outbound
+	// More events than the handler's input holds arrive before the reply,
+	// which must still reach the handler waiting for it.
+	for i := 0; i < 20; i++ {
+		th.SendSendEvent("chatter", "", "test")
+	}
+	*th.inbound <- &PacketEvent{ID: packet.ID, Type: GetMessageReplyType,
+		Data: json.RawMessage(`{"id":"m","content":"hi"}`)}
+	select {
+	case packet := <-*th.outbound:
+		var cmd SendCommand
+		json.Unmarshal(packet.Data, &cmd)
+		if cmd.Content != "answered" {
+			t.Fatalf("Unexpected reply: %s", cmd.Content)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timeout: the reply was not delivered to the busy handler.")
+	}
+}
+
+func TestServerRejected(t *testing.T) {
+	roomCfg := NewTestRoomConfig()
+	roomCfg.ConfirmSends = true
+	roomCfg.Handlers = []string{}
+	room, th := NewTestHarnessWithConfig(t, roomCfg)
+	defer room.db.Close()
+	defer room.Stop()
+	go room.Run()
+	errs := make(chan error)
+	go func() { errs <- room.SendText("way too long", "") }()
+	packet := <-*th.outbound
+	*th.inbound <- &PacketEvent{ID: packet.ID, Type: SendReplyType, Error: "message too long"}
+	err := <-errs
+	rejected, ok := err.(ErrServerRejected)
+	if !ok || rejected.Reason != "message too long" || rejected.Type != SendType {
+		t.Fatalf("Expected ErrServerRejected, got %#v", err)
+	}
+	go func() { errs <- room.SendText("fine", "") }()
+	packet = <-*th.outbound
+	*th.inbound <- &PacketEvent{ID: packet.ID, Type: SendReplyType, Data: json.RawMessage(`{"id":"m","content":"fine"}`)}
+	if err := <-errs; err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	// A handler waiting for confirmation in a busy room still gets it.
+	room.AddHandler("ping", PingCommandHandler)
+	th.SendSendEvent("!ping", "", "test")
+	packet = <-*th.outbound
+	for i := 0; i < 20; i++ {
+		th.SendSendEvent("chatter", "", "test")
+	}
+	*th.inbound <- &PacketEvent{ID: packet.ID, Type: SendReplyType, Data: json.RawMessage(`{"id":"p","content":"pong!"}`)}
+	th.SendSendEvent("!ping", "", "test")
+	select {
+	case packet = <-*th.outbound:
+		*th.inbound <- &PacketEvent{ID: packet.ID, Type: SendReplyType, Data: json.RawMessage(`{"id":"q","content":"pong!"}`)}
+	case <-time.After(time.Second):
+		t.Fatal("Timeout: the confirming handler stalled.")
+	}
+	WaitFor(t, func() bool {
+		room.data.Lock()
+		defer room.data.Unlock()
+		return len(room.data.pending) == 0
+	})
+	room.SetReadOnly(true)
+	if err := room.SendText("quiet", ""); err != ErrReadOnly {
+		t.Fatalf("Expected ErrReadOnly, got %v", err)
+	}
+}
+
+func TestQuietHours(t *testing.T) {
+	room, th := NewTestHarness(t)
+	defer room.db.Close()
+	defer room.Stop()
+	clock := func(h, m int) time.Time { return time.Date(2015, 10, 1, h, m, 0, 0, time.UTC) }
+	room.SetQuietHours(clock(22, 0), clock(7, 0), time.UTC)
+	for at, quiet := range map[time.Time]bool{
+		clock(21, 59): false,
+		clock(22, 0):  true,
+		clock(2, 30):  true,
+		clock(6, 59):  true,
+		clock(7, 0):   false,
+		clock(12, 0):  false,
+	} {
+		if room.IsQuiet(at) != quiet {
+			t.Errorf("IsQuiet(%s) = %v, expected %v", at.Format("15:04"), !quiet, quiet)
+		}
+	}
+	ny, _ := time.LoadLocation("America/New_York")
+	nyClock := func(h, m int) time.Time { return time.Date(2015, 10, 1, h, m, 0, 0, ny) }
+	room.SetQuietHours(nyClock(9, 0), nyClock(17, 0), ny)
+	if !room.IsQuiet(clock(14, 0)) || room.IsQuiet(clock(22, 0)) {
+		t.Error("Quiet hours were not interpreted in their location.")
+	}
+
+	go room.Run()
+	now := time.Now()
+	room.SetQuietHours(now.Add(-time.Hour), now.Add(time.Hour), nil)
+	th.SendNickEvent("quiet1", "quiet2")
+	th.AssertNoPacket()
+	th.SendSendEvent("!ping", "", "a")
+	th.AssertReceivedSendText("pong!")
+	room.SetQuietHours(now.Add(time.Hour), now.Add(2*time.Hour), nil)
+	th.SendNickEvent("quiet2", "quiet3")
+	th.AssertReceivedSendText("< quiet2 is now known as quiet3. >")
+	room.SetQuietHours(now, now, nil)
+	if room.IsQuiet(now) {
+		t.Fatal("Quiet hours were not turned off.")
+	}
+}
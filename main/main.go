@@ -17,6 +17,7 @@ var dbPath string
 var password string
 var join bool
 var msgLog bool
+var configPath string
 var logger = logrus.New()
 
 func init() {
@@ -36,6 +37,7 @@ func init() {
 	flag.StringVar(&password, "pass", defaultPass, "password for the room")
 	flag.BoolVar(&join, "join", defaultJoin, "whether the bot sends join/part/nick messages")
 	flag.BoolVar(&msgLog, "msglog", defaultMsgLog, "whether the bot logs messages.")
+	flag.StringVar(&configPath, "config", "", "JSON config file; if given, flags other than -log are ignored")
 }
 
 func main() {
@@ -51,17 +53,41 @@ func main() {
 	logger.Formatter = &logrus.JSONFormatter{}
 
 	runtime.GOMAXPROCS(runtime.NumCPU() - 1)
-	roomCfg := &maimai.RoomConfig{
-		DBPath:       dbPath,
-		ErrorLogPath: logPath,
-		Join:         join,
-		MsgLog:       msgLog,
-		Nick:         nick,
-		Password:     password,
+	var room *maimai.Room
+	if configPath != "" {
+		room, err = loadConfig(configPath)
+	} else {
+		roomCfg := &maimai.RoomConfig{
+			DBPath:       dbPath,
+			ErrorLogPath: logPath,
+			Join:         join,
+			MsgLog:       msgLog,
+			Nick:         nick,
+			Password:     password,
+		}
+		room, err = maimai.NewRoom(roomCfg, roomName, maimai.NewWSSenderReceiver(roomName, logger), logger)
 	}
-	room, err := maimai.NewRoom(roomCfg, roomName, maimai.NewWSSenderReceiver(roomName, logger), logger)
 	if err != nil {
 		panic(err)
 	}
 	room.Run()
+	if err := room.Close(); err != nil {
+		logger.Errorf("Error closing room: %s", err)
+	}
+}
+
+func loadConfig(path string) (*maimai.Room, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	room, err := maimai.LoadConfig(f)
+	if err != nil {
+		return nil, err
+	}
+	room.Logger.Out = logger.Out
+	room.Logger.Level = logger.Level
+	room.Logger.Formatter = logger.Formatter
+	return room, nil
 }
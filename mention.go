@@ -0,0 +1,109 @@
+package maimai
+
+import (
+	"strings"
+	"time"
+	"unicode"
+)
+
+// mentionTerminators are the characters, besides whitespace, that end an
+// @-mention in euphoria.
+const mentionTerminators = ",.!?;&<'\""
+
+// NormalizeNick returns nick in the form used to @-mention it, without the
+// whitespace and punctuation that would end the mention.
+func NormalizeNick(nick string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) || strings.ContainsRune(mentionTerminators, r) {
+			return -1
+		}
+		return r
+	}, nick)
+}
+
+// ReplyMention replies to msg with content prefixed by an @-mention of the
+// sender, so that it is clear who the reply is for.
+func (r *Room) ReplyMention(msg *Message, content string) {
+	r.SendText(mentionContent(msg, content), msg.ID)
+}
+
+func mentionContent(msg *Message, content string) string {
+	mention := NormalizeNick(msg.Sender.Name)
+	if mention == "" {
+		return content
+	}
+	return "@" + mention + " " + content
+}
+
+func containsCommand(cmds []string, cmd string) bool {
+	for _, c := range cmds {
+		if c == cmd {
+			return true
+		}
+	}
+	return false
+}
+
+// reply replies to msg with content, @-mentioning the sender if msg's command
+// is one of the RoomConfig's MentionReplies and threading the reply under the
+// root of msg's thread if it is one of the ThreadRootReplies.
+func (r *Room) reply(msg *Message, content string) {
+	cmd := commandOf(r.commandContent(msg.Content))
+	if containsCommand(r.config.MentionReplies, cmd) {
+		content = mentionContent(msg, content)
+	}
+	parent := msg.ID
+	if containsCommand(r.config.ThreadRootReplies, cmd) {
+		parent = r.threadRoot(msg)
+	}
+	r.SendText(content, parent)
+}
+
+// ThreadParent returns the parent for a message sent in response to msg
+// alongside it: msg's parent if msg is in a thread, so that the response joins
+// that thread, or "" to post top-level if msg is itself top-level.
+func ThreadParent(msg *Message) string {
+	return msg.Parent
+}
+
+// SendInThread sends text as a sibling of msg, in msg's thread if it has one
+// and top-level otherwise.
+func (r *Room) SendInThread(msg *Message, text string) {
+	r.SendText(text, ThreadParent(msg))
+}
+
+// maxThreadDepth bounds how many parents threadRoot will look up.
+const maxThreadDepth = 32
+
+// threadLookupTimeout bounds each get-message threadRoot falls back to, so
+// that an unanswered lookup delays the calling handler's reply only briefly.
+const threadLookupTimeout = time.Duration(2) * time.Second
+
+// threadRoot returns the ID of the root of msg's thread, walking Parent links
+// through the message log, or with get-message for parents that were not
+// logged. If a parent cannot be found, or a lookup times out, the walk stops
+// and the highest message found so far is returned.
+func (r *Room) threadRoot(msg *Message) string {
+	root, parent := msg.ID, msg.Parent
+	for i := 0; parent != "" && i < maxThreadDepth; i++ {
+		next, err := r.parentOf(parent)
+		if err != nil {
+			r.Logger.Warningf("Error resolving thread root of '%s': %s", msg.ID, err)
+			break
+		}
+		root, parent = parent, next
+	}
+	return root
+}
+
+// parentOf returns the ID of the parent of the message msgID.
+func (r *Room) parentOf(msgID string) (string, error) {
+	if logged, err := r.retrieveMsgLogEvent(msgID); err == nil && logged != nil {
+		return logged.Parent, nil
+	}
+	m, err := r.getMessage(msgID, threadLookupTimeout)
+	if err != nil {
+		return "", err
+	}
+	return m.Parent, nil
+}
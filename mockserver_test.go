@@ -0,0 +1,296 @@
+package maimai
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/websocket"
+)
+
+// mockServer is a minimal euphoria server for integration tests. It greets
+// each connection with a hello-event and a snapshot-event, requiring auth
+// first if passcode is set, and replies to ping, nick, and send commands.
+// Every packet it receives is passed to received.
+type mockServer struct {
+	*httptest.Server
+	passcode string
+	received chan *PacketEvent
+
+	mu      sync.Mutex
+	conns   []*mockConn
+	dialled int
+	msgID   int
+}
+
+type mockConn struct {
+	mu   sync.Mutex
+	conn *websocket.Conn
+	// silent is set, atomically, to stop answering websocket pings.
+	silent int32
+}
+
+func (c *mockConn) send(ID string, msgType PacketType, payload interface{}) {
+	packet, _ := MakePacket(ID, msgType, payload)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn.WriteJSON(packet)
+}
+
+func newMockServer(passcode string) *mockServer {
+	s := &mockServer{passcode: passcode, received: make(chan *PacketEvent, 64)}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// endpoint returns the server's address for WithEndpoint.
+func (s *mockServer) endpoint() string {
+	return strings.Replace(s.URL, "http://", "ws://", 1)
+}
+
+// connections returns the number of connections made so far.
+func (s *mockServer) connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dialled
+}
+
+// drop closes every open connection without a close frame, as a network
+// failure would.
+func (s *mockServer) drop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.conns {
+		c.conn.Close()
+	}
+	s.conns = nil
+}
+
+// stopPonging makes every open connection ignore websocket pings, as a
+// half-open connection would. Later connections still answer them.
+func (s *mockServer) stopPonging() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.conns {
+		atomic.StoreInt32(&c.silent, 1)
+	}
+}
+
+// broadcast sends msg to every open connection as a send-event.
+func (s *mockServer) broadcast(msg Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.conns {
+		c.send("", SendEventType, msg)
+	}
+}
+
+func (s *mockServer) nextMsgID() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.msgID++
+	return "msg" + strconv.Itoa(s.msgID)
+}
+
+func (s *mockServer) serve(w http.ResponseWriter, req *http.Request) {
+	conn, err := (&websocket.Upgrader{}).Upgrade(w, req, nil)
+	if err != nil {
+		return
+	}
+	c := &mockConn{conn: conn}
+	s.mu.Lock()
+	s.conns = append(s.conns, c)
+	s.dialled++
+	sessionID := "session" + strconv.Itoa(s.dialled)
+	s.mu.Unlock()
+	defer conn.Close()
+	conn.SetPingHandler(func(data string) error {
+		if atomic.LoadInt32(&c.silent) == 1 {
+			return nil
+		}
+		return conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+	})
+
+	self := User{ID: "bot:" + sessionID, Name: "", ServerID: "mock", ServerEra: "1"}
+	c.send("", HelloEventType, HelloEvent{ID: self.ID, Session: SessionView{User: self, SessionID: sessionID}, Version: "mock"})
+	authed := s.passcode == ""
+	if authed {
+		c.send("", SnapshotEventType, SnapshotEvent{Identity: self.ID, SessionID: sessionID, Version: "mock"})
+	} else {
+		c.send("", BounceEventType, BounceEvent{Reason: "authentication required", AuthOptions: []string{"passcode"}})
+	}
+	for {
+		var packet PacketEvent
+		if err := conn.ReadJSON(&packet); err != nil {
+			return
+		}
+		s.received <- &packet
+		payload, err := packet.Payload()
+		if err != nil {
+			c.send(packet.ID, packet.Type+"-reply", nil)
+			continue
+		}
+		switch data := payload.(type) {
+		case *AuthCommand:
+			if data.Passcode != s.passcode {
+				c.send(packet.ID, AuthReplyType, AuthReply{Success: false, Reason: "passcode incorrect"})
+				continue
+			}
+			c.send(packet.ID, AuthReplyType, AuthReply{Success: true})
+			if !authed {
+				authed = true
+				c.send("", SnapshotEventType, SnapshotEvent{Identity: self.ID, SessionID: sessionID, Version: "mock"})
+			}
+		case *PingCommand:
+			c.send(packet.ID, PingReplyType, PingReply{UnixTime: data.UnixTime})
+		case *NickCommand:
+			from := self.Name
+			self.Name = data.Name
+			c.send(packet.ID, NickReplyType, NickReply{SessionID: sessionID, ID: self.ID, From: from, To: data.Name})
+		case *SendCommand:
+			c.send(packet.ID, SendReplyType, Message{ID: s.nextMsgID(), Parent: data.Parent,
+				Time: time.Now().Unix(), Sender: self, Content: data.Content})
+		}
+	}
+}
+
+// expect returns the next packet of msgType the server receives, skipping
+// others.
+func (s *mockServer) expect(t *testing.T, msgType PacketType) *PacketEvent {
+	timeout := time.After(time.Duration(5) * time.Second)
+	for {
+		select {
+		case packet := <-s.received:
+			if packet.Type == msgType {
+				return packet
+			}
+		case <-timeout:
+			t.Fatalf("Timeout: server did not receive a %s packet.", msgType)
+		}
+	}
+}
+
+// expectAll returns the next packet of each of msgTypes the server receives,
+// in whatever order they arrive, skipping others.
+func (s *mockServer) expectAll(t *testing.T, msgTypes ...PacketType) map[PacketType]*PacketEvent {
+	got := make(map[PacketType]*PacketEvent)
+	timeout := time.After(time.Duration(5) * time.Second)
+	for len(got) < len(msgTypes) {
+		select {
+		case packet := <-s.received:
+			for _, msgType := range msgTypes {
+				if packet.Type == msgType && got[msgType] == nil {
+					got[msgType] = packet
+				}
+			}
+		case <-timeout:
+			t.Fatalf("Timeout: server did not receive all of %v.", msgTypes)
+		}
+	}
+	return got
+}
+
+func TestMockServerIntegration(t *testing.T) {
+	server := newMockServer("hunter2")
+	defer server.Close()
+	roomCfg := NewTestRoomConfig()
+	roomCfg.Password = "hunter2"
+	logger := logrus.New()
+	room, err := NewRoom(roomCfg, "test", NewWSSenderReceiver("test", logger, WithEndpoint(server.endpoint())), logger)
+	if err != nil {
+		t.Fatalf("Could not create room: %s", err)
+	}
+	go room.Run()
+
+	// Auth is sent in response to the bounce-event, so it may follow the
+	// nick.
+	packets := server.expectAll(t, AuthType, NickType)
+	auth, nick := packets[AuthType], packets[NickType]
+	var cmd AuthCommand
+	json.Unmarshal(auth.Data, &cmd)
+	if cmd.Type != "passcode" || cmd.Passcode != "hunter2" {
+		t.Fatalf("Incorrect auth command: %s", auth.Data)
+	}
+	if !strings.Contains(string(nick.Data), `"MaiMai"`) {
+		t.Fatalf("Incorrect nick command: %s", nick.Data)
+	}
+
+	server.broadcast(Message{ID: "m1", Content: "!ping", Sender: User{ID: "agent:a", Name: "alice"}})
+	reply := server.expect(t, SendType)
+	if string(reply.Data) != `{"content":"pong!","parent":"m1"}` {
+		t.Fatalf("Incorrect reply to !ping: %s", reply.Data)
+	}
+
+	server.drop()
+	server.expectAll(t, AuthType, NickType)
+	if n := server.connections(); n != 2 {
+		t.Fatalf("Incorrect number of connections. Expected 2, got %d", n)
+	}
+	if err := room.Close(); err != nil {
+		t.Fatalf("Close failed: %s", err)
+	}
+}
+
+func TestMockServerKeepalive(t *testing.T) {
+	server := newMockServer("")
+	defer server.Close()
+	logger := logrus.New()
+	ws := NewWSSenderReceiver("test", logger, WithEndpoint(server.endpoint()),
+		WithKeepalive(time.Duration(100)*time.Millisecond, time.Duration(1500)*time.Millisecond))
+	room, err := NewRoom(NewTestRoomConfig(), "test", ws, logger)
+	if err != nil {
+		t.Fatalf("Could not create room: %s", err)
+	}
+	go room.Run()
+	server.expect(t, NickType)
+
+	// Pongs keep the connection up.
+	time.Sleep(time.Duration(2) * time.Second)
+	if n := server.connections(); n != 1 {
+		t.Fatalf("Connection was dropped while ponging: %d connections", n)
+	}
+
+	server.stopPonging()
+	server.expect(t, NickType)
+	if n := server.connections(); n != 2 {
+		t.Fatalf("Incorrect number of connections. Expected 2, got %d", n)
+	}
+	if err := room.Close(); err != nil {
+		t.Fatalf("Close failed: %s", err)
+	}
+}
+
+func TestMockServerNoBounce(t *testing.T) {
+	server := newMockServer("")
+	defer server.Close()
+	roomCfg := NewTestRoomConfig()
+	roomCfg.Password = "hunter2"
+	logger := logrus.New()
+	room, err := NewRoom(roomCfg, "test", NewWSSenderReceiver("test", logger, WithEndpoint(server.endpoint())), logger)
+	if err != nil {
+		t.Fatalf("Could not create room: %s", err)
+	}
+	go room.Run()
+	// A room that doesn't ask for a passcode is never sent one.
+	timeout := time.After(time.Duration(2) * time.Second)
+	for done := false; !done; {
+		select {
+		case packet := <-server.received:
+			if packet.Type == AuthType {
+				t.Fatal("The passcode was sent without a bounce-event.")
+			}
+		case <-timeout:
+			done = true
+		}
+	}
+	if err := room.Close(); err != nil {
+		t.Fatalf("Close failed: %s", err)
+	}
+}
@@ -0,0 +1,81 @@
+package maimai
+
+import "encoding/json"
+
+// Ban bans the user with the given ID from the room for seconds, or
+// indefinitely if seconds is zero. The bot must be a manager of the room;
+// otherwise the server's error is returned.
+func (r *Room) Ban(userID string, seconds int) error {
+	data, err := r.RawSendAndWait(BanType, BanCommand{Ident: userID, Seconds: seconds})
+	if err != nil {
+		return err
+	}
+	var reply BanReply
+	if err := json.Unmarshal(data, &reply); err != nil {
+		return err
+	}
+	r.Logger.Infof("Banned %s for %d seconds", reply.Ident, reply.Seconds)
+	return nil
+}
+
+// Unban lifts a ban on the user with the given ID. The bot must be a manager
+// of the room; otherwise the server's error is returned.
+func (r *Room) Unban(userID string) error {
+	data, err := r.RawSendAndWait(UnbanType, UnbanCommand{Ident: userID})
+	if err != nil {
+		return err
+	}
+	var reply UnbanReply
+	if err := json.Unmarshal(data, &reply); err != nil {
+		return err
+	}
+	r.Logger.Infof("Unbanned %s", reply.Ident)
+	return nil
+}
+
+// editMessage sends cmd and returns the edited message.
+func (r *Room) editMessage(cmd EditMessageCommand) (*Message, error) {
+	data, err := r.RawSendAndWait(EditMessageType, cmd)
+	if err != nil {
+		return nil, err
+	}
+	var reply EditMessageReply
+	if err := json.Unmarshal(data, &reply); err != nil {
+		return nil, err
+	}
+	return &reply.Message, nil
+}
+
+// EditOption configures an edit made with EditMessage or DeleteMessage.
+type EditOption func(cmd *EditMessageCommand)
+
+// Silently makes an edit without announcing it to the room, so that clients
+// do not show it live. The change is still visible to anyone who later loads
+// the message.
+func Silently() EditOption {
+	return func(cmd *EditMessageCommand) {
+		cmd.Announce = false
+	}
+}
+
+func newEditMessageCommand(cmd EditMessageCommand, opts []EditOption) EditMessageCommand {
+	cmd.Announce = true
+	for _, opt := range opts {
+		opt(&cmd)
+	}
+	return cmd
+}
+
+// EditMessage replaces the content of the message with the given ID and,
+// unless Silently is given, announces the edit to the room, returning the
+// edited message.
+func (r *Room) EditMessage(msgID, content string, opts ...EditOption) (*Message, error) {
+	return r.editMessage(newEditMessageCommand(EditMessageCommand{ID: msgID, Content: content}, opts))
+}
+
+// DeleteMessage deletes the message with the given ID and, unless Silently
+// is given, announces the deletion to the room, returning the deleted
+// message. Deleting someone else's message requires manager privileges.
+func (r *Room) DeleteMessage(msgID string, opts ...EditOption) (*Message, error) {
+	return r.editMessage(newEditMessageCommand(EditMessageCommand{ID: msgID, Delete: true}, opts))
+}
@@ -0,0 +1,66 @@
+package maimai
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+// maxNickDistance is the largest edit distance at which ResolveNick matches
+// a nick. Shorter nicks allow at most half their length.
+const maxNickDistance = 2
+
+// seenNicks returns the nicks that have seen records.
+func (r *Room) seenNicks() ([]string, error) {
+	var nicks []string
+	err := r.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("Seen")).ForEach(func(k, v []byte) error {
+			nicks = append(nicks, string(k))
+			return nil
+		})
+	})
+	return nicks, err
+}
+
+// ResolveNick returns the nicks of present or previously seen users nearest
+// to nick, ignoring spaces and case, so that commands can forgive typos. An
+// exact match is returned alone; otherwise every nick at the smallest edit
+// distance within maxNickDistance is returned, sorted, and more than one
+// means the nick is ambiguous. Nicks are returned without spaces, as the seen
+// records store them.
+func (r *Room) ResolveNick(nick string) ([]string, error) {
+	seen, err := r.seenNicks()
+	if err != nil {
+		return nil, err
+	}
+	candidates := make(map[string]empty)
+	for _, n := range seen {
+		candidates[n] = empty{}
+	}
+	for _, user := range r.Users() {
+		candidates[strings.Replace(user.Name, " ", "", -1)] = empty{}
+	}
+	nick = strings.Replace(nick, " ", "", -1)
+	if _, ok := candidates[nick]; ok {
+		return []string{nick}, nil
+	}
+	threshold := maxNickDistance
+	if half := len([]rune(nick)) / 2; half < threshold {
+		threshold = half
+	}
+	var best []string
+	bestDist := threshold + 1
+	for candidate := range candidates {
+		d := levenshtein(strings.ToLower(nick), strings.ToLower(candidate))
+		switch {
+		case d > threshold:
+		case d < bestDist:
+			best, bestDist = []string{candidate}, d
+		case d == bestDist:
+			best = append(best, candidate)
+		}
+	}
+	sort.Strings(best)
+	return best, nil
+}
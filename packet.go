@@ -1,8 +1,14 @@
 package maimai
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
 )
 
 // PacketType indicates the type of a packet's payload.
@@ -27,6 +33,9 @@ type Message struct {
 	EncryptionKeyID string `json:"encryption_key_id,omitempty"`
 	Edited          int    `json:"edited,omitempty"`
 	Deleted         int    `json:"deleted,omitempty"`
+	// Truncated is set by the server on send-events whose content is too
+	// long to send in full; GetMessage fetches the whole message.
+	Truncated bool `json:"truncated,omitempty"`
 }
 
 // PingEvent encodes the server's information on when this ping occurred and when the next will.
@@ -35,6 +44,11 @@ type PingEvent struct {
 	Next int64 `json:"next"`
 }
 
+// PingCommand asks the server for a ping-reply, to measure round-trip time.
+type PingCommand struct {
+	UnixTime int64 `json:"time"`
+}
+
 type PingReply struct {
 	UnixTime int64 `json:"time,omitempty"`
 }
@@ -45,6 +59,72 @@ type User struct {
 	Name      string `json:"name"`
 	ServerID  string `json:"server_id"`
 	ServerEra string `json:"server_era"`
+	IsStaff   bool   `json:"is_staff,omitempty"`
+	IsManager bool   `json:"is_manager,omitempty"`
+}
+
+// AccountID returns the ID of the account the user is logged in as, or "" if
+// they are not logged in.
+func (u *User) AccountID() string {
+	if strings.HasPrefix(u.ID, "account:") {
+		return u.ID[len("account:"):]
+	}
+	return ""
+}
+
+// Timestamp returns the time the message was sent.
+func (m *Message) Timestamp() time.Time {
+	return time.Unix(m.Time, 0)
+}
+
+// IsFromManager reports whether the message was sent by a manager of the room.
+func (m *Message) IsFromManager() bool {
+	return m.Sender.IsManager
+}
+
+// IsFromStaff reports whether the message was sent by euphoria staff.
+func (m *Message) IsFromStaff() bool {
+	return m.Sender.IsStaff
+}
+
+// IsEncrypted reports whether the message's content is encrypted, in which
+// case the bot cannot read it.
+func (m *Message) IsEncrypted() bool {
+	return m.EncryptionKeyID != ""
+}
+
+// IsCommand reports whether the message is a command started by prefix, or by
+// DefaultCommandPrefix if prefix is empty.
+func (m *Message) IsCommand(prefix string) bool {
+	name, _ := m.CommandName(prefix)
+	return name != ""
+}
+
+// CommandName parses the message as a command started by prefix, or by
+// DefaultCommandPrefix if prefix is empty, returning the command's name
+// without the prefix and the rest of the message with surrounding whitespace
+// removed. Both are empty if the message is not a command.
+func (m *Message) CommandName(prefix string) (name, args string) {
+	if prefix == "" {
+		prefix = DefaultCommandPrefix
+	}
+	if !strings.HasPrefix(m.Content, prefix) {
+		return "", ""
+	}
+	rest := m.Content[len(prefix):]
+	end := strings.IndexFunc(rest, unicode.IsSpace)
+	switch {
+	case end < 0:
+		return rest, ""
+	case end == 0:
+		return "", ""
+	}
+	return rest[:end], strings.TrimSpace(rest[end:])
+}
+
+// GetMessageCommand requests the message with ID from the server.
+type GetMessageCommand struct {
+	ID string `json:"id"`
 }
 
 type SendCommand struct {
@@ -70,6 +150,54 @@ type AuthCommand struct {
 	Passcode string `json:"passcode,omitempty"`
 }
 
+// String omits the passcode so that it is never logged.
+func (c AuthCommand) String() string {
+	return fmt.Sprintf("{Type:%s Passcode:<redacted>}", c.Type)
+}
+
+type AuthReply struct {
+	Success bool   `json:"success"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// LoginCommand logs the session into an account. Its String method omits the
+// password so that it is never logged.
+type LoginCommand struct {
+	Namespace string `json:"namespace"`
+	ID        string `json:"id"`
+	Password  string `json:"password"`
+}
+
+func (c LoginCommand) String() string {
+	return fmt.Sprintf("{Namespace:%s ID:%s Password:<redacted>}", c.Namespace, c.ID)
+}
+
+type LoginReply struct {
+	Success   bool   `json:"success"`
+	Reason    string `json:"reason,omitempty"`
+	AccountID string `json:"account_id,omitempty"`
+}
+
+type LogoutCommand struct{}
+
+type LogoutReply struct{}
+
+// BanCommand bans a user from the room for Seconds, or indefinitely if
+// Seconds is zero. It requires manager privileges.
+type BanCommand struct {
+	Ident   string `json:"ident"`
+	Seconds int    `json:"seconds,omitempty"`
+}
+
+type BanReply BanCommand
+
+// UnbanCommand lifts a ban. It requires manager privileges.
+type UnbanCommand struct {
+	Ident string `json:"ident"`
+}
+
+type UnbanReply UnbanCommand
+
 type PresenceEvent struct {
 	*User
 	SessionID string `json:"session_id"`
@@ -82,6 +210,99 @@ type BounceEvent struct {
 	IP          string   `json:"ip,omitempty"`
 }
 
+// SnapshotEvent is sent by the server on joining a room and describes the
+// sessions present and the most recent messages.
+type SnapshotEvent struct {
+	Identity  string          `json:"identity"`
+	SessionID string          `json:"session_id"`
+	Version   string          `json:"version"`
+	Listing   []PresenceEvent `json:"listing"`
+	Log       []Message       `json:"log"`
+}
+
+// EditMessageCommand edits or, if Delete is set, deletes a message. Announce
+// sends an edit-message-event to the room. It requires manager privileges
+// unless the message is the bot's own.
+type EditMessageCommand struct {
+	ID             string `json:"id"`
+	PreviousEditID string `json:"previous_edit_id,omitempty"`
+	Parent         string `json:"parent,omitempty"`
+	Content        string `json:"content,omitempty"`
+	Delete         bool   `json:"delete"`
+	Announce       bool   `json:"announce"`
+}
+
+// EditMessageReply returns the edited message.
+type EditMessageReply EditMessageEvent
+
+// SessionView describes a session: the user and the session's ID.
+type SessionView struct {
+	User
+	SessionID string `json:"session_id"`
+}
+
+// WhoCommand requests the sessions present in the room.
+type WhoCommand struct{}
+
+// WhoReply lists the sessions present in the room.
+type WhoReply struct {
+	Listing []SessionView `json:"listing"`
+}
+
+// UnmarshalJSON decodes a who-reply, whose listing is normally wrapped in an
+// object but is also accepted as a bare array.
+func (r *WhoReply) UnmarshalJSON(data []byte) error {
+	if isJSONArray(data) {
+		return json.Unmarshal(data, &r.Listing)
+	}
+	type whoReply WhoReply
+	return json.Unmarshal(data, (*whoReply)(r))
+}
+
+// LogCommand requests up to N messages from the room's log, sent before the
+// message with ID Before or, if it is empty, the most recent.
+type LogCommand struct {
+	N      int    `json:"n"`
+	Before string `json:"before,omitempty"`
+}
+
+// LogReply holds messages from the room's log, oldest first.
+type LogReply struct {
+	Log    []Message `json:"log"`
+	Before string    `json:"before,omitempty"`
+}
+
+// UnmarshalJSON decodes a log-reply, whose log is normally wrapped in an
+// object but is also accepted as a bare array.
+func (r *LogReply) UnmarshalJSON(data []byte) error {
+	if isJSONArray(data) {
+		return json.Unmarshal(data, &r.Log)
+	}
+	type logReply LogReply
+	return json.Unmarshal(data, (*logReply)(r))
+}
+
+// isJSONArray reports whether data encodes a JSON array.
+func isJSONArray(data []byte) bool {
+	data = bytes.TrimSpace(data)
+	return len(data) > 0 && data[0] == '['
+}
+
+// HelloEvent is sent by the server when a connection is established,
+// describing the bot's own session.
+type HelloEvent struct {
+	ID            string      `json:"id"`
+	Session       SessionView `json:"session"`
+	RoomIsPrivate bool        `json:"room_is_private"`
+	Version       string      `json:"version"`
+}
+
+// EditMessageEvent indicates that a message in the room was edited or deleted.
+type EditMessageEvent struct {
+	EditID string `json:"edit_id"`
+	Message
+}
+
 // SendEvent is a packet type that contains a Message only.
 type SendEvent Message
 
@@ -89,6 +310,7 @@ type SendReply SendEvent
 
 // These give named constants to the packet types.
 const (
+	PingType      = "ping"
 	PingReplyType = "ping-reply"
 	PingEventType = "ping-event"
 
@@ -96,6 +318,9 @@ const (
 	SendEventType = "send-event"
 	SendReplyType = "send-reply"
 
+	GetMessageType      = "get-message"
+	GetMessageReplyType = "get-message-reply"
+
 	NickType      = "nick"
 	NickReplyType = "nick-reply"
 	NickEventType = "nick-event"
@@ -104,52 +329,127 @@ const (
 
 	PartEventType = "part-event"
 
-	AuthType = "auth"
+	AuthType      = "auth"
+	AuthReplyType = "auth-reply"
+
+	LoginType       = "login"
+	LoginReplyType  = "login-reply"
+	LogoutType      = "logout"
+	LogoutReplyType = "logout-reply"
+
+	BanType        = "ban"
+	BanReplyType   = "ban-reply"
+	UnbanType      = "unban"
+	UnbanReplyType = "unban-reply"
 
 	BounceEventType = "bounce-event"
+
+	SnapshotEventType = "snapshot-event"
+
+	HelloEventType = "hello-event"
+
+	EditMessageType      = "edit-message"
+	EditMessageReplyType = "edit-message-reply"
+	EditMessageEventType = "edit-message-event"
+
+	WhoType      = "who"
+	WhoReplyType = "who-reply"
+
+	LogType      = "log"
+	LogReplyType = "log-reply"
+)
+
+var (
+	packetTypesMu sync.RWMutex
+	packetTypes   = make(map[PacketType]func() interface{})
 )
 
-// Payload unmarshals the packet payload into the proper Event type and returns it.
+// RegisterPacketType teaches Payload to unmarshal packets of type t into the
+// value returned by factory, which must be a pointer. It can be used to
+// support packet types the library does not know about, or to replace the
+// payload of a built-in type.
+func RegisterPacketType(t PacketType, factory func() interface{}) {
+	packetTypesMu.Lock()
+	defer packetTypesMu.Unlock()
+	packetTypes[t] = factory
+}
+
+func init() {
+	builtin := map[PacketType]func() interface{}{
+		PingEventType:        func() interface{} { return &PingEvent{} },
+		SendEventType:        func() interface{} { return &Message{} },
+		SendReplyType:        func() interface{} { return &Message{} },
+		GetMessageReplyType:  func() interface{} { return &Message{} },
+		GetMessageType:       func() interface{} { return &GetMessageCommand{} },
+		SendType:             func() interface{} { return &SendCommand{} },
+		NickEventType:        func() interface{} { return &NickEvent{} },
+		NickReplyType:        func() interface{} { return &NickReply{} },
+		JoinEventType:        func() interface{} { return &PresenceEvent{} },
+		PartEventType:        func() interface{} { return &PresenceEvent{} },
+		PingType:             func() interface{} { return &PingCommand{} },
+		PingReplyType:        func() interface{} { return &PingReply{} },
+		AuthType:             func() interface{} { return &AuthCommand{} },
+		AuthReplyType:        func() interface{} { return &AuthReply{} },
+		LoginType:            func() interface{} { return &LoginCommand{} },
+		LoginReplyType:       func() interface{} { return &LoginReply{} },
+		LogoutType:           func() interface{} { return &LogoutCommand{} },
+		LogoutReplyType:      func() interface{} { return &LogoutReply{} },
+		BanType:              func() interface{} { return &BanCommand{} },
+		BanReplyType:         func() interface{} { return &BanReply{} },
+		UnbanType:            func() interface{} { return &UnbanCommand{} },
+		UnbanReplyType:       func() interface{} { return &UnbanReply{} },
+		BounceEventType:      func() interface{} { return &BounceEvent{} },
+		SnapshotEventType:    func() interface{} { return &SnapshotEvent{} },
+		HelloEventType:       func() interface{} { return &HelloEvent{} },
+		EditMessageType:      func() interface{} { return &EditMessageCommand{} },
+		EditMessageReplyType: func() interface{} { return &EditMessageReply{} },
+		EditMessageEventType: func() interface{} { return &EditMessageEvent{} },
+		WhoType:              func() interface{} { return &WhoCommand{} },
+		WhoReplyType:         func() interface{} { return &WhoReply{} },
+		LogType:              func() interface{} { return &LogCommand{} },
+		LogReplyType:         func() interface{} { return &LogReply{} },
+	}
+	for t, factory := range builtin {
+		RegisterPacketType(t, factory)
+	}
+}
+
+// Payload unmarshals the packet payload into the type registered for the
+// packet's type and returns it.
 func (p *PacketEvent) Payload() (interface{}, error) {
-	var payload interface{}
-	switch p.Type {
-	case PingEventType:
-		payload = &PingEvent{}
-	case SendEventType, SendReplyType:
-		payload = &Message{}
-	case SendType:
-		payload = &SendCommand{}
-	case NickEventType:
-		payload = &NickEvent{}
-	case JoinEventType, PartEventType:
-		payload = &PresenceEvent{}
-	case PingReplyType:
-		payload = &PingReply{}
-	case AuthType:
-		payload = &AuthCommand{}
-	case BounceEventType:
-		payload = &BounceEvent{}
-	default:
+	packetTypesMu.RLock()
+	factory, ok := packetTypes[p.Type]
+	packetTypesMu.RUnlock()
+	if !ok {
 		return p.Data, errors.New("Unexpected packet type.")
 	}
-	err := json.Unmarshal(p.Data, &payload)
-	return payload, err
+	payload := factory()
+	if err := json.Unmarshal(p.Data, payload); err != nil {
+		return payload, fmt.Errorf("Error unmarshalling %s packet with ID '%s': %s", p.Type, p.ID, err)
+	}
+	return payload, nil
 }
 
 func MakePacket(ID string, msgType PacketType, payload interface{}) (*PacketEvent, error) {
 	packet := &PacketEvent{
 		ID:   ID,
 		Type: msgType}
-	data, err := json.Marshal(payload)
-	if err != nil {
-		return nil, err
-	}
-	if err := packet.Data.UnmarshalJSON(data); err != nil {
+	if err := packet.MarshalPayload(payload); err != nil {
 		return nil, err
 	}
 	return packet, nil
 }
 
+// MarshalPayload encodes v as the packet's data; it is the inverse of Payload.
+func (p *PacketEvent) MarshalPayload(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	p.Data = data
+	return nil
+}
+
 func GetMessagePayload(packet *PacketEvent) *Message {
 	payload, _ := packet.Payload()
 	se, ok := payload.(*Message)
@@ -176,3 +476,12 @@ func GetPresenceEventPayload(packet *PacketEvent) *PresenceEvent {
 	}
 	return se
 }
+
+func GetSnapshotEventPayload(packet *PacketEvent) *SnapshotEvent {
+	payload, _ := packet.Payload()
+	se, ok := payload.(*SnapshotEvent)
+	if !ok {
+		panic("Failed to assert payload as *SnapshotEvent")
+	}
+	return se
+}
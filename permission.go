@@ -0,0 +1,100 @@
+package maimai
+
+// Permission is a level of standing in a room, from PermissionEveryone up to
+// PermissionAdmin. Each level includes those below it.
+type Permission int
+
+const (
+	// PermissionEveryone is held by every user.
+	PermissionEveryone Permission = iota
+	// PermissionRegular is held by users who have sent at least the
+	// RoomConfig's RegularMessages messages since the bot joined.
+	PermissionRegular
+	// PermissionManager is held by managers of the room.
+	PermissionManager
+	// PermissionAdmin is held by the users listed in the RoomConfig's
+	// Admins.
+	PermissionAdmin
+)
+
+var permissionNames = []string{"everyone", "regular", "manager", "admin"}
+
+func (p Permission) String() string {
+	if p < 0 || int(p) >= len(permissionNames) {
+		return "unknown"
+	}
+	return permissionNames[p]
+}
+
+// DefaultRegularMessages is how many messages make a user a regular when the
+// RoomConfig does not specify RegularMessages.
+const DefaultRegularMessages = 20
+
+// maxCountedUsers is the most users whose messages are counted, so that a
+// flood of new senders cannot grow the counts without bound. Users already
+// counted keep being counted once it is reached.
+const maxCountedUsers = 10000
+
+func (r *Room) regularMessages() int {
+	if r.config.RegularMessages <= 0 {
+		return DefaultRegularMessages
+	}
+	return r.config.RegularMessages
+}
+
+// countMessage counts a send-event towards its sender becoming a regular.
+// Counting stops once they are one.
+func (r *Room) countMessage(packet *PacketEvent) {
+	if packet.Type != SendEventType {
+		return
+	}
+	data := GetMessagePayload(packet)
+	if data == nil || data.Sender.ID == "" {
+		return
+	}
+	threshold := r.regularMessages()
+	r.data.Lock()
+	defer r.data.Unlock()
+	count, ok := r.data.msgCounts[data.Sender.ID]
+	if (!ok && len(r.data.msgCounts) >= maxCountedUsers) || count >= threshold {
+		return
+	}
+	r.data.msgCounts[data.Sender.ID] = count + 1
+}
+
+// PermissionOf returns the highest standing of the sender of msg.
+func (r *Room) PermissionOf(msg *Message) Permission {
+	if r.isAdmin(msg.Sender.ID) {
+		return PermissionAdmin
+	}
+	if msg.IsFromManager() {
+		return PermissionManager
+	}
+	r.data.Lock()
+	count := r.data.msgCounts[msg.Sender.ID]
+	r.data.Unlock()
+	if msg.Sender.ID != "" && count >= r.regularMessages() {
+		return PermissionRegular
+	}
+	return PermissionEveryone
+}
+
+// WithPermission wraps h so that send-events from users without at least
+// level never reach it. If a filtered message invokes one of commands, the
+// sender is told the permission they need.
+func WithPermission(level Permission, h Handler, commands ...string) Handler {
+	gated := make(map[string]empty)
+	for _, cmd := range commands {
+		gated[cmd] = empty{}
+	}
+	return withSendEventFilter(h, func(room *Room, data *Message) bool {
+		if room.PermissionOf(data) >= level {
+			return true
+		}
+		if _, ok := gated[commandOf(room.commandContent(data.Content))]; ok {
+			room.SendText(room.render("permission", map[string]interface{}{
+				"Level": level.String()}), data.ID)
+		}
+		return false
+	})
+}
@@ -0,0 +1,141 @@
+package maimai
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultPollDuration is how long polls run when the RoomConfig does not
+// specify PollDuration.
+const DefaultPollDuration = time.Duration(5) * time.Minute
+
+const (
+	pollUsage = "Usage: !poll \"Question?\" option1 | option2 [| ...]"
+	voteUsage = "Usage: !vote <number>"
+)
+
+// poll is a poll in progress. votes maps voters to the option they chose,
+// numbered from 1.
+type poll struct {
+	question string
+	options  []string
+	votes    map[string]int
+	msgID    string
+}
+
+// parsePoll parses the arguments of a !poll command, returning nil if there
+// is no question or fewer than two options.
+func parsePoll(args []string) *poll {
+	if len(args) < 3 {
+		return nil
+	}
+	p := &poll{question: args[1], votes: make(map[string]int)}
+	for _, option := range strings.Split(strings.Join(args[2:], " "), "|") {
+		if option = strings.TrimSpace(option); option != "" {
+			p.options = append(p.options, option)
+		}
+	}
+	if p.question == "" || len(p.options) < 2 {
+		return nil
+	}
+	return p
+}
+
+// vote records voter's choice of option, replacing any earlier vote, and
+// reports whether option is valid.
+func (p *poll) vote(voter string, option int) bool {
+	if option < 1 || option > len(p.options) {
+		return false
+	}
+	p.votes[voter] = option
+	return true
+}
+
+// tally returns the number of votes for each option.
+func (p *poll) tally() []int {
+	counts := make([]int, len(p.options))
+	for _, option := range p.votes {
+		counts[option-1]++
+	}
+	return counts
+}
+
+func (p *poll) String() string {
+	lines := []string{"Poll: " + p.question}
+	for i, option := range p.options {
+		lines = append(lines, fmt.Sprintf("%d. %s", i+1, option))
+	}
+	return strings.Join(append(lines, "Vote with !vote <number>."), "\n")
+}
+
+func (p *poll) results() string {
+	lines := []string{"Poll results: " + p.question}
+	for i, count := range p.tally() {
+		lines = append(lines, fmt.Sprintf("%d. %s: %d", i+1, p.options[i], count))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// PollHandler handles the !poll command, which starts a poll for the
+// RoomConfig's PollDuration, and the !vote command, which votes in it. Each
+// user has one vote, identified by user ID; voting again changes it. One poll
+// runs at a time.
+func PollHandler(room *Room, input chan PacketEvent, cmdChan chan string) {
+	duration := room.config.PollDuration
+	if duration <= 0 {
+		duration = DefaultPollDuration
+	}
+	var current *poll
+	var done <-chan time.Time
+	for {
+		select {
+		case packet := <-input:
+			if packet.Type != SendEventType {
+				continue
+			}
+			data := GetMessagePayload(&packet)
+			content := room.commandContent(data.Content)
+			switch commandOf(content) {
+			case "!poll":
+				if current != nil {
+					room.SendText("A poll is already running.", data.ID)
+					continue
+				}
+				p := parsePoll(ParseArgs(content))
+				if p == nil {
+					room.SendText(pollUsage, data.ID)
+					continue
+				}
+				p.question, p.msgID = SanitizeContent(p.question), data.ID
+				for i, option := range p.options {
+					p.options[i] = SanitizeContent(option)
+				}
+				current, done = p, time.After(duration)
+				room.SendText(p.String(), data.ID)
+			case "!vote":
+				if current == nil {
+					room.SendText("There is no poll running.", data.ID)
+					continue
+				}
+				fields := strings.Fields(content)
+				if len(fields) != 2 {
+					room.SendText(voteUsage, data.ID)
+					continue
+				}
+				n, err := strconv.Atoi(fields[1])
+				if err != nil || !current.vote(userKey(&data.Sender), n) {
+					room.SendText(voteUsage, data.ID)
+				}
+			}
+		case <-done:
+			room.SendText(current.results(), current.msgID)
+			current, done = nil, nil
+		case cmd := <-cmdChan:
+			if cmd == "kill" {
+				return
+			}
+		}
+	}
+}
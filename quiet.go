@@ -0,0 +1,60 @@
+package maimai
+
+import "time"
+
+// quietHours is a daily window, in a given location, during which
+// non-essential announcements are suppressed. start and end are offsets from
+// midnight; if end is before start the window spans midnight.
+type quietHours struct {
+	start, end time.Duration
+	loc        *time.Location
+}
+
+func sinceMidnight(t time.Time) time.Duration {
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute +
+		time.Duration(t.Second())*time.Second
+}
+
+func (q *quietHours) contains(t time.Time) bool {
+	now := sinceMidnight(t.In(q.loc))
+	if q.start <= q.end {
+		return now >= q.start && now < q.end
+	}
+	return now >= q.start || now < q.end
+}
+
+// SetQuietHours suppresses join, part and nick announcements and link titles
+// each day from the time of day of start until that of end, in loc (or UTC if
+// loc is nil). Only the clock times of start and end, as read in loc, are used,
+// and the window may span midnight. Logging, pings, and replies to commands are unaffected.
+// If start and end have the same time of day, quiet hours are turned off.
+func (r *Room) SetQuietHours(start, end time.Time, loc *time.Location) {
+	if loc == nil {
+		loc = time.UTC
+	}
+	q := &quietHours{
+		start: sinceMidnight(start.In(loc)),
+		end:   sinceMidnight(end.In(loc)),
+		loc:   loc,
+	}
+	if q.start == q.end {
+		q = nil
+	}
+	r.data.Lock()
+	r.data.quietHours = q
+	r.data.Unlock()
+}
+
+// IsQuiet reports whether t falls within the room's quiet hours.
+func (r *Room) IsQuiet(t time.Time) bool {
+	r.data.Lock()
+	q := r.data.quietHours
+	r.data.Unlock()
+	return q != nil && q.contains(t)
+}
+
+// announcing reports whether announcements controlled by feature may be made
+// now: the feature must be on and it must not be quiet hours.
+func (r *Room) announcing(feature string) bool {
+	return r.IsEnabled(feature) && !r.IsQuiet(time.Now())
+}
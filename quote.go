@@ -0,0 +1,160 @@
+package maimai
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const quoteUsage = "Usage: !quote, !quote <number>, or !quote add <text>"
+
+// Quote is a recorded quote. Quotes are stored in a per-room bucket within the
+// "Quotes" bucket, keyed by their number.
+type Quote struct {
+	Text    string `json:"text"`
+	AddedBy string `json:"addedBy"`
+	Time    int64  `json:"time"`
+}
+
+func quoteKey(n uint64) []byte {
+	return []byte(fmt.Sprintf("%020d", n))
+}
+
+func (r *Room) storeQuote(quote *Quote) (uint64, error) {
+	var n uint64
+	err := r.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket([]byte("Quotes")).CreateBucketIfNotExists([]byte(r.name))
+		if err != nil {
+			return err
+		}
+		n, err = b.NextSequence()
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(quote)
+		if err != nil {
+			return err
+		}
+		return b.Put(quoteKey(n), data)
+	})
+	return n, err
+}
+
+// retrieveQuote returns quote number n, or nil if there is none.
+func (r *Room) retrieveQuote(n uint64) (*Quote, error) {
+	var quote *Quote
+	err := r.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("Quotes")).Bucket([]byte(r.name))
+		if b == nil {
+			return nil
+		}
+		data := b.Get(quoteKey(n))
+		if data == nil {
+			return nil
+		}
+		quote = &Quote{}
+		return json.Unmarshal(data, quote)
+	})
+	return quote, err
+}
+
+// randomQuote returns a random quote and its number, or a nil quote if none
+// have been recorded.
+func (r *Room) randomQuote() (uint64, *Quote, error) {
+	var n uint64
+	var quote *Quote
+	err := r.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("Quotes")).Bucket([]byte(r.name))
+		if b == nil {
+			return nil
+		}
+		var keys [][]byte
+		b.ForEach(func(k, v []byte) error {
+			keys = append(keys, k)
+			return nil
+		})
+		if len(keys) == 0 {
+			return nil
+		}
+		key := keys[r.Rand.Intn(len(keys))]
+		var err error
+		n, err = strconv.ParseUint(string(key), 10, 64)
+		if err != nil {
+			return err
+		}
+		quote = &Quote{}
+		return json.Unmarshal(b.Get(key), quote)
+	})
+	return n, quote, err
+}
+
+// QuoteCommandHandler handles a send-event, checks for a !quote command, and
+// records or recalls quotes.
+func QuoteCommandHandler(room *Room, input chan PacketEvent, cmdChan chan string) {
+	for {
+		select {
+		case packet := <-input:
+			if packet.Type != SendEventType {
+				continue
+			}
+			data := GetMessagePayload(&packet)
+			fields := strings.Fields(room.commandContent(data.Content))
+			if len(fields) == 0 || fields[0] != "!quote" {
+				continue
+			}
+			switch {
+			case len(fields) == 1:
+				n, quote, err := room.randomQuote()
+				if err != nil {
+					room.errChan <- err
+					return
+				}
+				if quote == nil {
+					room.SendText("No quotes have been recorded yet.", data.ID)
+					continue
+				}
+				room.SendTextf(data.ID, "#%d: %s", n, quote.Text)
+			case fields[1] == "add":
+				if len(fields) < 3 {
+					room.SendText(quoteUsage, data.ID)
+					continue
+				}
+				n, err := room.storeQuote(&Quote{
+					Text:    ValidUTF8(unquote(strings.Join(fields[2:], " "))),
+					AddedBy: data.Sender.ID,
+					Time:    time.Now().Unix()})
+				if err != nil {
+					room.errChan <- err
+					return
+				}
+				room.SendTextf(data.ID, "Quote #%d added.", n)
+			case len(fields) == 2:
+				n, err := strconv.ParseUint(strings.TrimPrefix(fields[1], "#"), 10, 64)
+				if err != nil {
+					room.SendText(quoteUsage, data.ID)
+					continue
+				}
+				quote, err := room.retrieveQuote(n)
+				if err != nil {
+					room.errChan <- err
+					return
+				}
+				if quote == nil {
+					room.SendTextf(data.ID, "There is no quote #%d.", n)
+					continue
+				}
+				room.SendTextf(data.ID, "#%d: %s", n, quote.Text)
+			default:
+				room.SendText(quoteUsage, data.ID)
+			}
+		case cmd := <-cmdChan:
+			if cmd == "kill" {
+				return
+			}
+		}
+	}
+}
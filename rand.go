@@ -0,0 +1,40 @@
+package maimai
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// lockedSource guards a rand.Source so that a single *rand.Rand may be shared
+// by handlers running concurrently.
+type lockedSource struct {
+	mu  sync.Mutex
+	src rand.Source
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.src.Int63()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.src.Seed(seed)
+}
+
+func newSharedRand(src rand.Source) *rand.Rand {
+	return rand.New(&lockedSource{src: src})
+}
+
+// Jitter returns a random duration in [0, max), to add to the delay of a
+// scheduled post so that posts scheduled together are spread out. It
+// returns 0 if max is not positive.
+func (r *Room) Jitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(r.Rand.Int63n(int64(max)))
+}
@@ -0,0 +1,81 @@
+package maimai
+
+import (
+	"encoding/json"
+	"io"
+	"sync/atomic"
+)
+
+// recordBuffer is the number of received packets that can wait to be written
+// to a recording before further packets are dropped.
+const recordBuffer = 256
+
+// recorder writes packets to a recording from its own goroutine, so that a
+// slow writer never holds up the dispatcher.
+type recorder struct {
+	packets chan *PacketEvent
+	done    chan empty
+	dropped uint64
+}
+
+func newRecorder(w io.Writer, r *Room) *recorder {
+	rec := &recorder{
+		packets: make(chan *PacketEvent, recordBuffer),
+		done:    make(chan empty),
+	}
+	go func() {
+		defer close(rec.done)
+		enc := json.NewEncoder(w)
+		for packet := range rec.packets {
+			if err := enc.Encode(packet); err != nil {
+				r.Logger.Errorf("Error recording packet, recording stopped: %s", err)
+				// Drain so that the dispatcher never blocks.
+				for range rec.packets {
+				}
+				return
+			}
+		}
+	}()
+	return rec
+}
+
+// RecordTo writes every packet the room receives to w as newline-delimited
+// JSON, in the format Replay reads, replacing any recording already in
+// progress. A nil w stops recording. Packets are written asynchronously; if
+// w falls too far behind, packets are dropped rather than delaying the
+// handlers. RecordTo returns once the previous recording, if any, has been
+// written out.
+func (r *Room) RecordTo(w io.Writer) {
+	var rec *recorder
+	if w != nil {
+		rec = newRecorder(w, r)
+	}
+	r.data.Lock()
+	prev := r.data.recorder
+	r.data.recorder = rec
+	if prev != nil {
+		close(prev.packets)
+	}
+	r.data.Unlock()
+	if prev != nil {
+		<-prev.done
+		if dropped := atomic.LoadUint64(&prev.dropped); dropped > 0 {
+			r.Logger.Warningf("Recording dropped %d packets.", dropped)
+		}
+	}
+}
+
+// record passes packet to the recording, if one is in progress.
+func (r *Room) record(packet *PacketEvent) {
+	r.data.Lock()
+	defer r.data.Unlock()
+	rec := r.data.recorder
+	if rec == nil {
+		return
+	}
+	select {
+	case rec.packets <- packet:
+	default:
+		atomic.AddUint64(&rec.dropped, 1)
+	}
+}
@@ -0,0 +1,211 @@
+package maimai
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const remindUsage = "Usage: !remind me in <duration> to <text>, or !remind me at <time> to <text>"
+
+// reminderTimeFormats are the layouts accepted by !remind me at, tried in order.
+// Times without a zone are interpreted in the sender's !tz location.
+var reminderTimeFormats = []string{
+	time.RFC3339,
+	"2006-01-02 15:04",
+	"15:04",
+}
+
+// Reminder is a pending reminder persisted in the "Reminders" bucket.
+type Reminder struct {
+	User   string `json:"user"`
+	Parent string `json:"parent"`
+	Due    int64  `json:"due"`
+	Text   string `json:"text"`
+}
+
+func parseReminderTime(spec string, now time.Time, loc *time.Location) (time.Time, error) {
+	for _, layout := range reminderTimeFormats {
+		t, err := time.ParseInLocation(layout, spec, loc)
+		if err != nil {
+			continue
+		}
+		if layout == "15:04" {
+			now = now.In(loc)
+			t = time.Date(now.Year(), now.Month(), now.Day(),
+				t.Hour(), t.Minute(), 0, 0, loc)
+			if !t.After(now) {
+				t = t.AddDate(0, 0, 1)
+			}
+		}
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("Unrecognized time: %s", spec)
+}
+
+// parseReminder parses the content of a !remind command into a Reminder due
+// relative to now, interpreting times without a zone as UTC.
+func parseReminder(content string, now time.Time) (*Reminder, error) {
+	return parseReminderIn(content, now, time.UTC)
+}
+
+// parseReminderIn is like parseReminder but interprets times without a zone
+// in loc.
+func parseReminderIn(content string, now time.Time, loc *time.Location) (*Reminder, error) {
+	rest := strings.TrimSpace(strings.TrimPrefix(content, "!remind"))
+	if !strings.HasPrefix(rest, "me ") {
+		return nil, errors.New("Reminder must start with 'me'.")
+	}
+	rest = strings.TrimSpace(rest[3:])
+	idx := strings.Index(rest, " to ")
+	if idx < 0 {
+		return nil, errors.New("Reminder is missing 'to'.")
+	}
+	spec, text := rest[:idx], strings.TrimSpace(rest[idx+4:])
+	if text == "" {
+		return nil, errors.New("Reminder text is empty.")
+	}
+	var due time.Time
+	switch {
+	case strings.HasPrefix(spec, "in "):
+		d, err := time.ParseDuration(strings.TrimSpace(spec[3:]))
+		if err != nil {
+			return nil, err
+		}
+		if d <= 0 {
+			return nil, errors.New("Reminder duration must be positive.")
+		}
+		due = now.Add(d)
+	case strings.HasPrefix(spec, "at "):
+		t, err := parseReminderTime(strings.TrimSpace(spec[3:]), now, loc)
+		if err != nil {
+			return nil, err
+		}
+		due = t
+	default:
+		return nil, errors.New("Reminder must use 'in' or 'at'.")
+	}
+	return &Reminder{Due: due.UnixNano(), Text: text}, nil
+}
+
+func (r *Room) storeReminder(reminder *Reminder) (string, error) {
+	var key string
+	err := r.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("Reminders"))
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(reminder)
+		if err != nil {
+			return err
+		}
+		key = fmt.Sprintf("%020d", seq)
+		return b.Put([]byte(key), data)
+	})
+	return key, err
+}
+
+func (r *Room) deleteReminder(key string) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("Reminders")).Delete([]byte(key))
+	})
+}
+
+func (r *Room) retrieveReminders() (map[string]*Reminder, error) {
+	reminders := make(map[string]*Reminder)
+	err := r.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("Reminders")).ForEach(func(k, v []byte) error {
+			var reminder Reminder
+			if err := json.Unmarshal(v, &reminder); err != nil {
+				return err
+			}
+			reminders[string(k)] = &reminder
+			return nil
+		})
+	})
+	return reminders, err
+}
+
+// RemindCommandHandler handles a send-event, checks for a !remind command, and
+// schedules a reminder for the sender. Pending reminders are persisted and
+// rescheduled when the handler starts.
+func RemindCommandHandler(room *Room, input chan PacketEvent, cmdChan chan string) {
+	due := make(chan string)
+	done := make(chan empty)
+	timers := make(map[string]*time.Timer)
+	// However the handler exits, release the timers waiting to deliver.
+	defer func() {
+		close(done)
+		for _, timer := range timers {
+			timer.Stop()
+		}
+	}()
+	reminders, err := room.retrieveReminders()
+	if err != nil {
+		room.errChan <- err
+		return
+	}
+	schedule := func(key string, reminder *Reminder) {
+		wait := time.Unix(0, reminder.Due).Sub(time.Now())
+		timers[key] = time.AfterFunc(wait, func() {
+			select {
+			case due <- key:
+			case <-done:
+			}
+		})
+	}
+	for key, reminder := range reminders {
+		schedule(key, reminder)
+	}
+	for {
+		select {
+		case packet := <-input:
+			if packet.Type != SendEventType {
+				continue
+			}
+			data := GetMessagePayload(&packet)
+			content := room.commandContent(data.Content)
+			if commandOf(content) != "!remind" {
+				continue
+			}
+			loc, err := room.UserLocation(&data.Sender)
+			if err != nil {
+				room.errChan <- err
+				return
+			}
+			reminder, err := parseReminderIn(content, time.Now(), loc)
+			if err != nil {
+				room.SendText(remindUsage, data.ID)
+				continue
+			}
+			reminder.User = strings.Replace(data.Sender.Name, " ", "", -1)
+			reminder.Parent = data.ID
+			key, err := room.storeReminder(reminder)
+			if err != nil {
+				room.errChan <- err
+				return
+			}
+			reminders[key] = reminder
+			schedule(key, reminder)
+			room.SendText(fmt.Sprintf("Reminder set for %s.",
+				time.Unix(0, reminder.Due).In(loc).Format("2006-01-02 15:04:05 MST")), data.ID)
+		case key := <-due:
+			reminder := reminders[key]
+			delete(reminders, key)
+			delete(timers, key)
+			if err := room.deleteReminder(key); err != nil {
+				room.Logger.Errorf("Error deleting reminder %s: %s", key, err)
+			}
+			room.SendTextf(reminder.Parent, "@%s reminder: %s", reminder.User, reminder.Text)
+		case cmd := <-cmdChan:
+			if cmd == "kill" {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package maimai
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// replayIdle is how long Replay waits with nothing left to dispatch and
+// nothing sent before deciding the handlers are done.
+const replayIdle = time.Duration(200) * time.Millisecond
+
+// replaySenderReceiver is a SenderReceiver that receives packets read from a
+// recording and captures sent packets instead of transmitting them.
+type replaySenderReceiver struct {
+	scanner  *bufio.Scanner
+	stopChan chan empty
+	// fed is closed once every recorded packet has been received.
+	fed chan empty
+	wg  sync.WaitGroup
+
+	mu   sync.Mutex
+	sent []*PacketEvent
+	err  error
+}
+
+func newReplaySenderReceiver(rd io.Reader) *replaySenderReceiver {
+	return &replaySenderReceiver{
+		scanner:  bufio.NewScanner(rd),
+		stopChan: make(chan empty, 2),
+		fed:      make(chan empty),
+	}
+}
+
+func (rs *replaySenderReceiver) connect(r *Room) error {
+	return nil
+}
+
+func (rs *replaySenderReceiver) receiver(inbound chan *PacketEvent) {
+	defer close(rs.fed)
+	for line := 1; rs.scanner.Scan(); line++ {
+		if len(rs.scanner.Bytes()) == 0 {
+			continue
+		}
+		var packet PacketEvent
+		if err := json.Unmarshal(rs.scanner.Bytes(), &packet); err != nil {
+			rs.fail(fmt.Errorf("Error reading recorded packet on line %d: %s", line, err))
+			return
+		}
+		select {
+		case inbound <- &packet:
+		case <-rs.stopChan:
+			return
+		}
+	}
+	if err := rs.scanner.Err(); err != nil {
+		rs.fail(err)
+	}
+}
+
+func (rs *replaySenderReceiver) sender(outbound chan *PacketEvent) {
+	for {
+		select {
+		case msg := <-outbound:
+			rs.mu.Lock()
+			rs.sent = append(rs.sent, msg)
+			rs.mu.Unlock()
+		case <-rs.stopChan:
+			return
+		}
+	}
+}
+
+func (rs *replaySenderReceiver) fail(err error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.err == nil {
+		rs.err = err
+	}
+}
+
+// sentCount returns the number of packets sent so far.
+func (rs *replaySenderReceiver) sentCount() int {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return len(rs.sent)
+}
+
+func (rs *replaySenderReceiver) start(r *Room, inbound chan *PacketEvent, outbound chan *PacketEvent) {
+	rs.wg.Add(2)
+	go func() {
+		defer rs.wg.Done()
+		rs.receiver(inbound)
+	}()
+	go func() {
+		defer rs.wg.Done()
+		rs.sender(outbound)
+	}()
+}
+
+func (rs *replaySenderReceiver) reconnect(r *Room) error {
+	return nil
+}
+
+func (rs *replaySenderReceiver) close() error {
+	return nil
+}
+
+func (rs *replaySenderReceiver) stop() {
+	rs.stopChan <- empty{}
+	rs.stopChan <- empty{}
+	rs.wg.Wait()
+}
+
+// idle reports whether no packets are waiting to be dispatched, handled or
+// sent.
+func (r *Room) idle() bool {
+	if len(r.inbound) > 0 || len(r.outbound) > 0 {
+		return false
+	}
+	for _, e := range r.handlerSnapshot() {
+		if e.queued() > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Replay is used in place of Run to feed a recording of newline-delimited
+// PacketEvents, such as one written by RecordTo, through the handlers as if
+// they were received live. Nothing is transmitted; once the handlers have
+// finished with the recording the room is stopped and the packets they sent
+// are returned. Server replies in the recording are matched to the bot's
+// commands by packet ID as usual, so a recording of a session from its start
+// replays faithfully.
+//
+// Replay decides the handlers have finished once nothing has been dispatched
+// or sent for 200ms. It cannot see handlers that are sleeping, so output
+// that is deliberately delayed by longer than that, such as part
+// announcements after PartGrace or passcode retries backing off after a
+// bounce-event, is cut off and missing from the result.
+func (r *Room) Replay(rd io.Reader) ([]*PacketEvent, error) {
+	r.handlersMu.Lock()
+	running := r.running
+	r.handlersMu.Unlock()
+	if running {
+		return nil, errors.New("Cannot replay into a running room.")
+	}
+	rs := newReplaySenderReceiver(rd)
+	r.sr = rs
+	go r.Run()
+	<-rs.fed
+	sent, idleSince := -1, time.Now()
+	for {
+		if n := rs.sentCount(); n != sent || !r.idle() {
+			sent, idleSince = n, time.Now()
+		} else if time.Since(idleSince) >= replayIdle {
+			break
+		}
+		time.Sleep(time.Duration(10) * time.Millisecond)
+	}
+	r.Stop()
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return rs.sent, rs.err
+}
@@ -2,9 +2,14 @@ package maimai
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math/rand"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Sirupsen/logrus"
@@ -14,9 +19,42 @@ import (
 type empty struct{}
 
 type roomData struct {
-	msgID       int
+	sync.Mutex
 	seen        map[string]time.Time
 	userLeaving map[string]empty
+	readOnly    bool
+	// users maps session IDs to the users currently present.
+	users  map[string]User
+	locale string
+	// pending maps packet IDs to callers awaiting their replies.
+	pending map[string]chan *PacketEvent
+	// pingLatency is the most recently measured ping latency.
+	pingLatency time.Duration
+	// logRetention is how long logged messages are kept; zero keeps them
+	// forever.
+	logRetention time.Duration
+	// sessionID, userID and nick are the bot's own session, user ID and
+	// current nick.
+	sessionID string
+	userID    string
+	nick      string
+	// nickChanges are the changes of nick not yet delivered to OnNickChange.
+	nickChanges []nickUpdate
+	// features records features turned on or off; absent features are on.
+	features map[string]bool
+	// quietHours, if set, is when announcements are suppressed.
+	quietHours *quietHours
+	// ignored maps the IDs of users whose send-events are dropped to their
+	// nicks when ignored, if known.
+	ignored map[string]string
+	// recorder, if set, records the packets received.
+	recorder *recorder
+	// msgCounts counts the messages sent by each user ID since the bot
+	// joined, for PermissionRegular.
+	msgCounts map[string]int
+	// pendingSeen holds the seen records not yet flushed to the store, when
+	// SeenFlushInterval is set.
+	pendingSeen map[string]int64
 }
 
 // RoomConfig stores configuration options specific to a Room.
@@ -28,25 +66,182 @@ type RoomConfig struct {
 	MsgPrefix    string
 	Nick         string
 	Password     string
+	// Secrets supplies the passcode when Password is empty. If nil, an
+	// EnvSecretProvider is used.
+	Secrets SecretProvider
+	// IgnoredTitles are link titles that are never announced, compared
+	// case-insensitively. If nil, DefaultIgnoredTitles is used.
+	IgnoredTitles []string
+	// UserAgent is sent when fetching link titles. If empty,
+	// DefaultUserAgent is used.
+	UserAgent string
+	// LinkTitleWindow is how long after a link's title is posted that it is
+	// not posted again, room-wide. If zero, DefaultLinkTitleWindow is used.
+	LinkTitleWindow time.Duration
+	// LinkTitleCacheTTL is how long a fetched link title is reused. If zero,
+	// DefaultLinkTitleCacheTTL is used.
+	LinkTitleCacheTTL time.Duration
+	// LinkTitleTimeout bounds how long fetching a link title may take, from
+	// connecting to reading the page. If zero, DefaultLinkTitleTimeout is
+	// used.
+	LinkTitleTimeout time.Duration
+	// MaxConcurrentFetches is the most link titles fetched at once; further
+	// fetches wait their turn. If zero, DefaultMaxConcurrentFetches is used.
+	MaxConcurrentFetches int
+	// SeenFlushInterval, if set, batches the seen-record handler's writes,
+	// flushing them to the store this often and when the handler stops, so
+	// that rapid updates for the same user are merged.
+	SeenFlushInterval time.Duration
+	// PollDuration is how long polls started with !poll run. If zero,
+	// DefaultPollDuration is used.
+	PollDuration time.Duration
+	// Dictionary, if set, enables the !define command.
+	Dictionary DictionaryProvider
+	// Templates overrides the built-in reply templates by name ("join",
+	// "part", "nick", "seen", "seen.never").
+	Templates map[string]string
+	// NickRetries is the number of suffixed nicks tried when the nick is
+	// rejected. If zero, DefaultNickRetries is used; if negative, none are.
+	NickRetries int
+	// Admins are the user IDs allowed to run admin commands such as
+	// !shutdown. Admin commands are only enabled when Admins is non-empty.
+	Admins []string
+	// RegularMessages is how many messages a user must send before they
+	// have PermissionRegular. If zero, DefaultRegularMessages is used.
+	RegularMessages int
+	// RandSource seeds Room.Rand. If nil, a source seeded from the clock is
+	// used; set it for deterministic tests.
+	RandSource rand.Source
+	// PingGraceMultiplier scales the ping interval to give the grace period
+	// after an expected ping before reconnecting. If zero,
+	// DefaultPingGraceMultiplier is used.
+	PingGraceMultiplier float64
+	// MaxTitlesPerMessage is the number of distinct links in a message whose
+	// titles are reported. If zero, only the first is.
+	MaxTitlesPerMessage int
+	// BlockedDomains are domains whose links, including those on
+	// subdomains, are never fetched for titles.
+	BlockedDomains []string
+	// Features turns features such as FeatureLinkTitles on or off at
+	// startup. Features not listed are on; admins can change them at runtime
+	// with !feature.
+	Features map[string]bool
+	// Handlers names the built-in handlers to register. If nil, the default
+	// set for the other options is registered.
+	Handlers []string
+	// CommandPrefix starts commands. If empty, DefaultCommandPrefix is used.
+	CommandPrefix string
+	// MentionReplies are the commands, such as "!seen", whose replies
+	// @-mention the sender.
+	MentionReplies []string
+	// ConfirmSends makes SendText wait for the server to accept each
+	// message, so that rejections are returned to the caller. A handler
+	// sending is blocked for the round trip; packets for it are queued
+	// meanwhile.
+	ConfirmSends bool
+	// SendTimeout is how long a send waits for room in the outbound queue
+	// before failing with ErrSendTimeout. If zero, sends wait indefinitely.
+	SendTimeout time.Duration
+	// RestartPolicy, if set, restarts handlers that exit after an error
+	// instead of treating the error as fatal.
+	RestartPolicy *RestartPolicy
+	// ThreadRootReplies are the commands whose replies are sent under the
+	// root of the triggering message's thread rather than under the message
+	// itself.
+	ThreadRootReplies []string
+	// OnUnknownCommand, if set, is called with commands that are neither
+	// built in, listed in KnownCommands, nor alias triggers. SuggestCommand
+	// may be used to suggest the closest known command.
+	OnUnknownCommand func(room *Room, msg *Message, cmd string)
+	// OnNickChange, if set, is called in a goroutine of its own when the
+	// bot's nick changes, whether the bot changed it or it was renamed.
+	// Changes are delivered one at a time, in the order they happened.
+	OnNickChange func(room *Room, from, to string)
+	// KnownCommands are the commands handled by custom handlers, in their
+	// DefaultCommandPrefix form, so that they are not treated as unknown.
+	KnownCommands []string
+	// SpamPatterns are regular expressions matching messages that the
+	// spam-filter handler acts on with SpamAction. The handler is enabled
+	// by default when SpamPatterns is not empty.
+	SpamPatterns []string
+	SpamAction   SpamAction
+	// AnnounceInterval is the least time between announcements made with
+	// !announce. If zero, DefaultAnnounceInterval is used.
+	AnnounceInterval time.Duration
+	// FloodLimit is the number of messages a user may send within
+	// FloodWindow before being warned. Flood detection is only enabled when
+	// FloodLimit is positive.
+	FloodLimit int
+	// FloodWindow is the window for FloodLimit. If zero, DefaultFloodWindow
+	// is used.
+	FloodWindow time.Duration
+	// OnFlood, if set, is called when a user exceeds FloodLimit.
+	OnFlood func(room *Room, user User)
+	// PartGrace is how long a user must be gone before their part is
+	// announced. If zero, DefaultPartGrace is used.
+	PartGrace time.Duration
+	// PartJitter is the most extra time added at random to PartGrace, to
+	// spread out announcements when many users leave at once.
+	PartJitter time.Duration
+	// MaxLogContentLength is the most characters of a message's content
+	// stored in the message log; longer content is truncated. If zero,
+	// content is stored in full.
+	MaxLogContentLength int
+	// FetchTruncated makes MessageLogHandler fetch the full content of
+	// messages the server sends truncated, at the cost of a get-message
+	// round trip for each. The truncated content is logged at once and
+	// replaced by the full content when the fetch completes.
+	FetchTruncated bool
 }
 
 // Room represents a connection to a euphoria room and associated data.
 type Room struct {
+	// packetIDs counts the packet IDs allocated. It is accessed atomically
+	// and is first so that it is 64-bit aligned on 32-bit platforms.
+	packetIDs uint64
+	// packetsProcessed counts the packets received, atomically.
+	packetsProcessed uint64
+
+	name     string
 	data     *roomData
 	config   *RoomConfig
 	db       *bolt.DB
-	handlers []Handler
-	uptime   time.Time
-	inbound  chan *PacketEvent
-	outbound chan *PacketEvent
-	errChan  chan error
-	sr       SenderReceiver
-	cmdChan  chan string
-	Logger   *logrus.Logger
-	wg       sync.WaitGroup
+	handlers []*handlerEntry
+	// interceptors are sorted by descending priority.
+	interceptors []*interceptorEntry
+	// handlersMu guards handlers, interceptors and running.
+	handlersMu sync.Mutex
+	running    bool
+	uptime     time.Time
+	inbound    chan *PacketEvent
+	outbound   chan *PacketEvent
+	errChan    chan error
+	unknown    chan PacketEvent
+	// fetchSem holds a token for each link title fetch in progress.
+	fetchSem chan empty
+	// bus carries events published by handlers to their subscribers.
+	bus     bus
+	sr      SenderReceiver
+	cmdChan chan string
+	Logger  *logrus.Logger
+	// Rand is shared by handlers that need randomness. It is safe for
+	// concurrent use but is not suitable for cryptographic purposes.
+	Rand *rand.Rand
+	wg   sync.WaitGroup
+	// pendingSends counts senders blocked queueing packets on outbound.
+	pendingSends int32
+	// connected is set, atomically, while the room is connected and its
+	// packets are being sent.
+	connected int32
 }
 
 func (r *Room) storeMsgLogEvent(msgID string, msg *MsgLogEvent) {
+	if max := r.config.MaxLogContentLength; max > 0 && len([]rune(msg.Content)) > max {
+		truncated := *msg
+		truncated.Content = truncate(msg.Content, max)
+		truncated.Truncated = true
+		msg = &truncated
+	}
 	data, _ := json.Marshal(msg)
 	err := r.db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte("MsgLog"))
@@ -58,85 +253,641 @@ func (r *Room) storeMsgLogEvent(msgID string, msg *MsgLogEvent) {
 	}
 }
 
-// NewRoom creates a new room with the given configurations.
-func NewRoom(roomCfg *RoomConfig, room string, sr SenderReceiver, logger *logrus.Logger) (*Room, error) {
-	db, err := bolt.Open(roomCfg.DBPath, 0666, nil)
+func (r *Room) retrieveMsgLogEvent(msgID string) (*MsgLogEvent, error) {
+	var msg *MsgLogEvent
+	err := r.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket([]byte("MsgLog")).Get([]byte(msgID))
+		if data == nil {
+			return nil
+		}
+		msg = &MsgLogEvent{}
+		return json.Unmarshal(data, msg)
+	})
+	return msg, err
+}
+
+// PruneLog deletes logged messages sent before before, returning how many
+// were deleted.
+func (r *Room) PruneLog(before time.Time) (int, error) {
+	cutoff := before.Unix()
+	pruned := 0
+	err := r.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("MsgLog"))
+		var expired [][]byte
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var msg MsgLogEvent
+			if err := json.Unmarshal(v, &msg); err != nil {
+				return err
+			}
+			if msg.Time < cutoff {
+				expired = append(expired, append([]byte(nil), k...))
+			}
+		}
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		pruned = len(expired)
+		return nil
+	})
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
-	err = db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte("Seen"))
-		if err != nil {
-			return fmt.Errorf("Error creating bucket 'Seen': %s", err)
+	return pruned, nil
+}
+
+// SetLogRetention sets how long logged messages are kept. Older messages are
+// pruned periodically by the message log handler. A retention of zero keeps
+// messages forever.
+func (r *Room) SetLogRetention(d time.Duration) {
+	r.data.Lock()
+	r.data.logRetention = d
+	r.data.Unlock()
+}
+
+// pruneExpiredLog prunes messages older than the retention window at now.
+func (r *Room) pruneExpiredLog(now time.Time) {
+	r.data.Lock()
+	retention := r.data.logRetention
+	r.data.Unlock()
+	if retention <= 0 {
+		return
+	}
+	pruned, err := r.PruneLog(now.Add(-retention))
+	if err != nil {
+		r.Logger.Errorf("Error pruning message log: %s", err)
+		return
+	}
+	r.Logger.Debugf("Pruned %d logged messages", pruned)
+}
+
+// retrieveMsgLogEvents returns up to limit logged messages for which match
+// returns true, newest first. Message IDs sort chronologically, so the log is
+// walked backwards from the last key. A limit of 0 returns every match.
+func (r *Room) retrieveMsgLogEvents(match func(msgID string, msg *MsgLogEvent) bool, limit int) ([]*MsgLogEvent, error) {
+	var msgs []*MsgLogEvent
+	err := r.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte("MsgLog")).Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			var msg MsgLogEvent
+			if err := json.Unmarshal(v, &msg); err != nil {
+				return err
+			}
+			if !match(string(k), &msg) {
+				continue
+			}
+			msgs = append(msgs, &msg)
+			if limit > 0 && len(msgs) >= limit {
+				return nil
+			}
 		}
 		return nil
 	})
+	return msgs, err
+}
+
+// buckets are the bolt buckets created when a room is opened.
+var buckets = []string{"Seen", "MsgLog", "Reminders", "Quotes", "Aliases", "Emotes", "Timezones", "GameStats"}
+
+// builtinCommands are the commands handled by the built-in handlers, in their
+// DefaultCommandPrefix form.
+var builtinCommands = []string{"!alias", "!announce", "!calc", "!define",
+	"!emotestats", "!feature", "!flip", "!grep", "!ignore", "!last",
+	"!leaderboard", "!ping", "!poll", "!quote", "!remind", "!roll", "!scritch",
+	"!seen", "!shutdown", "!sysstats", "!thread", "!time", "!tz", "!unignore",
+	"!uptime", "!vote"}
+
+func isBuiltinCommand(cmd string) bool {
+	for _, c := range builtinCommands {
+		if c == cmd {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultHandlerNames returns the names of the built-in handlers registered
+// when the RoomConfig does not list Handlers.
+func defaultHandlerNames(roomCfg *RoomConfig) []string {
+	names := []string{"ping-event", "ping", "ping-watchdog", "seen", "seen-record",
+		"link-title", "uptime", "scritch", "flip", "time", "debug", "bounce",
+		"remind", "quote", "calc", "alias", "emote-stats", "poll", "tz", "game-stats",
+		"roll"}
+	if roomCfg.Join {
+		names = append(names, "nick-change", "join", "part")
+	}
+	if roomCfg.MsgLog {
+		names = append(names, "message-log", "last", "grep", "thread")
+	}
+	if roomCfg.Dictionary != nil {
+		names = append(names, "define")
+	}
+	if len(roomCfg.Admins) > 0 {
+		names = append(names, "shutdown", "feature", "sysstats", "ignore", "announce")
+	}
+	if roomCfg.FloodLimit > 0 {
+		names = append(names, "flood-guard")
+	}
+	if roomCfg.OnUnknownCommand != nil {
+		names = append(names, "unknown-command")
+	}
+	if len(roomCfg.SpamPatterns) > 0 {
+		names = append(names, "spam-filter")
+	}
+	return names
+}
+
+// observesBlankContent are the built-in handlers that act on every message,
+// including those with blank or encrypted content; the others are wrapped
+// with WithNonBlankContent and WithoutEncrypted.
+var observesBlankContent = map[string]bool{
+	"seen-record": true, "message-log": true, "flood-guard": true, "debug": true}
+
+// builtinHandler returns the built-in handler registered under name.
+func builtinHandler(name string, roomCfg *RoomConfig) (Handler, error) {
+	h, err := newBuiltinHandler(name, roomCfg)
+	if err != nil || observesBlankContent[name] {
+		return h, err
+	}
+	return WithNonBlankContent(WithoutEncrypted(h)), nil
+}
+
+func newBuiltinHandler(name string, roomCfg *RoomConfig) (Handler, error) {
+	switch name {
+	case "ping-event":
+		return PingEventHandler, nil
+	case "ping":
+		return PingCommandHandler, nil
+	case "ping-watchdog":
+		return PingWatchdogHandler, nil
+	case "seen":
+		return SeenCommandHandler, nil
+	case "seen-record":
+		return SeenRecordHandler, nil
+	case "link-title":
+		return LinkTitleHandler, nil
+	case "uptime":
+		return UptimeCommandHandler, nil
+	case "scritch":
+		return ScritchCommandHandler, nil
+	case "flip":
+		return CoinFlipCommandHandler, nil
+	case "roll":
+		return RollCommandHandler, nil
+	case "time":
+		return TimeCommandHandler, nil
+	case "debug":
+		return DebugHandler, nil
+	case "bounce":
+		return BounceHandler, nil
+	case "remind":
+		return RemindCommandHandler, nil
+	case "quote":
+		return QuoteCommandHandler, nil
+	case "calc":
+		return CalcCommandHandler, nil
+	case "alias":
+		return AliasHandler, nil
+	case "emote-stats":
+		return EmoteStatsHandler, nil
+	case "poll":
+		return PollHandler, nil
+	case "tz":
+		return TimezoneCommandHandler, nil
+	case "game-stats":
+		return GameStatsHandler, nil
+	case "nick-change":
+		return NickChangeHandler, nil
+	case "join":
+		return JoinEventHandler, nil
+	case "part":
+		return PartEventHandler, nil
+	case "message-log":
+		return MessageLogHandler, nil
+	case "last":
+		return LastCommandHandler, nil
+	case "grep":
+		return GrepCommandHandler, nil
+	case "thread":
+		return ThreadCommandHandler, nil
+	case "flood-guard":
+		if roomCfg.FloodLimit <= 0 {
+			return nil, errors.New("Handler 'flood-guard' requires a FloodLimit.")
+		}
+		return FloodGuardHandler, nil
+	case "unknown-command":
+		if roomCfg.OnUnknownCommand == nil {
+			return nil, errors.New("Handler 'unknown-command' requires OnUnknownCommand.")
+		}
+		return UnknownCommandHandler, nil
+	case "spam-filter":
+		if len(roomCfg.SpamPatterns) == 0 {
+			return nil, errors.New("Handler 'spam-filter' requires SpamPatterns.")
+		}
+		return NewSpamFilterHandler(roomCfg.SpamPatterns, roomCfg.SpamAction)
+	case "define":
+		if roomCfg.Dictionary == nil {
+			return nil, errors.New("Handler 'define' requires a Dictionary.")
+		}
+		return DefineCommandHandler, nil
+	case "shutdown", "feature", "sysstats", "ignore", "announce":
+		if len(roomCfg.Admins) == 0 {
+			return nil, fmt.Errorf("Handler '%s' requires Admins.", name)
+		}
+		switch name {
+		case "shutdown":
+			return WithAdminOnly(ShutdownCommandHandler, roomCfg.Admins, "!shutdown"), nil
+		case "sysstats":
+			return WithAdminOnly(SysStatsCommandHandler, roomCfg.Admins, "!sysstats"), nil
+		case "ignore":
+			return WithAdminOnly(IgnoreCommandHandler, roomCfg.Admins, "!ignore", "!unignore"), nil
+		case "announce":
+			return WithAdminOnly(BroadcastCommandHandler, roomCfg.Admins, "!announce"), nil
+		}
+		return WithAdminOnly(FeatureCommandHandler, roomCfg.Admins, "!feature"), nil
+	}
+	return nil, fmt.Errorf("Unknown handler '%s'.", name)
+}
+
+// NewRoom creates a new room with the given configurations.
+func NewRoom(roomCfg *RoomConfig, room string, sr SenderReceiver, logger *logrus.Logger) (*Room, error) {
+	db, err := bolt.Open(roomCfg.DBPath, 0666, nil)
 	if err != nil {
 		return nil, err
 	}
 	err = db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte("MsgLog"))
-		if err != nil {
-			return fmt.Errorf("Error creating bucket 'MsgLog': %s", err)
+		for _, bucket := range buckets {
+			_, err := tx.CreateBucketIfNotExists([]byte(bucket))
+			if err != nil {
+				return fmt.Errorf("Error creating bucket '%s': %s", bucket, err)
+			}
 		}
 		return nil
 	})
 	if err != nil {
 		return nil, err
 	}
-	var handlers []Handler
-	// TODO : change this to read handler config from file
-	handlers = append(handlers, PingEventHandler)
-	handlers = append(handlers, PingCommandHandler)
-	handlers = append(handlers, SeenCommandHandler)
-	handlers = append(handlers, SeenRecordHandler)
-	handlers = append(handlers, LinkTitleHandler)
-	handlers = append(handlers, UptimeCommandHandler)
-	handlers = append(handlers, ScritchCommandHandler)
-	handlers = append(handlers, DebugHandler)
-	if roomCfg.Join {
-		handlers = append(handlers, NickChangeHandler)
-		handlers = append(handlers, JoinEventHandler)
-		handlers = append(handlers, PartEventHandler)
+	var handlers []*handlerEntry
+	names := roomCfg.Handlers
+	if names == nil {
+		names = defaultHandlerNames(roomCfg)
 	}
-	if roomCfg.MsgLog {
-		handlers = append(handlers, MessageLogHandler)
+	for _, name := range names {
+		h, err := builtinHandler(name, roomCfg)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		handlers = append(handlers, newHandlerEntry(name, h))
 	}
 	// handlers = append(handlers, SuttaCommandHandler)
 	inbound := make(chan *PacketEvent, 4)
-	outbound := make(chan *PacketEvent, 4)
+	outbound := make(chan *PacketEvent, outboundSize)
 	errChan := make(chan error)
 	cmdChan := make(chan string)
-	return &Room{&roomData{0, make(map[string]time.Time),
-		make(map[string]empty)}, roomCfg, db, handlers, time.Now(),
-		inbound, outbound, errChan, sr, cmdChan, logger, sync.WaitGroup{}}, nil
+	data := &roomData{
+		seen:        make(map[string]time.Time),
+		userLeaving: make(map[string]empty),
+		users:       make(map[string]User),
+		locale:      "en",
+		pending:     make(map[string]chan *PacketEvent),
+		features:    make(map[string]bool),
+		ignored:     make(map[string]string),
+		pendingSeen: make(map[string]int64),
+		msgCounts:   make(map[string]int),
+	}
+	for name, enabled := range roomCfg.Features {
+		data.features[name] = enabled
+	}
+	fetches := roomCfg.MaxConcurrentFetches
+	if fetches <= 0 {
+		fetches = DefaultMaxConcurrentFetches
+	}
+	src := roomCfg.RandSource
+	if src == nil {
+		src = rand.NewSource(time.Now().UnixNano())
+	}
+	return &Room{
+		name:     room,
+		data:     data,
+		config:   roomCfg,
+		db:       db,
+		handlers: handlers,
+		uptime:   time.Now(),
+		inbound:  inbound,
+		outbound: outbound,
+		errChan:  errChan,
+		unknown:  make(chan PacketEvent, 16),
+		fetchSem: make(chan empty, fetches),
+		sr:       sr,
+		cmdChan:  cmdChan,
+		Logger:   logger,
+		Rand:     newSharedRand(src),
+	}, nil
+}
+
+// replyTimeout bounds how long RawSendAndWait waits for a reply, and is the
+// default for request.
+const replyTimeout = time.Duration(10) * time.Second
+
+// ErrServerRejected is returned when the server replies to a command with an
+// error, for example because a message was too long or sent too quickly.
+type ErrServerRejected struct {
+	Type   PacketType
+	Reason string
+}
+
+func (e ErrServerRejected) Error() string {
+	return fmt.Sprintf("Server rejected %s: %s", e.Type, e.Reason)
+}
+
+// ErrReplyTimeout is returned when the server does not reply to a command in
+// time.
+var ErrReplyTimeout = errors.New("Timed out waiting for reply.")
+
+// ErrNotConnected is returned when a packet is sent before the room has
+// connected and outboundSize packets are already waiting to be sent. Packets
+// sent before the room connects are otherwise queued and sent once it does.
+var ErrNotConnected = errors.New("Room is not connected.")
+
+// ErrSendTimeout is returned when a packet could not be queued to send within
+// the RoomConfig's SendTimeout, for example because the connection is stalled.
+var ErrSendTimeout = errors.New("Timed out waiting to send.")
+
+// ErrReadOnly is returned by SendText and SendTextAndWait when the room is
+// read-only.
+var ErrReadOnly = errors.New("Room is read-only.")
+
+// outboundSize is the number of packets that can be queued to send before
+// senders block.
+const outboundSize = 64
+
+// DefaultNickRetries is the number of alternative nicks SetNick tries when
+// the RoomConfig does not specify NickRetries.
+const DefaultNickRetries = 3
+
+// nextPacketID allocates the ID of an outgoing packet. IDs are sequential
+// from "0" and unique for the life of the Room, even across reconnects.
+func (r *Room) nextPacketID() string {
+	return strconv.FormatUint(atomic.AddUint64(&r.packetIDs, 1)-1, 10)
+}
+
+// LastPacketID returns the most recently allocated outgoing packet ID, or ""
+// if no packets have been sent, for debugging.
+func (r *Room) LastPacketID() string {
+	n := atomic.LoadUint64(&r.packetIDs)
+	if n == 0 {
+		return ""
+	}
+	return strconv.FormatUint(n-1, 10)
 }
 
-func (r *Room) sendPayload(payload interface{}, pType PacketType) {
-	msg, err := MakePacket(strconv.Itoa(r.data.msgID), pType, payload)
+func (r *Room) sendPacket(id string, payload interface{}, pType PacketType) error {
+	msg, err := MakePacket(id, pType, payload)
 	if err != nil {
 		r.Logger.Errorf("Error sending payload type %s: %v", pType, payload)
+		return err
 	}
-	go func() {
+	if atomic.LoadInt32(&r.connected) == 0 {
+		// Nothing is sending, so a full queue would block forever.
+		select {
+		case r.outbound <- msg:
+			return nil
+		default:
+			return ErrNotConnected
+		}
+	}
+	// Packets are queued synchronously so that the SenderReceiver's single
+	// writer sends them in the order they were sent.
+	atomic.AddInt32(&r.pendingSends, 1)
+	defer atomic.AddInt32(&r.pendingSends, -1)
+	if r.config.SendTimeout <= 0 {
 		r.outbound <- msg
+		return nil
+	}
+	timer := time.NewTimer(r.config.SendTimeout)
+	defer timer.Stop()
+	select {
+	case r.outbound <- msg:
+		return nil
+	case <-timer.C:
+		return ErrSendTimeout
+	}
+}
+
+func (r *Room) sendPayload(payload interface{}, pType PacketType) (string, error) {
+	id := r.nextPacketID()
+	return id, r.sendPacket(id, payload, pType)
+}
+
+// RawSend sends a packet of any type with the given payload, for commands the
+// library does not support directly. It returns the packet's ID, which the
+// server's reply will carry.
+func (r *Room) RawSend(msgType PacketType, payload interface{}) (string, error) {
+	return r.sendPayload(payload, msgType)
+}
+
+// RawSendAndWait sends a packet like RawSend and waits for the server's reply,
+// returning the reply's data. A reply carrying an error is returned along with
+// an ErrServerRejected.
+func (r *Room) RawSendAndWait(msgType PacketType, payload interface{}) (json.RawMessage, error) {
+	reply, err := r.request(msgType, payload, replyTimeout)
+	if reply == nil {
+		return nil, err
+	}
+	return reply.Data, err
+}
+
+// request sends a command with a new packet ID and waits up to timeout, or
+// replyTimeout if timeout is not positive, for the server's reply with the
+// same ID. A reply carrying an error is returned along with an
+// ErrServerRejected. All
+// request/reply commands go through request, so that replies are correlated
+// in one place.
+func (r *Room) request(msgType PacketType, payload interface{}, timeout time.Duration) (*PacketEvent, error) {
+	if timeout <= 0 {
+		timeout = replyTimeout
+	}
+	id := r.nextPacketID()
+	replyCh := make(chan *PacketEvent, 1)
+	r.data.Lock()
+	r.data.pending[id] = replyCh
+	r.data.Unlock()
+	defer func() {
+		r.data.Lock()
+		delete(r.data.pending, id)
+		r.data.Unlock()
 	}()
-	r.data.msgID++
+	if err := r.sendPacket(id, payload, msgType); err != nil {
+		return nil, err
+	}
+	select {
+	case reply := <-replyCh:
+		if reply.Error != "" {
+			return reply, ErrServerRejected{Type: msgType, Reason: reply.Error}
+		}
+		return reply, nil
+	case <-time.After(timeout):
+		return nil, ErrReplyTimeout
+	}
+}
+
+// deliverReply hands packet to a caller of request awaiting it, and
+// reports whether there was one.
+func (r *Room) deliverReply(packet *PacketEvent) bool {
+	if packet.ID == "" {
+		return false
+	}
+	r.data.Lock()
+	replyCh, ok := r.data.pending[packet.ID]
+	r.data.Unlock()
+	if ok {
+		select {
+		case replyCh <- packet:
+		default:
+		}
+	}
+	return ok
 }
 
-// Auth sends an authentication packet with the given password.
+// UnknownPackets returns a channel that receives packets whose type is not
+// recognized by Payload or whose payload could not be unmarshalled, so that
+// applications can log or handle new protocol events. Replies collected by
+// request are not included. The channel is buffered and must be
+// drained; packets arriving while it is full are dropped.
+func (r *Room) UnknownPackets() <-chan PacketEvent {
+	return r.unknown
+}
+
+func (r *Room) reportUnknown(packet *PacketEvent) {
+	if _, err := packet.Payload(); err == nil {
+		return
+	}
+	select {
+	case r.unknown <- *packet:
+	default:
+		r.Logger.Debugf("Dropped unknown packet of type %s and ID %s", packet.Type, packet.ID)
+	}
+}
+
+// SendAuth sends an authentication packet with the room's passcode.
 func (r *Room) SendAuth() {
+	passcode, err := r.passcode()
+	if err != nil {
+		r.Logger.Errorf("Error getting passcode: %s", err)
+		return
+	}
 	payload := AuthCommand{
 		Type:     "passcode",
-		Passcode: r.config.Password}
+		Passcode: passcode}
 	r.sendPayload(payload, AuthType)
 }
 
-// SendText sends a text message to the euphoria room.
-func (r *Room) SendText(text string, parent string) {
-	payload := SendCommand{
-		Content: text,
-		Parent:  parent}
-	r.sendPayload(payload, SendType)
+// SetReadOnly enables or disables read-only mode. In read-only mode the room
+// never posts messages; pings, auth and nick packets are still sent so the
+// connection stays alive.
+func (r *Room) SetReadOnly(readOnly bool) {
+	r.data.Lock()
+	defer r.data.Unlock()
+	r.data.readOnly = readOnly
+}
+
+// IsReadOnly reports whether the room is in read-only mode.
+func (r *Room) IsReadOnly() bool {
+	r.data.Lock()
+	defer r.data.Unlock()
+	return r.data.readOnly
+}
+
+// SendText sends a text message to the euphoria room. In read-only mode it
+// sends nothing and returns ErrReadOnly. If the RoomConfig's ConfirmSends is
+// set it waits for the server's reply, returning an ErrServerRejected if the
+// server refused the message; otherwise it returns once the message is queued.
+func (r *Room) SendText(text string, parent string) error {
+	_, err := r.sendCommand(SendCommand{Content: text, Parent: parent}, r.config.ConfirmSends)
+	return err
+}
+
+// Send sends cmd as given and waits for the server's reply, returning the ID
+// of the sent message. It is SendText for callers that need the message ID
+// or control over the whole SendCommand. A handler calling it blocks for the
+// round trip, at most ten seconds, while its packets are queued.
+func (r *Room) Send(cmd SendCommand) (string, error) {
+	msg, err := r.sendCommand(cmd, true)
+	if err != nil {
+		return "", err
+	}
+	return msg.ID, nil
+}
+
+// sendCommand sends cmd, unless the room is read-only. If wait is set it
+// waits for the server's reply and returns the message as sent; otherwise it
+// returns a nil message once cmd is queued.
+func (r *Room) sendCommand(cmd SendCommand, wait bool) (*Message, error) {
+	if r.IsReadOnly() {
+		r.Logger.Debugf("Read-only mode, not sending message: %s", cmd.Content)
+		return nil, ErrReadOnly
+	}
+	cmd.Content = ValidUTF8(cmd.Content)
+	if !wait {
+		_, err := r.sendPayload(cmd, SendType)
+		if err != nil {
+			r.Logger.Warningf("Could not send message: %s", err)
+		}
+		return nil, err
+	}
+	reply, err := r.request(SendType, cmd, replyTimeout)
+	if err != nil {
+		r.Logger.Warningf("Could not send message: %s", err)
+		return nil, err
+	}
+	var msg Message
+	if err := json.Unmarshal(reply.Data, &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// SendTextf sends a message formatted with fmt.Sprintf as a reply to parent.
+// String arguments are passed through SanitizeContent first, since they are
+// usually user-provided; the format itself is not.
+func (r *Room) SendTextf(parent string, format string, args ...interface{}) error {
+	// Sanitize a copy, since args may be the caller's own slice.
+	sanitized := make([]interface{}, len(args))
+	for i, arg := range args {
+		if s, ok := arg.(string); ok {
+			arg = SanitizeContent(s)
+		}
+		sanitized[i] = arg
+	}
+	return r.SendText(fmt.Sprintf(format, sanitized...), parent)
+}
+
+// SendTextAndWait sends a message like SendText and waits for the server's
+// reply, returning the message as sent.
+func (r *Room) SendTextAndWait(text string, parent string) (*Message, error) {
+	return r.sendCommand(SendCommand{Content: text, Parent: parent}, true)
+}
+
+// GetMessage fetches the message with the given ID from the server, with its
+// full content.
+func (r *Room) GetMessage(msgID string) (*Message, error) {
+	return r.getMessage(msgID, replyTimeout)
+}
+
+// getMessage is GetMessage, waiting up to timeout for the reply.
+func (r *Room) getMessage(msgID string, timeout time.Duration) (*Message, error) {
+	reply, err := r.request(GetMessageType, GetMessageCommand{ID: msgID}, timeout)
+	if err != nil {
+		return nil, err
+	}
+	var msg Message
+	if err := json.Unmarshal(reply.Data, &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
 }
 
 // SendPing sends a ping-reply, used in response to a ping-event.
@@ -145,6 +896,42 @@ func (r *Room) sendPing(time int64) {
 	r.sendPayload(payload, PingReplyType)
 }
 
+// SetNick sets the bot's nick and waits for the server to accept it. If the
+// nick is rejected, suffixed variants (nick2, nick3, ...) are tried up to the
+// configured number of retries. It returns the nick that was accepted.
+func (r *Room) SetNick(nick string) (string, error) {
+	retries := r.config.NickRetries
+	switch {
+	case retries == 0:
+		retries = DefaultNickRetries
+	case retries < 0:
+		retries = 0
+	}
+	var err error
+	for attempt := 1; attempt <= retries+1; attempt++ {
+		candidate := nick
+		if attempt > 1 {
+			candidate = nick + strconv.Itoa(attempt)
+		}
+		var data json.RawMessage
+		data, err = r.RawSendAndWait(NickType, NickCommand{Name: candidate})
+		if err == ErrReplyTimeout {
+			return "", err
+		}
+		if err != nil {
+			r.Logger.Warningf("Nick %s rejected: %s", candidate, err)
+			continue
+		}
+		var reply NickReply
+		if err := json.Unmarshal(data, &reply); err != nil {
+			return "", err
+		}
+		r.Logger.Infof("Nick set to %s", reply.To)
+		return reply.To, nil
+	}
+	return "", err
+}
+
 // SendNick sends a nick-event, setting the bot's nickname in the room.
 func (r *Room) SendNick(nick string) {
 	payload := NickCommand{Name: nick}
@@ -152,6 +939,10 @@ func (r *Room) SendNick(nick string) {
 }
 
 func (r *Room) storeSeen(user string, time int64) error {
+	if r.config.SeenFlushInterval > 0 {
+		r.batchSeen(user, time)
+		return nil
+	}
 	err := r.db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte("Seen"))
 		b.Put([]byte(user), []byte(strconv.FormatInt(time, 10)))
@@ -160,7 +951,102 @@ func (r *Room) storeSeen(user string, time int64) error {
 	return err
 }
 
+// backfillSeen records the senders of msgs as seen at the time of their
+// messages, keeping any later existing record.
+func (r *Room) backfillSeen(msgs []Message) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("Seen"))
+		for _, msg := range msgs {
+			user := []byte(strings.Replace(msg.Sender.Name, " ", "", -1))
+			if len(user) == 0 {
+				continue
+			}
+			if seenSince(b, user, msg.Time) {
+				continue
+			}
+			if err := b.Put(user, []byte(strconv.FormatInt(msg.Time, 10))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Name returns the name of the euphoria room.
+func (r *Room) Name() string {
+	return r.name
+}
+
+// Uptime returns the time at which the room was created.
+func (r *Room) Uptime() time.Time {
+	return r.uptime
+}
+
+// Ping sends a ping command and waits for the server's reply, recording the
+// round-trip time as the ping latency.
+func (r *Room) Ping() error {
+	start := time.Now()
+	if _, err := r.RawSendAndWait(PingType, PingCommand{UnixTime: start.Unix()}); err != nil {
+		return err
+	}
+	r.setPingLatency(time.Since(start))
+	return nil
+}
+
+// PingLatency returns the most recently measured ping latency, from either
+// Ping or the server's ping-events, or zero if none has been measured.
+func (r *Room) PingLatency() time.Duration {
+	r.data.Lock()
+	defer r.data.Unlock()
+	return r.data.pingLatency
+}
+
+func (r *Room) setPingLatency(latency time.Duration) {
+	r.data.Lock()
+	r.data.pingLatency = latency
+	r.data.Unlock()
+}
+
+// recordPingEvent estimates latency as the time between when the server sent
+// data and now. Ping-event times have one-second resolution, so the estimate
+// is coarse; clock skew making it negative is treated as zero latency.
+func (r *Room) recordPingEvent(data *PingEvent, now time.Time) {
+	latency := now.Sub(time.Unix(data.Time, 0))
+	if latency < 0 {
+		latency = 0
+	}
+	r.setPingLatency(latency)
+}
+
+// ReportError reports an error that a handler cannot recover from. The
+// dispatcher treats such errors as fatal.
+func (r *Room) ReportError(err error) {
+	r.errChan <- err
+}
+
+// StoreSeen records that user was seen at t.
+func (r *Room) StoreSeen(user string, t time.Time) error {
+	return r.storeSeen(user, t.Unix())
+}
+
+// LastSeen returns when user was last seen, or the zero time if they have not
+// been seen.
+func (r *Room) LastSeen(user string) (time.Time, error) {
+	seen, err := r.retrieveSeen(user)
+	if err != nil || seen == nil {
+		return time.Time{}, err
+	}
+	unix, err := strconv.ParseInt(string(seen), 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(unix, 0), nil
+}
+
 func (r *Room) retrieveSeen(user string) ([]byte, error) {
+	if pending, ok := r.pendingSeenTime(user); ok {
+		return []byte(strconv.FormatInt(pending, 10)), nil
+	}
 	var t []byte
 	err := r.db.View(func(tx *bolt.Tx) error {
 		t = tx.Bucket([]byte("Seen")).Get([]byte(user))
@@ -169,31 +1055,196 @@ func (r *Room) retrieveSeen(user string) ([]byte, error) {
 	return t, err
 }
 
+// maxHandlerQueue is the most packets queued for a handler that is not
+// keeping up; further packets for it are dropped until it catches up.
+const maxHandlerQueue = 1000
+
+// handlerEntry is a named handler and the channels used to drive it.
+type handlerEntry struct {
+	name    string
+	handler Handler
+	input   chan PacketEvent
+	cmdChan chan string
+	done    chan empty
+	// killed is set, atomically, once the handler has been told to exit.
+	killed int32
+	// queue holds the packets not yet fed to input, so that the dispatcher
+	// never waits for a busy handler; wake signals that one was added.
+	queueMu sync.Mutex
+	queue   []PacketEvent
+	wake    chan empty
+}
+
+func newHandlerEntry(name string, h Handler) *handlerEntry {
+	return &handlerEntry{
+		name:    name,
+		handler: h,
+		input:   make(chan PacketEvent, 4),
+		cmdChan: make(chan string, 1),
+		done:    make(chan empty),
+		wake:    make(chan empty, 1),
+	}
+}
+
+// enqueue queues packet for the handler, reporting false if the queue is full
+// and the packet was dropped. Packets for a handler that has exited are
+// discarded.
+func (e *handlerEntry) enqueue(packet PacketEvent) bool {
+	select {
+	case <-e.done:
+		return true
+	default:
+	}
+	e.queueMu.Lock()
+	defer e.queueMu.Unlock()
+	if len(e.queue) >= maxHandlerQueue {
+		return false
+	}
+	e.queue = append(e.queue, packet)
+	select {
+	case e.wake <- empty{}:
+	default:
+	}
+	return true
+}
+
+// queued returns how many packets are waiting to be fed to the handler.
+func (e *handlerEntry) queued() int {
+	e.queueMu.Lock()
+	defer e.queueMu.Unlock()
+	return len(e.queue) + len(e.input)
+}
+
+// pump feeds the queued packets to the handler's input in order until the
+// handler exits.
+func (e *handlerEntry) pump() {
+	for {
+		e.queueMu.Lock()
+		if len(e.queue) == 0 {
+			e.queueMu.Unlock()
+			select {
+			case <-e.wake:
+				continue
+			case <-e.done:
+				return
+			}
+		}
+		packet := e.queue[0]
+		e.queue[0] = PacketEvent{}
+		e.queue = e.queue[1:]
+		e.queueMu.Unlock()
+		select {
+		case e.input <- packet:
+		case <-e.done:
+			return
+		}
+	}
+}
+
+func (r *Room) startHandler(e *handlerEntry) {
+	r.wg.Add(2)
+	go func() {
+		defer r.wg.Done()
+		defer close(e.done)
+		r.superviseHandler(e)
+	}()
+	go func() {
+		defer r.wg.Done()
+		e.pump()
+	}()
+}
+
+func (r *Room) handlerSnapshot() []*handlerEntry {
+	r.handlersMu.Lock()
+	defer r.handlersMu.Unlock()
+	entries := make([]*handlerEntry, len(r.handlers))
+	copy(entries, r.handlers)
+	return entries
+}
+
+// AddHandler registers a handler under name. If the room is running the
+// handler is started immediately, otherwise it starts with the room.
+func (r *Room) AddHandler(name string, h Handler) error {
+	r.handlersMu.Lock()
+	defer r.handlersMu.Unlock()
+	for _, e := range r.handlers {
+		if e.name == name {
+			return fmt.Errorf("Handler already registered: %s", name)
+		}
+	}
+	e := newHandlerEntry(name, h)
+	r.handlers = append(r.handlers, e)
+	if r.running {
+		r.startHandler(e)
+	}
+	return nil
+}
+
+// RemoveHandler stops the handler registered under name and waits for it to
+// exit.
+func (r *Room) RemoveHandler(name string) error {
+	r.handlersMu.Lock()
+	var removed *handlerEntry
+	for i, e := range r.handlers {
+		if e.name == name {
+			removed = e
+			r.handlers = append(r.handlers[:i], r.handlers[i+1:]...)
+			break
+		}
+	}
+	running := r.running
+	r.handlersMu.Unlock()
+	if removed == nil {
+		return fmt.Errorf("No handler registered: %s", name)
+	}
+	if running {
+		removed.kill("kill")
+		<-removed.done
+	}
+	return nil
+}
+
 func (r *Room) dispatcher() {
-	var fanout [](chan PacketEvent)
-	var cmdChans [](chan string)
-	for i, h := range r.handlers {
-		fanout = append(fanout, make(chan PacketEvent, 4))
-		cmdChans = append(cmdChans, make(chan string, 1))
-		r.wg.Add(1)
-		go func(hd Handler, msgCh chan PacketEvent, cmdCh chan string) {
-			defer r.wg.Done()
-			hd(r, msgCh, cmdCh)
-		}(h, fanout[i], cmdChans[i])
+	r.handlersMu.Lock()
+	for _, e := range r.handlers {
+		r.startHandler(e)
 	}
+	r.running = true
+	r.handlersMu.Unlock()
 	for {
 		select {
 		case inboundMsg := <-r.inbound:
-			for _, channel := range fanout {
-				channel <- *inboundMsg
+			atomic.AddUint64(&r.packetsProcessed, 1)
+			r.record(inboundMsg)
+			if !r.deliverReply(inboundMsg) {
+				r.reportUnknown(inboundMsg)
+			}
+			r.trackPresence(inboundMsg)
+			r.countMessage(inboundMsg)
+			if r.fromIgnored(inboundMsg) || r.intercept(inboundMsg) {
+				continue
+			}
+			// Handlers are fed through their queues, so that one waiting in
+			// request cannot keep the dispatcher from delivering its reply.
+			for _, e := range r.handlerSnapshot() {
+				if !e.enqueue(*inboundMsg) {
+					r.Logger.Warningf("Handler %s is not keeping up, dropping %s packet", e.name, inboundMsg.Type)
+				}
 			}
 		case cmd := <-r.cmdChan:
-			for _, channel := range cmdChans {
-				channel <- cmd
+			r.handlersMu.Lock()
+			r.running = false
+			r.handlersMu.Unlock()
+			for _, e := range r.handlerSnapshot() {
+				e.kill(cmd)
 			}
 			r.Logger.Warningf("command received and dispatched, exiting: %s", cmd)
 			return
 		case err := <-r.errChan:
+			if r.config.RestartPolicy != nil {
+				r.Logger.Errorf("Error received from handler: %s", err)
+				continue
+			}
 			r.Logger.Fatalf("Unhandled error received from handler: %s\n", err)
 		}
 	}
@@ -203,18 +1254,70 @@ func (r *Room) dispatcher() {
 func (r *Room) Run() {
 	if err := r.sr.connect(r); err != nil {
 		r.Logger.Error("Could not connect to euphoria.")
+	} else {
+		atomic.StoreInt32(&r.connected, 1)
 	}
 	go r.sr.start(r, r.inbound, r.outbound)
 	r.dispatcher()
 }
 
+// Shutdown stops the room without waiting for it to stop, so it is safe to
+// call from a handler. Packets already sent are handed to the SenderReceiver
+// before the handlers and send loop are stopped.
+func (r *Room) Shutdown() {
+	go func() {
+		for atomic.LoadInt32(&r.pendingSends) > 0 || len(r.outbound) > 0 {
+			time.Sleep(time.Duration(10) * time.Millisecond)
+		}
+		r.Stop()
+	}()
+}
+
+// closeTimeout bounds how long Close waits for queued packets to be sent.
+const closeTimeout = time.Duration(5) * time.Second
+
+// Close stops the room if it is running, after giving queued packets up to
+// closeTimeout to be sent, and waits for its handlers to exit. It then closes
+// the connection and syncs and closes the store, returning the first error
+// encountered.
+func (r *Room) Close() error {
+	r.handlersMu.Lock()
+	running := r.running
+	r.handlersMu.Unlock()
+	if running {
+		deadline := time.Now().Add(closeTimeout)
+		for (atomic.LoadInt32(&r.pendingSends) > 0 || len(r.outbound) > 0) && time.Now().Before(deadline) {
+			time.Sleep(time.Duration(10) * time.Millisecond)
+		}
+		r.Stop()
+	}
+	r.RecordTo(nil)
+	var first error
+	if err := r.flushSeen(); err != nil {
+		first = err
+	}
+	if err := r.sr.close(); err != nil && first == nil {
+		first = err
+	}
+	if err := r.db.Sync(); err != nil && first == nil {
+		first = err
+	}
+	if err := r.db.Close(); err != nil && first == nil {
+		first = err
+	}
+	return first
+}
+
 func (r *Room) Stop() {
+	atomic.StoreInt32(&r.connected, 0)
 	r.cmdChan <- "kill"
 	r.sr.stop()
 	r.wg.Wait()
 }
 
 func (r *Room) isUserLeaving(user string) bool {
+	r.data.Lock()
+	defer r.data.Unlock()
 	if _, ok := r.data.userLeaving[user]; ok {
 		return true
 	}
@@ -222,9 +1325,140 @@ func (r *Room) isUserLeaving(user string) bool {
 }
 
 func (r *Room) clearUserLeaving(user string) {
+	r.data.Lock()
 	delete(r.data.userLeaving, user)
+	r.data.Unlock()
 }
 
 func (r *Room) setUserLeaving(user string) {
+	r.data.Lock()
 	r.data.userLeaving[user] = empty{}
+	r.data.Unlock()
+}
+
+type usersByName []User
+
+func (u usersByName) Len() int      { return len(u) }
+func (u usersByName) Swap(i, j int) { u[i], u[j] = u[j], u[i] }
+func (u usersByName) Less(i, j int) bool {
+	if u[i].Name != u[j].Name {
+		return u[i].Name < u[j].Name
+	}
+	return u[i].ID < u[j].ID
+}
+
+// trackPresence updates the roster of present users from snapshot, join, part
+// and nick events, and the bot's own session and nick from snapshot events,
+// nick replies, and nick events for its session, which it learns from hello
+// and snapshot events.
+func (r *Room) trackPresence(packet *PacketEvent) {
+	switch packet.Type {
+	case HelloEventType, SnapshotEventType, JoinEventType, PartEventType, NickEventType:
+	case NickReplyType:
+		if packet.Error != "" {
+			return
+		}
+	default:
+		return
+	}
+	payload, err := packet.Payload()
+	if err != nil {
+		r.Logger.Errorf("Error tracking presence: %s", err)
+		return
+	}
+	r.data.Lock()
+	defer r.data.Unlock()
+	switch data := payload.(type) {
+	case *HelloEvent:
+		r.data.sessionID = data.Session.SessionID
+		r.data.userID = data.Session.ID
+	case *SnapshotEvent:
+		r.data.sessionID = data.SessionID
+		r.data.users = make(map[string]User)
+		for _, session := range data.Listing {
+			if session.User != nil {
+				r.data.users[session.SessionID] = *session.User
+			}
+		}
+	case *PresenceEvent:
+		if data.User == nil {
+			return
+		}
+		if packet.Type == JoinEventType {
+			r.data.users[data.SessionID] = *data.User
+		} else {
+			delete(r.data.users, data.SessionID)
+		}
+	case *NickReply:
+		r.setNick(data.To)
+	case *NickEvent:
+		if data.SessionID != "" && data.SessionID == r.data.sessionID {
+			r.setNick(data.To)
+		}
+		if classifyNickEvent(data) == nickPart {
+			delete(r.data.users, data.SessionID)
+			return
+		}
+		user, ok := r.data.users[data.SessionID]
+		if !ok {
+			user = User{ID: data.ID}
+		}
+		user.Name = data.To
+		r.data.users[data.SessionID] = user
+	}
+}
+
+// nickUpdate is a change of the bot's nick, for OnNickChange.
+type nickUpdate struct {
+	from, to string
+}
+
+// setNick records nick as the bot's own, queueing a call to OnNickChange if
+// it changed. r.data must be locked.
+func (r *Room) setNick(nick string) {
+	from := r.data.nick
+	r.data.nick = nick
+	if from == nick || r.config.OnNickChange == nil {
+		return
+	}
+	r.data.nickChanges = append(r.data.nickChanges, nickUpdate{from: from, to: nick})
+	if len(r.data.nickChanges) == 1 {
+		go r.deliverNickChanges()
+	}
+}
+
+// deliverNickChanges calls OnNickChange for each queued change in turn until
+// the queue is empty. A change stays queued until its call returns, so that
+// only one goroutine delivers changes at a time.
+func (r *Room) deliverNickChanges() {
+	r.data.Lock()
+	for len(r.data.nickChanges) > 0 {
+		change := r.data.nickChanges[0]
+		r.data.Unlock()
+		r.config.OnNickChange(r, change.from, change.to)
+		r.data.Lock()
+		r.data.nickChanges = r.data.nickChanges[1:]
+	}
+	r.data.Unlock()
+}
+
+// Nick returns the bot's current nick, as last confirmed by the server, or ""
+// if no nick has been set.
+func (r *Room) Nick() string {
+	r.data.Lock()
+	defer r.data.Unlock()
+	return r.data.nick
+}
+
+// Users returns a snapshot of the users currently present in the room, sorted
+// by name.
+func (r *Room) Users() []User {
+	r.data.Lock()
+	defer r.data.Unlock()
+	users := make([]User, 0, len(r.data.users))
+	for _, user := range r.data.users {
+		users = append(users, user)
+	}
+	sort.Sort(usersByName(users))
+	return users
 }
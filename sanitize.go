@@ -0,0 +1,43 @@
+package maimai
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ValidUTF8 returns s with each invalid UTF-8 sequence replaced by the
+// Unicode replacement character, so that user content is always valid when
+// stored or echoed.
+func ValidUTF8(s string) string {
+	if utf8.ValidString(s) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			b.WriteRune(utf8.RuneError)
+		} else {
+			b.WriteString(s[i : i+size])
+		}
+		i += size
+	}
+	return b.String()
+}
+
+// SanitizeContent strips control and invisible formatting characters, such as
+// zero-width spaces and bidirectional overrides, from s. These can be used to
+// make text echoed by the bot render strangely or spoof another user's nick.
+// Newlines and tabs are kept, and invalid UTF-8 is replaced as by ValidUTF8.
+func SanitizeContent(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '\n' || r == '\t' {
+			return r
+		}
+		if unicode.IsControl(r) || unicode.Is(unicode.Cf, r) {
+			return -1
+		}
+		return r
+	}, s)
+}
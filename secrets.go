@@ -0,0 +1,80 @@
+package maimai
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// SecretProvider supplies room passcodes, so that they need not be stored in
+// the configuration. Implementations may fetch them from a secret store.
+type SecretProvider interface {
+	Passcode(room string) (string, error)
+}
+
+// EnvSecretProvider reads a room's passcode from the environment variable
+// Prefix followed by the room name in upper case, for example
+// MAIMAI_PASSCODE_TEST for the room "test". There is deliberately no fallback
+// shared by every room, which would hand one room's passcode to all the
+// others. If Prefix is empty, "MAIMAI_PASSCODE_" is used.
+type EnvSecretProvider struct {
+	Prefix string
+}
+
+// DefaultPasscodeEnvPrefix is the variable prefix EnvSecretProvider uses when
+// none is given.
+const DefaultPasscodeEnvPrefix = "MAIMAI_PASSCODE_"
+
+func (p EnvSecretProvider) Passcode(room string) (string, error) {
+	prefix := p.Prefix
+	if prefix == "" {
+		prefix = DefaultPasscodeEnvPrefix
+	}
+	name := strings.Map(func(r rune) rune {
+		if r > unicode.MaxASCII || !(unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			return '_'
+		}
+		return unicode.ToUpper(r)
+	}, room)
+	return os.Getenv(prefix + name), nil
+}
+
+// passcode returns the room's passcode: the RoomConfig's Password if set, and
+// otherwise the passcode from its Secrets, or from an EnvSecretProvider if
+// Secrets is nil.
+func (r *Room) passcode() (string, error) {
+	if r.config.Password != "" {
+		return r.config.Password, nil
+	}
+	secrets := r.config.Secrets
+	if secrets == nil {
+		secrets = EnvSecretProvider{}
+	}
+	return secrets.Passcode(r.name)
+}
+
+// Authenticate sends the room's passcode and waits for the server to accept
+// it. It returns ErrAuthRequired if there is no passcode to send.
+func (r *Room) Authenticate() error {
+	passcode, err := r.passcode()
+	if err != nil {
+		return err
+	}
+	if passcode == "" {
+		return ErrAuthRequired
+	}
+	data, err := r.RawSendAndWait(AuthType, AuthCommand{Type: "passcode", Passcode: passcode})
+	if err != nil {
+		return err
+	}
+	var reply AuthReply
+	if err := json.Unmarshal(data, &reply); err != nil {
+		return err
+	}
+	if !reply.Success {
+		return fmt.Errorf("Authentication failed: %s", reply.Reason)
+	}
+	return nil
+}
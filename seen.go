@@ -0,0 +1,70 @@
+package maimai
+
+import (
+	"strconv"
+
+	"github.com/boltdb/bolt"
+)
+
+// batchSeen records user as seen at time in memory, to be written to the
+// store by the next flushSeen.
+func (r *Room) batchSeen(user string, time int64) {
+	r.data.Lock()
+	r.data.pendingSeen[user] = time
+	r.data.Unlock()
+}
+
+// pendingSeenTime returns the time user was seen, if it has yet to be
+// flushed.
+func (r *Room) pendingSeenTime(user string) (int64, bool) {
+	r.data.Lock()
+	defer r.data.Unlock()
+	t, ok := r.data.pendingSeen[user]
+	return t, ok
+}
+
+// seenSince reports whether b records user as seen at or after t.
+func seenSince(b *bolt.Bucket, user []byte, t int64) bool {
+	seen := b.Get(user)
+	if seen == nil {
+		return false
+	}
+	stored, err := strconv.ParseInt(string(seen), 10, 64)
+	return err == nil && stored >= t
+}
+
+// flushSeen writes the batched seen records to the store in a single
+// transaction, keeping any later record already stored, such as one written
+// by backfillSeen. If the write fails the records are kept, unless
+// superseded meanwhile, so that the next flush retries them.
+func (r *Room) flushSeen() error {
+	r.data.Lock()
+	pending := r.data.pendingSeen
+	r.data.pendingSeen = make(map[string]int64)
+	r.data.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+	err := r.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("Seen"))
+		for user, t := range pending {
+			if seenSince(b, []byte(user), t) {
+				continue
+			}
+			if err := b.Put([]byte(user), []byte(strconv.FormatInt(t, 10))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		r.data.Lock()
+		for user, t := range pending {
+			if _, ok := r.data.pendingSeen[user]; !ok {
+				r.data.pendingSeen[user] = t
+			}
+		}
+		r.data.Unlock()
+	}
+	return err
+}
@@ -0,0 +1,82 @@
+package maimai
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// SpamAction is what SpamFilterHandler does with a message matching one of
+// its patterns.
+type SpamAction int
+
+const (
+	// SpamLog only logs the message.
+	SpamLog SpamAction = iota
+	// SpamWarn logs the message and warns its sender.
+	SpamWarn
+	// SpamDelete logs and deletes the message, which requires the bot to
+	// be a manager of the room. If the deletion fails the sender is warned
+	// instead.
+	SpamDelete
+)
+
+// compileSpamPatterns compiles patterns, reporting the first invalid one.
+func compileSpamPatterns(patterns []string) ([]*regexp.Regexp, error) {
+	res := make([]*regexp.Regexp, len(patterns))
+	for i, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid spam pattern '%s': %s", pattern, err)
+		}
+		res[i] = re
+	}
+	return res, nil
+}
+
+// NewSpamFilterHandler returns a handler that takes action on send-events
+// whose content matches any of patterns, which are regular expressions. An
+// invalid pattern is reported as an error.
+func NewSpamFilterHandler(patterns []string, action SpamAction) (Handler, error) {
+	res, err := compileSpamPatterns(patterns)
+	if err != nil {
+		return nil, err
+	}
+	return func(room *Room, input chan PacketEvent, cmdChan chan string) {
+		for {
+			select {
+			case packet := <-input:
+				if packet.Type != SendEventType {
+					continue
+				}
+				data := GetMessagePayload(&packet)
+				var matched *regexp.Regexp
+				for _, re := range res {
+					if re.MatchString(data.Content) {
+						matched = re
+						break
+					}
+				}
+				if matched == nil {
+					continue
+				}
+				room.Logger.Warningf("Spam from %s (%s) matched %s: %s", data.Sender.Name, data.Sender.ID, matched, data.Content)
+				switch action {
+				case SpamDelete:
+					_, err := room.DeleteMessage(data.ID)
+					if err == nil {
+						continue
+					}
+					room.Logger.Errorf("Could not delete spam %s: %s", data.ID, err)
+					fallthrough
+				case SpamWarn:
+					room.reply(data, room.render("spam", map[string]interface{}{
+						"User": SanitizeContent(data.Sender.Name)}))
+				}
+			case cmd := <-cmdChan:
+				if cmd == "kill" {
+					return
+				}
+			}
+		}
+	}, nil
+}
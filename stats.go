@@ -0,0 +1,84 @@
+package maimai
+
+import (
+	"fmt"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// SysStats is a snapshot of the bot's resource usage, reported by !sysstats.
+type SysStats struct {
+	Uptime     time.Duration
+	Goroutines int
+	HeapAlloc  uint64
+	Handlers   int
+	Packets    uint64
+}
+
+// SysStats returns the bot's current resource usage. Handlers counts the
+// handlers that have not exited and Packets the packets received since the
+// room started running.
+func (r *Room) SysStats() SysStats {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	handlers := 0
+	for _, e := range r.handlerSnapshot() {
+		select {
+		case <-e.done:
+		default:
+			handlers++
+		}
+	}
+	return SysStats{
+		Uptime:     time.Since(r.uptime),
+		Goroutines: runtime.NumGoroutine(),
+		HeapAlloc:  mem.HeapAlloc,
+		Handlers:   handlers,
+		Packets:    atomic.LoadUint64(&r.packetsProcessed),
+	}
+}
+
+// formatBytes renders n in the largest binary unit that keeps it at least 1,
+// e.g. "1.5 MiB".
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// SysStatsCommandHandler handles a send-event, checks for a !sysstats
+// command, and replies with the bot's resource usage. It should be wrapped
+// with WithAdminOnly.
+func SysStatsCommandHandler(room *Room, input chan PacketEvent, cmdChan chan string) {
+	for {
+		select {
+		case packet := <-input:
+			if packet.Type != SendEventType {
+				continue
+			}
+			data := GetMessagePayload(&packet)
+			if room.commandContent(data.Content) != "!sysstats" {
+				continue
+			}
+			stats := room.SysStats()
+			room.reply(data, room.render("sysstats", map[string]interface{}{
+				"Uptime":     stats.Uptime.Truncate(time.Second).String(),
+				"Goroutines": stats.Goroutines,
+				"Heap":       formatBytes(stats.HeapAlloc),
+				"Handlers":   stats.Handlers,
+				"Packets":    stats.Packets}))
+		case cmd := <-cmdChan:
+			if cmd == "kill" {
+				return
+			}
+		}
+	}
+}
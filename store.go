@@ -0,0 +1,30 @@
+package maimai
+
+import "time"
+
+// storeAttempts is how many times retryStore tries a store write, and
+// storeRetryDelay how long it waits after the first failure, doubling after
+// each further one.
+const (
+	storeAttempts   = 3
+	storeRetryDelay = time.Duration(100) * time.Millisecond
+)
+
+// retryStore runs op, a write to the store, retrying it if it fails so that
+// a briefly unavailable store, such as one that is locked, does not stop the
+// calling handler. The last error is returned if every attempt fails.
+func (r *Room) retryStore(what string, op func() error) error {
+	delay := storeRetryDelay
+	var err error
+	for attempt := 1; attempt <= storeAttempts; attempt++ {
+		if err = op(); err == nil {
+			return nil
+		}
+		if attempt < storeAttempts {
+			r.Logger.Warningf("Error storing %s, retrying in %s: %s", what, delay, err)
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+	return err
+}
@@ -0,0 +1,76 @@
+package maimai
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// RestartPolicy controls the restarting of handlers that exit other than by
+// being killed, typically after reporting an error. A handler is restarted
+// until it has been restarted MaxRestarts times within Window, after which it
+// is left stopped.
+type RestartPolicy struct {
+	MaxRestarts int
+	Window      time.Duration
+}
+
+// allow reports whether a handler that has been restarted at the times in
+// restarts may be restarted again at now, and returns the restarts still
+// within the window.
+func (p *RestartPolicy) allow(restarts []time.Time, now time.Time) (bool, []time.Time) {
+	recent := restarts[:0]
+	for _, t := range restarts {
+		if now.Sub(t) < p.Window {
+			recent = append(recent, t)
+		}
+	}
+	return len(recent) < p.MaxRestarts, recent
+}
+
+// kill asks e to exit cleanly, returning false if it has already exited.
+func (e *handlerEntry) kill(cmd string) bool {
+	if cmd == "kill" {
+		atomic.StoreInt32(&e.killed, 1)
+	}
+	select {
+	case e.cmdChan <- cmd:
+		return true
+	case <-e.done:
+		return false
+	}
+}
+
+// runHandler runs e's handler once, reporting whether it exited because it
+// was killed. When the room has a RestartPolicy, a panicking handler is
+// recovered and treated as exiting abnormally.
+func (r *Room) runHandler(e *handlerEntry) (killed bool) {
+	if r.config.RestartPolicy != nil {
+		defer func() {
+			if p := recover(); p != nil {
+				r.Logger.Errorf("Handler %s panicked: %v", e.name, p)
+				killed = false
+			}
+		}()
+	}
+	e.handler(r, e.input, e.cmdChan)
+	return atomic.LoadInt32(&e.killed) == 1
+}
+
+// superviseHandler runs e's handler, restarting it according to the room's
+// RestartPolicy when it exits without being killed.
+func (r *Room) superviseHandler(e *handlerEntry) {
+	var restarts []time.Time
+	for {
+		if r.runHandler(e) || r.config.RestartPolicy == nil {
+			return
+		}
+		var ok bool
+		ok, restarts = r.config.RestartPolicy.allow(restarts, time.Now())
+		if !ok {
+			r.Logger.Errorf("Handler %s exited too often, not restarting it.", e.name)
+			return
+		}
+		restarts = append(restarts, time.Now())
+		r.Logger.Warningf("Handler %s exited, restarting it.", e.name)
+	}
+}
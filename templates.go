@@ -0,0 +1,116 @@
+package maimai
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"text/template"
+)
+
+// englishCatalog holds the built-in reply templates, rendered with
+// text/template. It is the default locale and the fallback for keys missing
+// from other locales.
+var englishCatalog = map[string]string{
+	"join":         "< {{.User}} joined the room. >",
+	"part":         "< {{.User}} left the room. >",
+	"nick":         "< {{.From}} is now known as {{.To}}. >",
+	"seen":         "Seen {{.Hours}} hours ago.",
+	"seen.never":   "User has not been seen yet.",
+	"seen.here":    "{{.User}} is here now.",
+	"unavailable":  "Sorry, that is temporarily unavailable.",
+	"seen.fuzzy":   "Assuming you meant @{{.Nick}}: seen {{.Hours}} hours ago.",
+	"seen.which":   "Did you mean {{.Nicks}}?",
+	"uptime":       "This bot has been up for {{.Uptime}}.",
+	"unauthorized": "You are not authorized to do that.",
+	"permission":   "Only {{.Level}}s can do that.",
+	"shutdown":     "Goodbye!",
+	"feature.on":   "Feature {{.Name}} is now on.",
+	"feature.off":  "Feature {{.Name}} is now off.",
+	"feature.bad":  "Unknown feature {{.Name}}. Features are {{.Names}}.",
+	"flood":        "{{.User}}, please slow down.",
+	"spam":         "{{.User}}, that message looks like spam.",
+	"ignore.on":    "Ignoring {{.User}}.",
+	"ignore.off":   "No longer ignoring {{.User}}.",
+	"ignore.deny":  "{{.User}} can't be ignored.",
+	"sysstats":     "Up {{.Uptime}}: {{.Goroutines}} goroutines, {{.Heap}} heap, {{.Handlers}} handlers, {{.Packets}} packets processed.",
+
+	"command.unknown": "Unknown command {{.Command}}. Did you mean {{.Suggestion}}?",
+}
+
+var (
+	localesMu sync.RWMutex
+	locales   = map[string]map[string]string{"en": englishCatalog}
+)
+
+// RegisterLocale registers a message catalog for lang, replacing any catalog
+// previously registered for it. Keys missing from the catalog fall back to
+// English.
+func RegisterLocale(lang string, catalog map[string]string) {
+	copied := make(map[string]string, len(catalog))
+	for k, v := range catalog {
+		copied[k] = v
+	}
+	localesMu.Lock()
+	defer localesMu.Unlock()
+	locales[lang] = copied
+}
+
+func lookupMessage(lang string, key string) string {
+	localesMu.RLock()
+	defer localesMu.RUnlock()
+	if text, ok := locales[lang][key]; ok {
+		return text
+	}
+	return englishCatalog[key]
+}
+
+// SetLocale selects the message catalog used for the room's built-in
+// messages. The locale must have been registered with RegisterLocale.
+func (r *Room) SetLocale(lang string) error {
+	localesMu.RLock()
+	_, ok := locales[lang]
+	localesMu.RUnlock()
+	if !ok {
+		return fmt.Errorf("Unknown locale: %s", lang)
+	}
+	r.data.Lock()
+	defer r.data.Unlock()
+	r.data.locale = lang
+	return nil
+}
+
+func (r *Room) locale() string {
+	r.data.Lock()
+	defer r.data.Unlock()
+	return r.data.locale
+}
+
+func executeTemplate(text string, data interface{}) (string, error) {
+	tmpl, err := template.New("").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// render executes the named message with data. A template overridden in the
+// room's config takes precedence over the room's locale; if it fails to
+// render, the locale's message is used instead.
+func (r *Room) render(name string, data interface{}) string {
+	if text, ok := r.config.Templates[name]; ok {
+		out, err := executeTemplate(text, data)
+		if err == nil {
+			return out
+		}
+		r.Logger.Errorf("Error rendering template %s: %s", name, err)
+	}
+	out, err := executeTemplate(lookupMessage(r.locale(), name), data)
+	if err != nil {
+		r.Logger.Errorf("Error rendering message %s: %s", name, err)
+	}
+	return out
+}
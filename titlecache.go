@@ -0,0 +1,139 @@
+package maimai
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultLinkTitleWindow is how long after a link's title is posted that it
+// is not posted again when the RoomConfig does not specify LinkTitleWindow.
+const DefaultLinkTitleWindow = time.Duration(60) * time.Second
+
+// DefaultLinkTitleCacheTTL is how long a fetched link title is reused when the
+// RoomConfig does not specify LinkTitleCacheTTL.
+const DefaultLinkTitleCacheTTL = time.Duration(10) * time.Minute
+
+type titleEntry struct {
+	title   string
+	fetched time.Time
+	posted  time.Time
+}
+
+// titleFetch is a fetch of a link title in progress, whose result other
+// fetches of the same link wait for.
+type titleFetch struct {
+	done  chan empty
+	title string
+	err   error
+}
+
+// titleCache remembers fetched link titles, so that a link posted repeatedly
+// is fetched once per ttl, and when each was last posted, so that its title
+// is posted at most once per window. It is safe for concurrent use.
+type titleCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	window  time.Duration
+	entries map[string]*titleEntry
+	// fetching holds the fetches in progress, by link.
+	fetching map[string]*titleFetch
+}
+
+func newTitleCache(ttl, window time.Duration) *titleCache {
+	return &titleCache{ttl: ttl, window: window, entries: make(map[string]*titleEntry),
+		fetching: make(map[string]*titleFetch)}
+}
+
+// fetch returns the result of get, which fetches the title of url, unless a
+// fetch of url is already in progress, in which case it waits for that
+// fetch's result instead.
+func (c *titleCache) fetch(url string, get func() (string, error)) (string, error) {
+	c.mu.Lock()
+	if f, ok := c.fetching[url]; ok {
+		c.mu.Unlock()
+		<-f.done
+		return f.title, f.err
+	}
+	f := &titleFetch{done: make(chan empty)}
+	c.fetching[url] = f
+	c.mu.Unlock()
+	f.title, f.err = get()
+	c.mu.Lock()
+	delete(c.fetching, url)
+	c.mu.Unlock()
+	close(f.done)
+	return f.title, f.err
+}
+
+// title returns the cached title of url and whether it was fetched within
+// the ttl.
+func (c *titleCache) title(url string, now time.Time) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[url]
+	if !ok || e.fetched.IsZero() || now.Sub(e.fetched) >= c.ttl {
+		return "", false
+	}
+	return e.title, true
+}
+
+func (c *titleCache) store(url, title string, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[url]
+	if !ok {
+		e = &titleEntry{}
+		c.entries[url] = e
+	}
+	e.title, e.fetched = title, now
+}
+
+// recentlyPosted reports whether url's title was posted within the window.
+func (c *titleCache) recentlyPosted(url string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[url]
+	return ok && !e.posted.IsZero() && now.Sub(e.posted) < c.window
+}
+
+// claimPost marks url's title posted at now unless it was already posted
+// within the window, reporting whether it did. Checking and marking at once
+// keeps messages whose titles are fetched concurrently from both posting it.
+func (c *titleCache) claimPost(url string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[url]
+	if !ok {
+		e = &titleEntry{}
+		c.entries[url] = e
+	}
+	if !e.posted.IsZero() && now.Sub(e.posted) < c.window {
+		return false
+	}
+	e.posted = now
+	return true
+}
+
+// expire forgets entries that are neither cached nor recently posted.
+func (c *titleCache) expire(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for url, e := range c.entries {
+		if now.Sub(e.fetched) >= c.ttl && now.Sub(e.posted) >= c.window {
+			delete(c.entries, url)
+		}
+	}
+}
+
+// newTitleCache returns a titleCache using the RoomConfig's
+// LinkTitleCacheTTL and LinkTitleWindow.
+func (r *Room) newTitleCache() *titleCache {
+	ttl, window := r.config.LinkTitleCacheTTL, r.config.LinkTitleWindow
+	if ttl <= 0 {
+		ttl = DefaultLinkTitleCacheTTL
+	}
+	if window <= 0 {
+		window = DefaultLinkTitleWindow
+	}
+	return newTitleCache(ttl, window)
+}
@@ -0,0 +1,109 @@
+package maimai
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const tzUsage = "Usage: !tz, !tz set <timezone>, or !tz clear, e.g. !tz set America/New_York"
+
+// userKey identifies user in per-user records: by user ID, or by nick if the
+// ID is unknown.
+func userKey(user *User) string {
+	if user.ID != "" {
+		return user.ID
+	}
+	return user.Name
+}
+
+// storeTimezone records user's timezone preference in the "Timezones" bucket,
+// keyed by userKey. An empty zone clears it.
+func (r *Room) storeTimezone(user *User, zone string) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("Timezones"))
+		if zone == "" {
+			return b.Delete([]byte(userKey(user)))
+		}
+		return b.Put([]byte(userKey(user)), []byte(zone))
+	})
+}
+
+// retrieveTimezone returns user's timezone preference, or "" if they have not
+// set one.
+func (r *Room) retrieveTimezone(user *User) (string, error) {
+	var zone string
+	err := r.db.View(func(tx *bolt.Tx) error {
+		zone = string(tx.Bucket([]byte("Timezones")).Get([]byte(userKey(user))))
+		return nil
+	})
+	return zone, err
+}
+
+// UserLocation returns the location time-related replies to user should use:
+// their timezone preference, or UTC if they have not set a valid one.
+func (r *Room) UserLocation(user *User) (*time.Location, error) {
+	zone, err := r.retrieveTimezone(user)
+	if err != nil || zone == "" {
+		return time.UTC, err
+	}
+	loc, err := loadTimezone(zone)
+	if err != nil {
+		return time.UTC, nil
+	}
+	return loc, nil
+}
+
+// TimezoneCommandHandler handles the !tz command, with which users set, clear,
+// and check the timezone used for their !time and !remind replies.
+func TimezoneCommandHandler(room *Room, input chan PacketEvent, cmdChan chan string) {
+	for {
+		select {
+		case packet := <-input:
+			if packet.Type != SendEventType {
+				continue
+			}
+			data := GetMessagePayload(&packet)
+			fields := strings.Fields(room.commandContent(data.Content))
+			if len(fields) == 0 || fields[0] != "!tz" {
+				continue
+			}
+			var err error
+			switch {
+			case len(fields) == 1:
+				var zone string
+				if zone, err = room.retrieveTimezone(&data.Sender); err == nil {
+					if zone == "" {
+						room.reply(data, "You have not set a timezone, so UTC is used.")
+					} else {
+						room.reply(data, fmt.Sprintf("Your timezone is %s.", zone))
+					}
+				}
+			case len(fields) == 2 && fields[1] == "clear":
+				if err = room.storeTimezone(&data.Sender, ""); err == nil {
+					room.reply(data, "Timezone cleared, UTC will be used.")
+				}
+			case len(fields) == 3 && fields[1] == "set":
+				if _, lerr := loadTimezone(fields[2]); lerr != nil {
+					room.reply(data, fmt.Sprintf("Unknown timezone %s. %s", SanitizeContent(fields[2]), tzUsage))
+					continue
+				}
+				if err = room.storeTimezone(&data.Sender, fields[2]); err == nil {
+					room.reply(data, fmt.Sprintf("Timezone set to %s.", fields[2]))
+				}
+			default:
+				room.reply(data, tzUsage)
+			}
+			if err != nil {
+				room.errChan <- err
+				return
+			}
+		case cmd := <-cmdChan:
+			if cmd == "kill" {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package maimai
+
+import "strings"
+
+// maxSuggestionDistance is the largest edit distance at which SuggestCommand
+// will suggest a known command.
+const maxSuggestionDistance = 2
+
+// levenshtein returns the edit distance between a and b.
+func levenshtein(a, b string) int {
+	s, t := []rune(a), []rune(b)
+	prev := make([]int, len(t)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(s); i++ {
+		cur := make([]int, len(t)+1)
+		cur[0] = i
+		for j := 1; j <= len(t); j++ {
+			cost := 1
+			if s[i-1] == t[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+		}
+		prev = cur
+	}
+	return prev[len(t)]
+}
+
+// closestCommand returns the command in known nearest to cmd, or "" if none
+// is within maxSuggestionDistance. Ties go to the earlier command.
+func closestCommand(cmd string, known []string) string {
+	best, bestDist := "", maxSuggestionDistance+1
+	for _, k := range known {
+		if d := levenshtein(cmd, k); d < bestDist {
+			best, bestDist = k, d
+		}
+	}
+	return best
+}
+
+// knownCommands returns the built-in commands, the RoomConfig's
+// KnownCommands, and the alias triggers.
+func (r *Room) knownCommands() ([]string, error) {
+	triggers, err := r.retrieveAliasTriggers()
+	if err != nil {
+		return nil, err
+	}
+	known := append([]string{}, builtinCommands...)
+	known = append(known, r.config.KnownCommands...)
+	return append(known, triggers...), nil
+}
+
+// displayCommand returns cmd, in its DefaultCommandPrefix form, as a user
+// would type it with the room's command prefix.
+func (r *Room) displayCommand(cmd string) string {
+	if r.config.CommandPrefix == "" {
+		return cmd
+	}
+	return r.config.CommandPrefix + cmd[len(DefaultCommandPrefix):]
+}
+
+// SuggestCommand is an OnUnknownCommand callback that replies with the known
+// command closest to cmd, if there is one close enough to be a typo.
+func SuggestCommand(room *Room, msg *Message, cmd string) {
+	known, err := room.knownCommands()
+	if err != nil {
+		room.Logger.Errorf("Error listing known commands: %s", err)
+		return
+	}
+	suggestion := closestCommand(cmd, known)
+	if suggestion == "" {
+		return
+	}
+	room.SendText(room.render("command.unknown", map[string]interface{}{
+		"Command":    SanitizeContent(room.displayCommand(cmd)),
+		"Suggestion": room.displayCommand(suggestion)}), msg.ID)
+}
+
+// UnknownCommandHandler handles send-events and calls the RoomConfig's
+// OnUnknownCommand for commands that are not built in, listed in
+// KnownCommands, or alias triggers.
+func UnknownCommandHandler(room *Room, input chan PacketEvent, cmdChan chan string) {
+	for {
+		select {
+		case packet := <-input:
+			if packet.Type != SendEventType {
+				continue
+			}
+			data := GetMessagePayload(&packet)
+			cmd := commandOf(room.commandContent(data.Content))
+			if len(cmd) <= len(DefaultCommandPrefix) || !strings.HasPrefix(cmd, DefaultCommandPrefix) {
+				continue
+			}
+			known, err := room.knownCommands()
+			if err != nil {
+				room.errChan <- err
+				return
+			}
+			if containsCommand(known, cmd) {
+				continue
+			}
+			room.config.OnUnknownCommand(room, data, cmd)
+		case cmd := <-cmdChan:
+			if cmd == "kill" {
+				return
+			}
+		}
+	}
+}